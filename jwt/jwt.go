@@ -0,0 +1,217 @@
+package jwt
+
+// Verification of JSON Web Tokens (RFC 7519) signed with HS256, RS256 or ES256.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed   = errors.New("jwt: malformed token")
+	ErrAlgorithm   = errors.New("jwt: algorithm not allowed")
+	ErrUnknownKey  = errors.New("jwt: unknown key")
+	ErrSignature   = errors.New("jwt: invalid signature")
+	ErrExpired     = errors.New("jwt: token expired")
+	ErrNotYetValid = errors.New("jwt: token not valid yet")
+	ErrIssuer      = errors.New("jwt: wrong issuer")
+	ErrAudience    = errors.New("jwt: wrong audience")
+)
+
+// Verification keys by key id ("kid" header), tokens without kid use the "" key.
+//
+// Values are []byte for HS256, *rsa.PublicKey for RS256 and *ecdsa.PublicKey (P-256) for ES256.
+type KeySet map[string]any
+
+// Claims of a verified token.
+type Claims map[string]any
+
+// Returns the "sub" claim.
+func (claims Claims) Subject() string {
+	subject, _ := claims["sub"].(string)
+	return subject
+}
+
+// Returns the "exp" claim and whether it is set.
+func (claims Claims) ExpiresAt() (time.Time, bool) {
+	return claims.time("exp")
+}
+
+// Returns a NumericDate claim.
+func (claims Claims) time(name string) (time.Time, bool) {
+	seconds, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// Returns true if the "aud" claim, a string or a list, contains audience.
+func (claims Claims) HasAudience(audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []any:
+		return slices.Contains(aud, any(audience))
+	}
+	return false
+}
+
+// Checks tokens against a key set.
+type Verifier struct {
+	Keys KeySet
+	// Accepted algorithms, empty accepts HS256, RS256 and ES256
+	Algorithms []string
+	// Required "iss" and "aud" claims (empty skips the check)
+	Issuer   string
+	Audience string
+	// Tolerated clock difference for "exp" and "nbf"
+	Leeway time.Duration
+	// Current time (nil uses time.Now)
+	Now func() time.Time
+}
+
+// Header of a token.
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// Verifies the signature and the time, issuer and audience claims of a token.
+//
+// Returns the claims and a error (can be nil)
+func (verifier *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var head header
+	if err := decodeSegment(parts[0], &head); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	if !verifier.allowed(head.Algorithm) {
+		return nil, ErrAlgorithm
+	}
+	key, ok := verifier.Keys[head.KeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if err := verifySignature(head.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, verifier.Validate(claims)
+}
+
+// Checks the time, issuer and audience claims of verified claims, for example again later.
+//
+// Returns a error (can be nil)
+func (verifier *Verifier) Validate(claims Claims) error {
+	now := time.Now()
+	if verifier.Now != nil {
+		now = verifier.Now()
+	}
+	if expires, ok := claims.ExpiresAt(); ok && !now.Before(expires.Add(verifier.Leeway)) {
+		return ErrExpired
+	}
+	if notBefore, ok := claims.time("nbf"); ok && now.Add(verifier.Leeway).Before(notBefore) {
+		return ErrNotYetValid
+	}
+	if issuer, _ := claims["iss"].(string); verifier.Issuer != "" && issuer != verifier.Issuer {
+		return ErrIssuer
+	}
+	if verifier.Audience != "" && !claims.HasAudience(verifier.Audience) {
+		return ErrAudience
+	}
+	return nil
+}
+
+// Returns true if the algorithm is accepted.
+func (verifier *Verifier) allowed(algorithm string) bool {
+	if len(verifier.Algorithms) == 0 {
+		return algorithm == "HS256" || algorithm == "RS256" || algorithm == "ES256"
+	}
+	return slices.Contains(verifier.Algorithms, algorithm)
+}
+
+// Checks a signature, the key type has to match the algorithm.
+//
+// Returns a error (can be nil)
+func verifySignature(algorithm string, key any, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch algorithm {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrAlgorithm
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return ErrSignature
+		}
+
+	case "RS256":
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrAlgorithm
+		}
+		if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) != nil {
+			return ErrSignature
+		}
+
+	case "ES256":
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || publicKey.Curve != elliptic.P256() {
+			return ErrAlgorithm
+		}
+		// R and S, 32 bytes each
+		if len(signature) != 64 {
+			return ErrSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return ErrSignature
+		}
+
+	default:
+		return ErrAlgorithm
+	}
+	return nil
+}
+
+// Decodes a base64url JSON segment.
+//
+// Returns a error (can be nil)
+func decodeSegment(segment string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keys shared by the tests, RSA key generation is slow.
+var (
+	secret      = []byte("secret")
+	rsaKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+	ecdsaKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+// Encodes a value as a base64url JSON segment.
+func segment(value any) string {
+	data, _ := json.Marshal(value)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Creates a token, key is the secret or private key matching alg.
+func sign(t *testing.T, head map[string]any, claims map[string]any, key any) string {
+	t.Helper()
+	signed := segment(head) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	at := func(offset time.Duration) float64 { return float64(now.Add(offset).Unix()) }
+	// The RSA public key as an HMAC secret, the classic algorithm confusion attack
+	rsaPublic, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+
+	tests := []struct {
+		name     string
+		token    func(t *testing.T) string
+		verifier Verifier
+		err      error
+	}{
+		{"HS256", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"sub": "alice"}, secret)
+		}, Verifier{}, nil},
+		{"RS256", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "RS256", "kid": "rsa"}, map[string]any{"sub": "alice"}, rsaKey)
+		}, Verifier{}, nil},
+		{"ES256", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "ES256", "kid": "ec"}, map[string]any{"sub": "alice"}, ecdsaKey)
+		}, Verifier{}, nil},
+		{"alg none", func(t *testing.T) string {
+			return segment(map[string]any{"alg": "none"}) + "." + segment(map[string]any{"sub": "alice"}) + "."
+		}, Verifier{}, ErrAlgorithm},
+		{"alg none allowed by mistake", func(t *testing.T) string {
+			return segment(map[string]any{"alg": "none"}) + "." + segment(map[string]any{"sub": "alice"}) + "."
+		}, Verifier{Algorithms: []string{"none"}}, ErrAlgorithm},
+		{"HS256 signed with the RSA public key", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256", "kid": "rsa"}, map[string]any{"sub": "alice"}, rsaPublic)
+		}, Verifier{}, ErrAlgorithm},
+		{"ES256 with an RSA key", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "ES256", "kid": "rsa"}, map[string]any{"sub": "alice"}, ecdsaKey)
+		}, Verifier{}, ErrAlgorithm},
+		{"algorithm not in Algorithms", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"sub": "alice"}, secret)
+		}, Verifier{Algorithms: []string{"RS256"}}, ErrAlgorithm},
+		{"unknown kid", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256", "kid": "other"}, map[string]any{"sub": "alice"}, secret)
+		}, Verifier{}, ErrUnknownKey},
+		{"wrong secret", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"sub": "alice"}, []byte("guess"))
+		}, Verifier{}, ErrSignature},
+		{"RS256 from another key", func(t *testing.T) string {
+			other, _ := rsa.GenerateKey(rand.Reader, 1024)
+			return sign(t, map[string]any{"alg": "RS256", "kid": "rsa"}, map[string]any{"sub": "alice"}, other)
+		}, Verifier{}, ErrSignature},
+		{"tampered claims", func(t *testing.T) string {
+			token := sign(t, map[string]any{"alg": "ES256", "kid": "ec"}, map[string]any{"sub": "alice"}, ecdsaKey)
+			parts := strings.Split(token, ".")
+			return parts[0] + "." + segment(map[string]any{"sub": "admin"}) + "." + parts[2]
+		}, Verifier{}, ErrSignature},
+		{"short ES256 signature", func(t *testing.T) string {
+			token := sign(t, map[string]any{"alg": "ES256", "kid": "ec"}, map[string]any{"sub": "alice"}, ecdsaKey)
+			return token[:len(token)-4]
+		}, Verifier{}, ErrSignature},
+		{"two segments", func(t *testing.T) string {
+			return segment(map[string]any{"alg": "HS256"}) + "." + segment(map[string]any{})
+		}, Verifier{}, ErrMalformed},
+		{"header not base64", func(t *testing.T) string { return "!!.e30.AA" }, Verifier{}, ErrMalformed},
+		{"header not JSON", func(t *testing.T) string {
+			return base64.RawURLEncoding.EncodeToString([]byte("{")) + ".e30.AA"
+		}, Verifier{}, ErrMalformed},
+		{"expired", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"exp": at(-time.Minute)}, secret)
+		}, Verifier{}, ErrExpired},
+		{"expires now", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"exp": at(0)}, secret)
+		}, Verifier{}, ErrExpired},
+		{"expired within leeway", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"exp": at(-time.Minute)}, secret)
+		}, Verifier{Leeway: 2 * time.Minute}, nil},
+		{"expired beyond leeway", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"exp": at(-3 * time.Minute)}, secret)
+		}, Verifier{Leeway: 2 * time.Minute}, ErrExpired},
+		{"not valid yet", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"nbf": at(time.Minute)}, secret)
+		}, Verifier{}, ErrNotYetValid},
+		{"not valid yet within leeway", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"nbf": at(time.Minute)}, secret)
+		}, Verifier{Leeway: 2 * time.Minute}, nil},
+		{"valid window", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"nbf": at(-time.Minute), "exp": at(time.Minute)}, secret)
+		}, Verifier{}, nil},
+		{"issuer", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"iss": "https://auth.example.com"}, secret)
+		}, Verifier{Issuer: "https://auth.example.com"}, nil},
+		{"wrong issuer", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"iss": "https://evil.example.com"}, secret)
+		}, Verifier{Issuer: "https://auth.example.com"}, ErrIssuer},
+		{"missing issuer", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{}, secret)
+		}, Verifier{Issuer: "https://auth.example.com"}, ErrIssuer},
+		{"audience string", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"aud": "chat"}, secret)
+		}, Verifier{Audience: "chat"}, nil},
+		{"audience list", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"aud": []string{"api", "chat"}}, secret)
+		}, Verifier{Audience: "chat"}, nil},
+		{"wrong audience", func(t *testing.T) string {
+			return sign(t, map[string]any{"alg": "HS256"}, map[string]any{"aud": []string{"api"}}, secret)
+		}, Verifier{Audience: "chat"}, ErrAudience},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := test.verifier
+			verifier.Keys = KeySet{"": secret, "rsa": &rsaKey.PublicKey, "ec": &ecdsaKey.PublicKey}
+			verifier.Now = func() time.Time { return now }
+			claims, err := verifier.Verify(test.token(t))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+			if err == nil && claims == nil {
+				t.Error("no claims returned")
+			}
+		})
+	}
+}
+
+func TestClaims(t *testing.T) {
+	claims := Claims{"sub": "alice", "exp": float64(1_700_000_000), "aud": []any{"api", "chat"}}
+	if claims.Subject() != "alice" {
+		t.Errorf("Subject() = %q", claims.Subject())
+	}
+	if expires, ok := claims.ExpiresAt(); !ok || expires.Unix() != 1_700_000_000 {
+		t.Errorf("ExpiresAt() = %v, %v", expires, ok)
+	}
+	if !claims.HasAudience("chat") || claims.HasAudience("admin") {
+		t.Error("HasAudience does not match the list")
+	}
+	if _, ok := (Claims{"exp": "tomorrow"}).ExpiresAt(); ok {
+		t.Error("a string exp claim was accepted")
+	}
+}
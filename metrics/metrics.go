@@ -0,0 +1,265 @@
+package metrics
+
+// Import containing counters for servers and clients, served in the Prometheus text format.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mithril/websocket"
+	"mithril/wsclient"
+	"mithril/wsserver"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the ping round trip histogram, in seconds
+var RTTBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Compile time checks, a Registry can be used by servers and clients
+var (
+	_ wsserver.Metrics       = (*Registry)(nil)
+	_ wsclient.ClientMetrics = (*Registry)(nil)
+	_ http.Handler           = (*Registry)(nil)
+)
+
+// Counters of a server or client, see wsserver.Server.Metrics and wsclient.Client.Metrics.
+//
+// It is also a http.Handler serving the counters in the Prometheus text format:
+//
+//	http.Handle("/metrics", registry)
+//
+// Give servers and clients of one process separate registries with different namespaces.
+type Registry struct {
+	namespace string
+
+	open     atomic.Int64
+	accepted atomic.Uint64
+	// Indexed by the message type (the opcode)
+	messagesIn  [11]atomic.Uint64
+	bytesIn     [11]atomic.Uint64
+	messagesOut [11]atomic.Uint64
+	bytesOut    [11]atomic.Uint64
+	writeQueue  atomic.Int64
+	// Ping round trips, counts per bucket plus one for +Inf
+	rttCounts []atomic.Uint64
+	rttSum    atomic.Int64
+
+	// Counters with free form labels, guarded by mu
+	mu       sync.Mutex
+	rejected map[string]uint64
+	dropped  map[string]uint64
+	closes   map[uint16]uint64
+}
+
+// Creates an empty registry, metric names start with namespace ("mithril" if empty).
+func NewRegistry(namespace string) *Registry {
+	if namespace == "" {
+		namespace = "mithril"
+	}
+	return &Registry{
+		namespace: namespace,
+		rttCounts: make([]atomic.Uint64, len(RTTBuckets)+1),
+		rejected:  make(map[string]uint64),
+		dropped:   make(map[string]uint64),
+		closes:    make(map[uint16]uint64),
+	}
+}
+
+func (registry *Registry) HandshakeAccepted() {
+	registry.accepted.Add(1)
+	registry.open.Add(1)
+}
+
+func (registry *Registry) HandshakeRejected(reason string) {
+	registry.mu.Lock()
+	registry.rejected[reason]++
+	registry.mu.Unlock()
+}
+
+func (registry *Registry) ConnectionClosed() {
+	registry.open.Add(-1)
+}
+
+func (registry *Registry) MessageReceived(messageType websocket.MessageType, size int) {
+	if int(messageType) < len(registry.messagesIn) {
+		registry.messagesIn[messageType].Add(1)
+		registry.bytesIn[messageType].Add(uint64(size))
+	}
+}
+
+func (registry *Registry) MessageSent(messageType websocket.MessageType, size int) {
+	if int(messageType) < len(registry.messagesOut) {
+		registry.messagesOut[messageType].Add(1)
+		registry.bytesOut[messageType].Add(uint64(size))
+	}
+}
+
+func (registry *Registry) MessageDropped(reason string) {
+	registry.mu.Lock()
+	registry.dropped[reason]++
+	registry.mu.Unlock()
+}
+
+func (registry *Registry) PingRTT(rtt time.Duration) {
+	bucket, _ := slices.BinarySearch(RTTBuckets, rtt.Seconds())
+	registry.rttCounts[bucket].Add(1)
+	registry.rttSum.Add(int64(rtt))
+}
+
+func (registry *Registry) CloseSent(code uint16) {
+	registry.mu.Lock()
+	registry.closes[code]++
+	registry.mu.Unlock()
+}
+
+func (registry *Registry) WriteQueued(delta int) {
+	registry.writeQueue.Add(int64(delta))
+}
+
+// Serves the counters in the Prometheus text format.
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.WriteTo(w)
+}
+
+// Writes the counters in the Prometheus text format.
+//
+// Returns the amount of bytes written and error (can be nil)
+func (registry *Registry) WriteTo(w io.Writer) (int64, error) {
+	out := &exposition{writer: bufio.NewWriter(w), namespace: registry.namespace}
+
+	out.family("connections_open", "gauge", "Clients that completed the handshake and are still connected.")
+	out.sample("connections_open", "", float64(registry.open.Load()))
+
+	out.family("handshakes_accepted_total", "counter", "Handshakes that completed.")
+	out.sample("handshakes_accepted_total", "", float64(registry.accepted.Load()))
+
+	registry.mu.Lock()
+	rejected := sortedCounts(registry.rejected)
+	dropped := sortedCounts(registry.dropped)
+	codes := make([]uint16, 0, len(registry.closes))
+	for code := range registry.closes {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	closes := make([]labelCount, len(codes))
+	for i, code := range codes {
+		closes[i] = labelCount{strconv.Itoa(int(code)), registry.closes[code]}
+	}
+	registry.mu.Unlock()
+
+	out.family("handshakes_rejected_total", "counter", "Handshakes refused or aborted, by reason.")
+	for _, entry := range rejected {
+		out.sample("handshakes_rejected_total", label("reason", entry.label), float64(entry.count))
+	}
+
+	for _, direction := range []struct {
+		name     string
+		messages *[11]atomic.Uint64
+		bytes    *[11]atomic.Uint64
+	}{
+		{"received", &registry.messagesIn, &registry.bytesIn},
+		{"sent", &registry.messagesOut, &registry.bytesOut},
+	} {
+		out.family("messages_"+direction.name+"_total", "counter", "Messages and control frames "+direction.name+", by type.")
+		for _, messageType := range messageTypes {
+			out.sample("messages_"+direction.name+"_total", label("type", messageType.String()), float64(direction.messages[messageType].Load()))
+		}
+		out.family(direction.name+"_bytes_total", "counter", "Payload bytes "+direction.name+", by message type.")
+		for _, messageType := range messageTypes {
+			out.sample(direction.name+"_bytes_total", label("type", messageType.String()), float64(direction.bytes[messageType].Load()))
+		}
+	}
+
+	out.family("messages_dropped_total", "counter", "Received messages that were skipped, by reason.")
+	for _, entry := range dropped {
+		out.sample("messages_dropped_total", label("reason", entry.label), float64(entry.count))
+	}
+
+	out.family("close_frames_sent_total", "counter", "Close frames sent, by status code.")
+	for _, entry := range closes {
+		out.sample("close_frames_sent_total", label("code", entry.label), float64(entry.count))
+	}
+
+	out.family("write_queue_depth", "gauge", "Writers waiting for another writer of the same connection.")
+	out.sample("write_queue_depth", "", float64(registry.writeQueue.Load()))
+
+	out.family("ping_rtt_seconds", "histogram", "Round trip time of pings answered by a pong.")
+	var cumulative uint64
+	for i, bound := range RTTBuckets {
+		cumulative += registry.rttCounts[i].Load()
+		out.sample("ping_rtt_seconds_bucket", label("le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(cumulative))
+	}
+	cumulative += registry.rttCounts[len(RTTBuckets)].Load()
+	out.sample("ping_rtt_seconds_bucket", label("le", "+Inf"), float64(cumulative))
+	out.sample("ping_rtt_seconds_sum", "", time.Duration(registry.rttSum.Load()).Seconds())
+	out.sample("ping_rtt_seconds_count", "", float64(cumulative))
+
+	if out.err == nil {
+		out.err = out.writer.Flush()
+	}
+	return out.written, out.err
+}
+
+// Message types in the order they are exposed
+var messageTypes = []websocket.MessageType{
+	websocket.TextMessage, websocket.BinaryMessage, websocket.CloseMessage, websocket.PingMessage, websocket.PongMessage,
+}
+
+// A label value and its count.
+type labelCount struct {
+	label string
+	count uint64
+}
+
+// Returns the entries of counts sorted by label.
+func sortedCounts(counts map[string]uint64) []labelCount {
+	entries := make([]labelCount, 0, len(counts))
+	for label, count := range counts {
+		entries = append(entries, labelCount{label, count})
+	}
+	slices.SortFunc(entries, func(a, b labelCount) int { return strings.Compare(a.label, b.label) })
+	return entries
+}
+
+// Returns a label pair with the value escaped.
+func label(name string, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
+
+// Writer of the text format, keeping the first error.
+type exposition struct {
+	writer    *bufio.Writer
+	namespace string
+	written   int64
+	err       error
+}
+
+// Writes the HELP and TYPE lines of a metric.
+func (out *exposition) family(name string, kind string, help string) {
+	out.printf("# HELP %s_%s %s\n# TYPE %s_%s %s\n", out.namespace, name, help, out.namespace, name, kind)
+}
+
+// Writes one sample, labels can be empty.
+func (out *exposition) sample(name string, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	out.printf("%s_%s%s %s\n", out.namespace, name, labels, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (out *exposition) printf(format string, args ...any) {
+	if out.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(out.writer, format, args...)
+	out.written += int64(n)
+	out.err = err
+}
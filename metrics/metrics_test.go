@@ -0,0 +1,239 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"mithril/websocket"
+	"mithril/wsclient"
+	"mithril/wsserver"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the text exposition of registry.
+func scrape(t *testing.T, registry *Registry) string {
+	t.Helper()
+	var out bytes.Buffer
+	n, err := registry.WriteTo(&out)
+	if err != nil || n != int64(out.Len()) {
+		t.Fatalf("WriteTo wrote %d of %d bytes: %v", n, out.Len(), err)
+	}
+	return out.String()
+}
+
+// Returns the value of the sample with the given name and labels, empty if there is none.
+func sample(text string, name string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if value, ok := strings.CutPrefix(line, name+" "); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestFamilies(t *testing.T) {
+	text := scrape(t, NewRegistry("test"))
+	families := []struct{ name, kind string }{
+		{"connections_open", "gauge"},
+		{"handshakes_accepted_total", "counter"},
+		{"handshakes_rejected_total", "counter"},
+		{"messages_received_total", "counter"},
+		{"received_bytes_total", "counter"},
+		{"messages_sent_total", "counter"},
+		{"sent_bytes_total", "counter"},
+		{"messages_dropped_total", "counter"},
+		{"close_frames_sent_total", "counter"},
+		{"write_queue_depth", "gauge"},
+		{"ping_rtt_seconds", "histogram"},
+	}
+	for _, family := range families {
+		help := "# HELP test_" + family.name + " "
+		kind := "# TYPE test_" + family.name + " " + family.kind + "\n"
+		if !strings.Contains(text, help) || !strings.Contains(text, kind) {
+			t.Errorf("no HELP and TYPE %s lines for %s", family.kind, family.name)
+		}
+	}
+	if !strings.HasPrefix(text, "# HELP test_connections_open ") || !strings.HasSuffix(text, "\n") {
+		t.Errorf("unexpected framing:\n%s", text)
+	}
+	if sample(scrape(t, NewRegistry("")), "mithril_connections_open") != "0" {
+		t.Error("empty namespace does not default to mithril")
+	}
+}
+
+func TestCounters(t *testing.T) {
+	registry := NewRegistry("test")
+	registry.HandshakeAccepted()
+	registry.HandshakeAccepted()
+	registry.ConnectionClosed()
+	registry.MessageReceived(websocket.TextMessage, 5)
+	registry.MessageReceived(websocket.TextMessage, 7)
+	registry.MessageSent(websocket.PongMessage, 3)
+	registry.MessageDropped("rate_limit")
+	registry.WriteQueued(2)
+	registry.WriteQueued(-1)
+	text := scrape(t, registry)
+
+	for name, want := range map[string]string{
+		"test_connections_open":                            "1",
+		"test_handshakes_accepted_total":                   "2",
+		`test_messages_received_total{type="text"}`:        "2",
+		`test_received_bytes_total{type="text"}`:           "12",
+		`test_messages_received_total{type="binary"}`:      "0",
+		`test_messages_sent_total{type="pong"}`:            "1",
+		`test_sent_bytes_total{type="pong"}`:               "3",
+		`test_messages_dropped_total{reason="rate_limit"}`: "1",
+		"test_write_queue_depth":                           "1",
+	} {
+		if got := sample(text, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestPingHistogram(t *testing.T) {
+	registry := NewRegistry("test")
+	for _, rtt := range []time.Duration{
+		500 * time.Microsecond,
+		// Equal to a bound, counted in that bucket
+		5 * time.Millisecond,
+		3 * time.Millisecond,
+		// Above the last bound
+		10 * time.Second,
+	} {
+		registry.PingRTT(rtt)
+	}
+	text := scrape(t, registry)
+
+	buckets := []struct{ le, count string }{
+		{"0.001", "1"}, {"0.0025", "1"}, {"0.005", "3"}, {"0.01", "3"}, {"0.025", "3"}, {"0.05", "3"},
+		{"0.1", "3"}, {"0.25", "3"}, {"0.5", "3"}, {"1", "3"}, {"2.5", "3"}, {"5", "3"}, {"+Inf", "4"},
+	}
+	if len(buckets) != len(RTTBuckets)+1 {
+		t.Fatalf("the test covers %d buckets, there are %d", len(buckets)-1, len(RTTBuckets))
+	}
+	for _, bucket := range buckets {
+		if got := sample(text, `test_ping_rtt_seconds_bucket{le="`+bucket.le+`"}`); got != bucket.count {
+			t.Errorf("bucket le=%s = %q, want %s", bucket.le, got, bucket.count)
+		}
+	}
+	if got := sample(text, "test_ping_rtt_seconds_sum"); got != "10.0085" {
+		t.Errorf("sum = %q, want 10.0085", got)
+	}
+	if got := sample(text, "test_ping_rtt_seconds_count"); got != "4" {
+		t.Errorf("count = %q, want 4", got)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	registry := NewRegistry("test")
+	registry.HandshakeRejected("a\"b\\c\nd")
+	registry.HandshakeRejected("plain")
+	registry.HandshakeRejected("plain")
+	text := scrape(t, registry)
+
+	if got := sample(text, `test_handshakes_rejected_total{reason="a\"b\\c\nd"}`); got != "1" {
+		t.Errorf("escaped sample = %q in\n%s", got, text)
+	}
+	if got := sample(text, `test_handshakes_rejected_total{reason="plain"}`); got != "2" {
+		t.Errorf("plain sample = %q", got)
+	}
+	// Samples are sorted by label
+	if strings.Index(text, `reason="a`) > strings.Index(text, `reason="plain"`) {
+		t.Error("labels are not sorted")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	registry := NewRegistry("test")
+	registry.HandshakeAccepted()
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if got := recorder.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type %q", got)
+	}
+	if recorder.Code != http.StatusOK || sample(recorder.Body.String(), "test_handshakes_accepted_total") != "1" {
+		t.Errorf("got %d with\n%s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// Counters fed by a real server, rejecting clients that ask for /ws?deny and closing the others with 4000.
+func TestServerCounters(t *testing.T) {
+	registry := NewRegistry("test")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	srv := wsserver.NewServer("127.0.0.1", port)
+	srv.Metrics = registry
+	srv.CheckHandshake = func(ws *websocket.Ws) (http.Header, error) {
+		if ws.Query.Has("deny") {
+			return nil, errors.New("denied")
+		}
+		return nil, nil
+	}
+	go srv.ListenAndServe(func(ws *websocket.Ws, srv *wsserver.Server) (uint16, error) {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			return 1000, err
+		}
+		ws.WriteMessage(messageType, data)
+		ws.Close(4000, "bye")
+		return 4000, nil
+	}, "/ws")
+	address := net.JoinHostPort("127.0.0.1", port)
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("server did not start")
+		}
+	}
+
+	var handshakeError *wsclient.HandshakeError
+	err = wsclient.ConnectURL("ws://"+address+"/ws?deny", func(ws *wsclient.ClientWs) {}, nil)
+	if !errors.As(err, &handshakeError) || handshakeError.StatusCode != 403 {
+		t.Fatalf("got %v, want a 403 handshake error", err)
+	}
+	err = wsclient.ConnectURL("ws://"+address+"/ws", func(ws *wsclient.ClientWs) {
+		ws.WriteText("hello")
+		ws.ReadMessage()
+		// Returns once the close frame arrived
+		ws.ReadMessage()
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		`test_handshakes_rejected_total{reason="check_handshake"}`: "1",
+		"test_handshakes_accepted_total":                           "1",
+		`test_messages_received_total{type="text"}`:                "1",
+		`test_close_frames_sent_total{code="4000"}`:                "1",
+		"test_connections_open":                                    "0",
+	}
+	// The server counts the closed connection after the client saw its close frame
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(time.Millisecond) {
+		text, missing := scrape(t, registry), ""
+		for name, value := range want {
+			if sample(text, name) != value {
+				missing = name
+			}
+		}
+		if missing == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %q, want %q in\n%s", missing, sample(text, missing), want[missing], text)
+		}
+	}
+}
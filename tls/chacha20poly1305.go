@@ -0,0 +1,277 @@
+package tls
+
+// ChaCha20-Poly1305 AEAD (RFC 8439).
+// The standard library keeps its implementation internal, so here is one written from the RFC.
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+var errOpen = errors.New("tls: message authentication failed")
+
+type chacha20Poly1305 struct {
+	key [32]byte
+}
+
+// Creates a ChaCha20-Poly1305 AEAD from a 32 byte key.
+//
+// Returns a error (can be nil)
+func newChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("tls: bad ChaCha20-Poly1305 key length")
+	}
+	aead := &chacha20Poly1305{}
+	copy(aead.key[:], key)
+	return aead, nil
+}
+
+func (aead *chacha20Poly1305) NonceSize() int { return 12 }
+
+func (aead *chacha20Poly1305) Overhead() int { return 16 }
+
+func (aead *chacha20Poly1305) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	ret, out := sliceForAppend(dst, len(plaintext)+16)
+	ciphertext, tag := out[:len(plaintext)], out[len(plaintext):]
+
+	var polyKey [64]byte
+	chacha20Block(&aead.key, 0, nonce, &polyKey)
+	chacha20XOR(&aead.key, 1, nonce, ciphertext, plaintext)
+
+	sum := poly1305AEAD(polyKey[:32], additionalData, ciphertext)
+	copy(tag, sum[:])
+	return ret
+}
+
+func (aead *chacha20Poly1305) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < 16 {
+		return nil, errOpen
+	}
+	tag := ciphertext[len(ciphertext)-16:]
+	ciphertext = ciphertext[:len(ciphertext)-16]
+
+	var polyKey [64]byte
+	chacha20Block(&aead.key, 0, nonce, &polyKey)
+	sum := poly1305AEAD(polyKey[:32], additionalData, ciphertext)
+	if subtle.ConstantTimeCompare(sum[:], tag) != 1 {
+		return nil, errOpen
+	}
+
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	chacha20XOR(&aead.key, 1, nonce, out, ciphertext)
+	return ret, nil
+}
+
+// Grows dst by n bytes, returning the whole slice and the new tail.
+func sliceForAppend(dst []byte, n int) ([]byte, []byte) {
+	total := len(dst) + n
+	if cap(dst) >= total {
+		dst = dst[:total]
+	} else {
+		grown := make([]byte, total)
+		copy(grown, dst)
+		dst = grown
+	}
+	return dst, dst[total-n:]
+}
+
+func quarterRound(a, b, c, d uint32) (uint32, uint32, uint32, uint32) {
+	a += b
+	d = bits.RotateLeft32(d^a, 16)
+	c += d
+	b = bits.RotateLeft32(b^c, 12)
+	a += b
+	d = bits.RotateLeft32(d^a, 8)
+	c += d
+	b = bits.RotateLeft32(b^c, 7)
+	return a, b, c, d
+}
+
+// Computes one 64 byte keystream block.
+func chacha20Block(key *[32]byte, counter uint32, nonce []byte, out *[64]byte) {
+	var state [16]uint32
+	state[0], state[1], state[2], state[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		state[4+i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	state[12] = counter
+	state[13] = binary.LittleEndian.Uint32(nonce[0:])
+	state[14] = binary.LittleEndian.Uint32(nonce[4:])
+	state[15] = binary.LittleEndian.Uint32(nonce[8:])
+
+	x := state
+	for i := 0; i < 10; i++ {
+		// Column rounds
+		x[0], x[4], x[8], x[12] = quarterRound(x[0], x[4], x[8], x[12])
+		x[1], x[5], x[9], x[13] = quarterRound(x[1], x[5], x[9], x[13])
+		x[2], x[6], x[10], x[14] = quarterRound(x[2], x[6], x[10], x[14])
+		x[3], x[7], x[11], x[15] = quarterRound(x[3], x[7], x[11], x[15])
+		// Diagonal rounds
+		x[0], x[5], x[10], x[15] = quarterRound(x[0], x[5], x[10], x[15])
+		x[1], x[6], x[11], x[12] = quarterRound(x[1], x[6], x[11], x[12])
+		x[2], x[7], x[8], x[13] = quarterRound(x[2], x[7], x[8], x[13])
+		x[3], x[4], x[9], x[14] = quarterRound(x[3], x[4], x[9], x[14])
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[i*4:], x[i]+state[i])
+	}
+}
+
+// XORs src with the keystream starting at block counter into dst.
+func chacha20XOR(key *[32]byte, counter uint32, nonce []byte, dst []byte, src []byte) {
+	var block [64]byte
+	for len(src) > 0 {
+		chacha20Block(key, counter, nonce, &block)
+		n := min(len(src), 64)
+		for i := 0; i < n; i++ {
+			dst[i] = src[i] ^ block[i]
+		}
+		dst, src = dst[n:], src[n:]
+		counter++
+	}
+}
+
+// Authenticates additional data and ciphertext the way RFC 8439, 2.8 lays them out.
+func poly1305AEAD(key []byte, additionalData []byte, ciphertext []byte) [16]byte {
+	var p poly1305
+	p.init(key)
+	p.writePadded(additionalData)
+	p.writePadded(ciphertext)
+
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[0:], uint64(len(additionalData)))
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(ciphertext)))
+	p.block(lengths[:], 1<<24)
+	return p.sum()
+}
+
+// Poly1305 one-time authenticator using 26 bit limbs.
+type poly1305 struct {
+	r   [5]uint32
+	h   [5]uint32
+	pad [4]uint32
+}
+
+func (p *poly1305) init(key []byte) {
+	p.r[0] = binary.LittleEndian.Uint32(key[0:]) & 0x3ffffff
+	p.r[1] = (binary.LittleEndian.Uint32(key[3:]) >> 2) & 0x3ffff03
+	p.r[2] = (binary.LittleEndian.Uint32(key[6:]) >> 4) & 0x3ffc0ff
+	p.r[3] = (binary.LittleEndian.Uint32(key[9:]) >> 6) & 0x3f03fff
+	p.r[4] = (binary.LittleEndian.Uint32(key[12:]) >> 8) & 0x00fffff
+	for i := 0; i < 4; i++ {
+		p.pad[i] = binary.LittleEndian.Uint32(key[16+i*4:])
+	}
+}
+
+// Feeds data padded with zeros to a multiple of 16 bytes.
+func (p *poly1305) writePadded(data []byte) {
+	for len(data) >= 16 {
+		p.block(data[:16], 1<<24)
+		data = data[16:]
+	}
+	if len(data) > 0 {
+		var last [16]byte
+		copy(last[:], data)
+		p.block(last[:], 1<<24)
+	}
+}
+
+// Adds a 16 byte block to the accumulator and multiplies by r.
+func (p *poly1305) block(m []byte, hibit uint32) {
+	r0, r1, r2, r3, r4 := uint64(p.r[0]), uint64(p.r[1]), uint64(p.r[2]), uint64(p.r[3]), uint64(p.r[4])
+	s1, s2, s3, s4 := r1*5, r2*5, r3*5, r4*5
+
+	h0 := uint64(p.h[0] + binary.LittleEndian.Uint32(m[0:])&0x3ffffff)
+	h1 := uint64(p.h[1] + (binary.LittleEndian.Uint32(m[3:])>>2)&0x3ffffff)
+	h2 := uint64(p.h[2] + (binary.LittleEndian.Uint32(m[6:])>>4)&0x3ffffff)
+	h3 := uint64(p.h[3] + (binary.LittleEndian.Uint32(m[9:])>>6)&0x3ffffff)
+	h4 := uint64(p.h[4] + (binary.LittleEndian.Uint32(m[12:])>>8 | hibit))
+
+	d0 := h0*r0 + h1*s4 + h2*s3 + h3*s2 + h4*s1
+	d1 := h0*r1 + h1*r0 + h2*s4 + h3*s3 + h4*s2
+	d2 := h0*r2 + h1*r1 + h2*r0 + h3*s4 + h4*s3
+	d3 := h0*r3 + h1*r2 + h2*r1 + h3*r0 + h4*s4
+	d4 := h0*r4 + h1*r3 + h2*r2 + h3*r1 + h4*r0
+
+	// Carry propagation
+	c := d0 >> 26
+	p.h[0] = uint32(d0) & 0x3ffffff
+	d1 += c
+	c = d1 >> 26
+	p.h[1] = uint32(d1) & 0x3ffffff
+	d2 += c
+	c = d2 >> 26
+	p.h[2] = uint32(d2) & 0x3ffffff
+	d3 += c
+	c = d3 >> 26
+	p.h[3] = uint32(d3) & 0x3ffffff
+	d4 += c
+	c = d4 >> 26
+	p.h[4] = uint32(d4) & 0x3ffffff
+	p.h[0] += uint32(c) * 5
+	p.h[1] += p.h[0] >> 26
+	p.h[0] &= 0x3ffffff
+}
+
+// Reduces the accumulator modulo 2^130-5 and adds the pad.
+func (p *poly1305) sum() [16]byte {
+	h0, h1, h2, h3, h4 := p.h[0], p.h[1], p.h[2], p.h[3], p.h[4]
+
+	c := h1 >> 26
+	h1 &= 0x3ffffff
+	h2 += c
+	c = h2 >> 26
+	h2 &= 0x3ffffff
+	h3 += c
+	c = h3 >> 26
+	h3 &= 0x3ffffff
+	h4 += c
+	c = h4 >> 26
+	h4 &= 0x3ffffff
+	h0 += c * 5
+	c = h0 >> 26
+	h0 &= 0x3ffffff
+	h1 += c
+
+	// Compute h - p and keep it if it did not underflow
+	g0 := h0 + 5
+	c = g0 >> 26
+	g0 &= 0x3ffffff
+	g1 := h1 + c
+	c = g1 >> 26
+	g1 &= 0x3ffffff
+	g2 := h2 + c
+	c = g2 >> 26
+	g2 &= 0x3ffffff
+	g3 := h3 + c
+	c = g3 >> 26
+	g3 &= 0x3ffffff
+	g4 := h4 + c - (1 << 26)
+
+	mask := (g4 >> 31) - 1
+	h0 = (h0 &^ mask) | (g0 & mask)
+	h1 = (h1 &^ mask) | (g1 & mask)
+	h2 = (h2 &^ mask) | (g2 & mask)
+	h3 = (h3 &^ mask) | (g3 & mask)
+	h4 = (h4 &^ mask) | (g4 & mask)
+
+	// Repack into 32 bit words and add the pad
+	w0 := h0 | h1<<26
+	w1 := h1>>6 | h2<<20
+	w2 := h2>>12 | h3<<14
+	w3 := h3>>18 | h4<<8
+
+	var out [16]byte
+	f := uint64(w0) + uint64(p.pad[0])
+	binary.LittleEndian.PutUint32(out[0:], uint32(f))
+	f = uint64(w1) + uint64(p.pad[1]) + f>>32
+	binary.LittleEndian.PutUint32(out[4:], uint32(f))
+	f = uint64(w2) + uint64(p.pad[2]) + f>>32
+	binary.LittleEndian.PutUint32(out[8:], uint32(f))
+	f = uint64(w3) + uint64(p.pad[3]) + f>>32
+	binary.LittleEndian.PutUint32(out[12:], uint32(f))
+	return out
+}
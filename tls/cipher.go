@@ -0,0 +1,152 @@
+package tls
+
+// TLS 1.3 cipher suites and record protection (RFC 8446, 5.2).
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+var errDecrypt = errors.New("tls: failed to decrypt record")
+
+// TLS 1.3 cipher suite
+type cipherSuite struct {
+	id        uint16
+	keyLength int
+	hash      crypto.Hash
+	newHash   func() hash.Hash
+	aead      func(key []byte) (cipher.AEAD, error)
+}
+
+// Supported suites in order of preference.
+var cipherSuites13 []*cipherSuite = []*cipherSuite{
+	{TLS_AES_128_GCM_SHA256, 16, crypto.SHA256, sha256.New, aesGCM},
+	{TLS_CHACHA20_POLY1305_SHA256, 32, crypto.SHA256, sha256.New, newChaCha20Poly1305},
+	{TLS_AES_256_GCM_SHA384, 32, crypto.SHA384, sha512.New384, aesGCM},
+}
+
+// Returns the suite with the given id (can be nil).
+func cipherSuiteByID(id uint16) *cipherSuite {
+	for _, suite := range cipherSuites13 {
+		if suite.id == id {
+			return suite
+		}
+	}
+	return nil
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// One direction of a protected connection.
+type halfConn struct {
+	suite  *cipherSuite
+	secret []byte
+	aead   cipher.AEAD
+	iv     []byte
+	seq    uint64
+}
+
+// Derives key and IV from a traffic secret and resets the sequence number.
+//
+// Returns a error (can be nil)
+func (hc *halfConn) setTrafficSecret(suite *cipherSuite, secret []byte) error {
+	key := expandLabel(suite.newHash, secret, "key", nil, suite.keyLength)
+	aead, err := suite.aead(key)
+	if err != nil {
+		return err
+	}
+	hc.suite = suite
+	hc.secret = secret
+	hc.aead = aead
+	hc.iv = expandLabel(suite.newHash, secret, "iv", nil, 12)
+	hc.seq = 0
+	return nil
+}
+
+// Moves to the next traffic secret after a KeyUpdate.
+//
+// Returns a error (can be nil)
+func (hc *halfConn) update() error {
+	next := expandLabel(hc.suite.newHash, hc.secret, "traffic upd", nil, hc.suite.hash.Size())
+	return hc.setTrafficSecret(hc.suite, next)
+}
+
+// Per-record nonce, the IV XORed with the sequence number.
+func (hc *halfConn) nonce() []byte {
+	nonce := make([]byte, len(hc.iv))
+	copy(nonce, hc.iv)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], hc.seq)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-8+i] ^= seq[i]
+	}
+	return nonce
+}
+
+// Protects data of the given content type, or leaves it as plaintext before keys are set.
+//
+// Returns the encoded record.
+func (hc *halfConn) seal(contentType byte, data []byte) []byte {
+	if hc.aead == nil {
+		record := &TLSRecord{ContentType: contentType, Version: VersionTLS12, Fragment: data}
+		return record.Bytes()
+	}
+
+	// TLSInnerPlaintext: content followed by the real content type
+	inner := make([]byte, len(data)+1)
+	copy(inner, data)
+	inner[len(data)] = contentType
+
+	record := &TLSRecord{
+		ContentType: RecordApplicationData,
+		Version:     VersionTLS12,
+		Length:      uint16(len(inner) + hc.aead.Overhead()),
+	}
+	header := record.Header()
+	record.Fragment = hc.aead.Seal(nil, hc.nonce(), inner, header)
+	hc.seq++
+	return record.Bytes()
+}
+
+// Removes the protection of a record.
+//
+// Returns the real content type, the plaintext and a error (can be nil)
+func (hc *halfConn) open(record *TLSRecord) (byte, []byte, error) {
+	if hc.aead == nil || record.ContentType == RecordChangeCipherSpec {
+		return record.ContentType, record.Fragment, nil
+	}
+	if record.ContentType != RecordApplicationData {
+		return 0, nil, errors.New("tls: unprotected record after keys were set")
+	}
+
+	plaintext, err := hc.aead.Open(nil, hc.nonce(), record.Fragment, record.Header())
+	if err != nil {
+		return 0, nil, errDecrypt
+	}
+	hc.seq++
+
+	// Strip the zero padding, the last non zero byte is the content type
+	i := len(plaintext) - 1
+	for i >= 0 && plaintext[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil, errors.New("tls: record without content type")
+	}
+	if i > MaxPlaintext {
+		return 0, nil, errRecordOverflow
+	}
+	return plaintext[i], plaintext[:i], nil
+}
@@ -0,0 +1,682 @@
+package tls
+
+// Educational TLS 1.3 client (RFC 8446).
+// Supports X25519/P-256 key exchange, the three TLS 1.3 AEAD suites and
+// server authentication. No resumption, early data or client certificates.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var errUnexpectedMessage = errors.New("tls: unexpected handshake message")
+
+// Client configuration
+type Config struct {
+	// Name sent in SNI and checked against the certificate.
+	ServerName string
+	// Root CAs, the system pool is used when nil.
+	RootCAs *x509.CertPool
+	// Skips certificate chain and name checks. CertificateVerify is still checked.
+	InsecureSkipVerify bool
+	// ALPN protocols offered to the server.
+	NextProtos []string
+	// Overrides the time used for certificate validation.
+	Time func() time.Time
+}
+
+// A TLS 1.3 client connection.
+type Conn struct {
+	// Underlying connection, also provides the address and deadline methods.
+	net.Conn
+	config *Config
+
+	handshakeMu   sync.Mutex
+	handshakeDone bool
+	handshakeErr  error
+
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+	in      halfConn
+	out     halfConn
+	// Handshake bytes not yet parsed
+	handshakeBuf []byte
+	// Decrypted application data not yet returned by Read
+	input   []byte
+	readErr error
+
+	// Negotiated ALPN protocol (can be empty)
+	NegotiatedProtocol string
+	// Server certificates, leaf first
+	PeerCertificates []*x509.Certificate
+	// Negotiated cipher suite
+	CipherSuite uint16
+}
+
+// Wraps conn as the client side of a TLS 1.3 connection.
+//
+// The handshake runs on the first Read or Write, or when Handshake is called.
+func Client(conn net.Conn, config *Config) *Conn {
+	return &Conn{Conn: conn, config: config}
+}
+
+// Dials addr and completes a TLS 1.3 handshake.
+//
+// Returns a error (can be nil)
+func Dial(network string, addr string, config *Config) (*Conn, error) {
+	raw, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		copied := *config
+		copied.ServerName = host
+		config = &copied
+	}
+	conn := Client(raw, config)
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Runs the handshake if it has not run yet.
+//
+// Returns a error (can be nil)
+func (c *Conn) Handshake() error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if !c.handshakeDone {
+		c.handshakeErr = c.clientHandshake()
+		c.handshakeDone = true
+		if c.handshakeErr != nil {
+			c.sendAlert(AlertLevelFatal, alertFor(c.handshakeErr))
+		}
+	}
+	return c.handshakeErr
+}
+
+// Reads decrypted application data.
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.input) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		contentType, data, err := c.readRecord()
+		if err != nil {
+			c.readErr = err
+			continue
+		}
+		switch contentType {
+		case RecordApplicationData:
+			c.input = data
+		case RecordHandshake:
+			c.handshakeBuf = append(c.handshakeBuf, data...)
+			c.readErr = c.handlePostHandshake()
+		default:
+			c.readErr = errUnexpectedMessage
+		}
+	}
+	n := copy(b, c.input)
+	c.input = c.input[n:]
+	return n, nil
+}
+
+// Encrypts and sends application data.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), MaxPlaintext)
+		if _, err := c.Conn.Write(c.out.seal(RecordApplicationData, b[:n])); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Sends close_notify and closes the connection.
+func (c *Conn) Close() error {
+	if c.handshakeDone && c.handshakeErr == nil {
+		c.sendAlert(AlertLevelWarning, 0)
+	}
+	return c.Conn.Close()
+}
+
+// Sends an alert, errors are ignored since the connection is going away.
+func (c *Conn) sendAlert(level byte, description byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Conn.Write(c.out.seal(RecordAlert, Alert{Level: level, Description: description}.Bytes()))
+}
+
+// Maps handshake failures to alert descriptions.
+func alertFor(err error) byte {
+	var alert Alert
+	switch {
+	case errors.As(err, &alert):
+		return alert.Description
+	case errors.Is(err, errDecrypt):
+		return 20
+	case errors.Is(err, errUnexpectedMessage):
+		return 10
+	default:
+		var certErr x509.UnknownAuthorityError
+		var hostErr x509.HostnameError
+		if errors.As(err, &certErr) {
+			return 48
+		}
+		if errors.As(err, &hostErr) {
+			return 42
+		}
+		return 40
+	}
+}
+
+// Reads and unprotects the next record, skipping compatibility ChangeCipherSpec records.
+//
+// Returns the content type, the plaintext and a error (can be nil)
+func (c *Conn) readRecord() (byte, []byte, error) {
+	for {
+		record, err := ReadRecord(c.Conn)
+		if err != nil {
+			return 0, nil, err
+		}
+		contentType, data, err := c.in.open(record)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch contentType {
+		case RecordChangeCipherSpec:
+			if c.handshakeDone || !bytes.Equal(data, []byte{1}) {
+				return 0, nil, errUnexpectedMessage
+			}
+			continue
+		case RecordAlert:
+			alert, err := ParseAlert(data)
+			if err != nil {
+				return 0, nil, err
+			}
+			if alert.Description == 0 {
+				return 0, nil, io.EOF
+			}
+			return 0, nil, alert
+		}
+		return contentType, data, nil
+	}
+}
+
+// Returns the next handshake message and its raw bytes.
+//
+// Returns a error (can be nil)
+func (c *Conn) readHandshake() (HandshakeMessage, []byte, error) {
+	for {
+		if len(c.handshakeBuf) >= 4 {
+			length := 4 + (int(c.handshakeBuf[1])<<16 | int(c.handshakeBuf[2])<<8 | int(c.handshakeBuf[3]))
+			if len(c.handshakeBuf) >= length {
+				raw := c.handshakeBuf[:length]
+				c.handshakeBuf = c.handshakeBuf[length:]
+				message, _, err := ParseHandshake(raw, VersionTLS13)
+				return message, raw, err
+			}
+		}
+		contentType, data, err := c.readRecord()
+		if err != nil {
+			return nil, nil, err
+		}
+		if contentType != RecordHandshake {
+			return nil, nil, errUnexpectedMessage
+		}
+		c.handshakeBuf = append(c.handshakeBuf, data...)
+	}
+}
+
+// Handles NewSessionTicket and KeyUpdate messages after the handshake.
+//
+// Returns a error (can be nil)
+func (c *Conn) handlePostHandshake() error {
+	for len(c.handshakeBuf) >= 4 {
+		length := 4 + (int(c.handshakeBuf[1])<<16 | int(c.handshakeBuf[2])<<8 | int(c.handshakeBuf[3]))
+		if len(c.handshakeBuf) < length {
+			return nil
+		}
+		message, _, err := ParseHandshake(c.handshakeBuf[:length], VersionTLS13)
+		c.handshakeBuf = c.handshakeBuf[length:]
+		if err != nil {
+			return err
+		}
+
+		switch m := message.(type) {
+		case *NewSessionTicketMessage:
+			// Resumption is not supported, tickets are dropped
+		case *KeyUpdateMessage:
+			if err := c.in.update(); err != nil {
+				return err
+			}
+			if m.UpdateRequested {
+				c.writeMu.Lock()
+				_, err := c.Conn.Write(c.out.seal(RecordHandshake, (&KeyUpdateMessage{}).Marshal()))
+				if err == nil {
+					err = c.out.update()
+				}
+				c.writeMu.Unlock()
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return errUnexpectedMessage
+		}
+	}
+	return nil
+}
+
+// Creates a key share for group.
+//
+// Returns a error (can be nil)
+func generateKeyShare(group uint16) (*ecdh.PrivateKey, error) {
+	switch group {
+	case X25519:
+		return ecdh.X25519().GenerateKey(rand.Reader)
+	case P256:
+		return ecdh.P256().GenerateKey(rand.Reader)
+	}
+	return nil, errors.New("tls: unsupported group")
+}
+
+// Builds the ClientHello offering a key share for group.
+func (c *Conn) clientHello(random [32]byte, sessionID []byte, group uint16, key *ecdh.PrivateKey, cookie []byte) *ClientHelloMessage {
+	hello := &ClientHelloMessage{
+		Version:            VersionTLS12,
+		Random:             random,
+		SessionID:          sessionID,
+		CompressionMethods: []byte{0},
+		Extensions: []Extension{
+			ServerNameExtension(c.config.ServerName),
+			SupportedVersionsExtension(VersionTLS13),
+			SupportedGroupsExtension(X25519, P256),
+			SignatureAlgorithmsExtension(
+				ECDSAWithP256AndSHA256,
+				ECDSAWithP384AndSHA384,
+				ECDSAWithP521AndSHA512,
+				Ed25519,
+				PSSWithSHA256,
+				PSSWithSHA384,
+				PSSWithSHA512,
+				// Only acceptable in certificates
+				PKCS1WithSHA256,
+				PKCS1WithSHA384,
+				PKCS1WithSHA512,
+			),
+			KeyShareExtension(KeyShare{Group: group, Data: key.PublicKey().Bytes()}),
+		},
+	}
+	for _, suite := range cipherSuites13 {
+		hello.CipherSuites = append(hello.CipherSuites, suite.id)
+	}
+	if len(c.config.NextProtos) > 0 {
+		hello.Extensions = append(hello.Extensions, ALPNExtension(c.config.NextProtos...))
+	}
+	if cookie != nil {
+		hello.Extensions = append(hello.Extensions, CookieExtension(cookie))
+	}
+	return hello
+}
+
+// Runs the full client handshake.
+//
+// Returns a error (can be nil)
+func (c *Conn) clientHandshake() error {
+	var random [32]byte
+	sessionID := make([]byte, 32)
+	if _, err := rand.Read(random[:]); err != nil {
+		return err
+	}
+	if _, err := rand.Read(sessionID); err != nil {
+		return err
+	}
+
+	group := X25519
+	key, err := generateKeyShare(group)
+	if err != nil {
+		return err
+	}
+	hello := c.clientHello(random, sessionID, group, key, nil)
+	helloBytes := hello.Marshal()
+	if _, err := c.Conn.Write(c.out.seal(RecordHandshake, helloBytes)); err != nil {
+		return err
+	}
+
+	message, serverHelloBytes, err := c.readHandshake()
+	if err != nil {
+		return err
+	}
+	serverHello, ok := message.(*ServerHelloMessage)
+	if !ok {
+		return errUnexpectedMessage
+	}
+	suite, err := c.checkServerHello(serverHello, sessionID)
+	if err != nil {
+		return err
+	}
+	transcript := suite.newHash()
+
+	if serverHello.IsHelloRetryRequest() {
+		// The first ClientHello is replaced by its hash (RFC 8446, 4.4.1)
+		firstHash := suite.newHash()
+		firstHash.Write(helloBytes)
+		transcript.Write(handshakeBytes(TypeMessageHash, firstHash.Sum(nil)))
+		transcript.Write(serverHelloBytes)
+
+		var cookie []byte
+		if extension, ok := serverHello.Extension(ExtensionCookie); ok {
+			if cookie, err = extension.Cookie(); err != nil {
+				return err
+			}
+		}
+		if extension, ok := serverHello.Extension(ExtensionKeyShare); ok {
+			if group, err = extension.SelectedGroup(); err != nil {
+				return err
+			}
+			if key, err = generateKeyShare(group); err != nil {
+				return err
+			}
+		}
+
+		hello = c.clientHello(random, sessionID, group, key, cookie)
+		helloBytes = hello.Marshal()
+		if _, err := c.Conn.Write(c.out.seal(RecordHandshake, helloBytes)); err != nil {
+			return err
+		}
+		transcript.Write(helloBytes)
+
+		if message, serverHelloBytes, err = c.readHandshake(); err != nil {
+			return err
+		}
+		if serverHello, ok = message.(*ServerHelloMessage); !ok || serverHello.IsHelloRetryRequest() {
+			return errUnexpectedMessage
+		}
+		if second, err := c.checkServerHello(serverHello, sessionID); err != nil {
+			return err
+		} else if second != suite {
+			return errors.New("tls: server changed cipher suite after HelloRetryRequest")
+		}
+	} else {
+		transcript.Write(helloBytes)
+	}
+	transcript.Write(serverHelloBytes)
+	c.CipherSuite = suite.id
+
+	// Key exchange
+	extension, ok := serverHello.Extension(ExtensionKeyShare)
+	if !ok {
+		return errors.New("tls: server sent no key share")
+	}
+	share, err := extension.ServerKeyShare()
+	if err != nil {
+		return err
+	}
+	if share.Group != group {
+		return errors.New("tls: server key share uses a group that was not offered")
+	}
+	peerKey, err := key.Curve().NewPublicKey(share.Data)
+	if err != nil {
+		return err
+	}
+	sharedSecret, err := key.ECDH(peerKey)
+	if err != nil {
+		return err
+	}
+
+	// Handshake secrets
+	earlySecret := hkdfExtract(suite.newHash, nil, nil)
+	handshakeSecret := hkdfExtract(suite.newHash, deriveSecret(suite.newHash, earlySecret, "derived", nil), sharedSecret)
+	clientSecret := deriveSecret(suite.newHash, handshakeSecret, "c hs traffic", transcript)
+	serverSecret := deriveSecret(suite.newHash, handshakeSecret, "s hs traffic", transcript)
+	if err := c.in.setTrafficSecret(suite, serverSecret); err != nil {
+		return err
+	}
+
+	// Encrypted server flight
+	certificateRequested, err := c.readServerFlight(suite, transcript, serverSecret)
+	if err != nil {
+		return err
+	}
+
+	// Application secrets are bound to the transcript up to the server Finished
+	masterSecret := hkdfExtract(suite.newHash, deriveSecret(suite.newHash, handshakeSecret, "derived", nil), nil)
+	clientAppSecret := deriveSecret(suite.newHash, masterSecret, "c ap traffic", transcript)
+	serverAppSecret := deriveSecret(suite.newHash, masterSecret, "s ap traffic", transcript)
+
+	// Client flight
+	if err := c.out.setTrafficSecret(suite, clientSecret); err != nil {
+		return err
+	}
+	var flight bytes.Buffer
+	if certificateRequested != nil {
+		// No client certificates, answer with an empty list
+		empty := (&CertificateMessage{TLS13: true, RequestContext: certificateRequested.RequestContext}).Marshal()
+		transcript.Write(empty)
+		flight.Write(c.out.seal(RecordHandshake, empty))
+	}
+	finished := (&FinishedMessage{VerifyData: finishedMAC(suite, clientSecret, transcript)}).Marshal()
+	flight.Write(c.out.seal(RecordHandshake, finished))
+	if _, err := c.Conn.Write(flight.Bytes()); err != nil {
+		return err
+	}
+
+	if err := c.in.setTrafficSecret(suite, serverAppSecret); err != nil {
+		return err
+	}
+	return c.out.setTrafficSecret(suite, clientAppSecret)
+}
+
+// Checks a ServerHello (or HelloRetryRequest) against what was offered.
+//
+// Returns the selected suite and a error (can be nil)
+func (c *Conn) checkServerHello(hello *ServerHelloMessage, sessionID []byte) (*cipherSuite, error) {
+	if hello.NegotiatedVersion() != VersionTLS13 {
+		return nil, Alert{Level: AlertLevelFatal, Description: 70}
+	}
+	if !bytes.Equal(hello.SessionID, sessionID) || hello.CompressionMethod != 0 {
+		return nil, Alert{Level: AlertLevelFatal, Description: 47}
+	}
+	suite := cipherSuiteByID(hello.CipherSuite)
+	if suite == nil {
+		return nil, Alert{Level: AlertLevelFatal, Description: 47}
+	}
+	return suite, nil
+}
+
+// Reads EncryptedExtensions through the server Finished.
+//
+// Returns the CertificateRequest if the server sent one (can be nil) and a error (can be nil)
+func (c *Conn) readServerFlight(suite *cipherSuite, transcript hash.Hash, serverSecret []byte) (*CertificateRequestMessage, error) {
+	message, raw, err := c.readHandshake()
+	if err != nil {
+		return nil, err
+	}
+	encryptedExtensions, ok := message.(*EncryptedExtensionsMessage)
+	if !ok {
+		return nil, errUnexpectedMessage
+	}
+	transcript.Write(raw)
+	if extension, ok := findExtension(encryptedExtensions.Extensions, ExtensionALPN); ok {
+		protocols, err := extension.ALPNProtocols()
+		if err != nil || len(protocols) != 1 {
+			return nil, errBadExtension
+		}
+		c.NegotiatedProtocol = protocols[0]
+	}
+
+	var certificateRequest *CertificateRequestMessage
+	if message, raw, err = c.readHandshake(); err != nil {
+		return nil, err
+	}
+	if request, ok := message.(*CertificateRequestMessage); ok {
+		certificateRequest = request
+		transcript.Write(raw)
+		if message, raw, err = c.readHandshake(); err != nil {
+			return nil, err
+		}
+	}
+
+	certificate, ok := message.(*CertificateMessage)
+	if !ok || len(certificate.Certificates) == 0 {
+		return nil, errUnexpectedMessage
+	}
+	transcript.Write(raw)
+	if err := c.verifyCertificates(certificate.Chain()); err != nil {
+		return nil, err
+	}
+
+	if message, raw, err = c.readHandshake(); err != nil {
+		return nil, err
+	}
+	certificateVerify, ok := message.(*CertificateVerifyMessage)
+	if !ok {
+		return nil, errUnexpectedMessage
+	}
+	if err := verifyHandshakeSignature(c.PeerCertificates[0].PublicKey, certificateVerify, transcript.Sum(nil)); err != nil {
+		return nil, err
+	}
+	transcript.Write(raw)
+
+	if message, raw, err = c.readHandshake(); err != nil {
+		return nil, err
+	}
+	finished, ok := message.(*FinishedMessage)
+	if !ok {
+		return nil, errUnexpectedMessage
+	}
+	if !hmac.Equal(finished.VerifyData, finishedMAC(suite, serverSecret, transcript)) {
+		return nil, Alert{Level: AlertLevelFatal, Description: 51}
+	}
+	transcript.Write(raw)
+
+	if len(c.handshakeBuf) != 0 {
+		return nil, errUnexpectedMessage
+	}
+	return certificateRequest, nil
+}
+
+// Computes Finished verify_data for the transcript so far.
+func finishedMAC(suite *cipherSuite, baseSecret []byte, transcript hash.Hash) []byte {
+	finishedKey := expandLabel(suite.newHash, baseSecret, "finished", nil, suite.hash.Size())
+	mac := hmac.New(suite.newHash, finishedKey)
+	mac.Write(transcript.Sum(nil))
+	return mac.Sum(nil)
+}
+
+// Parses the server chain and verifies it against the configured roots.
+//
+// Returns a error (can be nil)
+func (c *Conn) verifyCertificates(chain [][]byte) error {
+	certificates := make([]*x509.Certificate, 0, len(chain))
+	for _, der := range chain {
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return Alert{Level: AlertLevelFatal, Description: 42}
+		}
+		certificates = append(certificates, certificate)
+	}
+	c.PeerCertificates = certificates
+
+	if c.config.InsecureSkipVerify {
+		return nil
+	}
+	options := x509.VerifyOptions{
+		Roots:         c.config.RootCAs,
+		DNSName:       c.config.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	if c.config.Time != nil {
+		options.CurrentTime = c.config.Time()
+	}
+	for _, intermediate := range certificates[1:] {
+		options.Intermediates.AddCert(intermediate)
+	}
+	_, err := certificates[0].Verify(options)
+	return err
+}
+
+// Checks the server's CertificateVerify signature over the transcript hash.
+//
+// Returns a error (can be nil)
+func verifyHandshakeSignature(publicKey crypto.PublicKey, verify *CertificateVerifyMessage, transcriptHash []byte) error {
+	// 64 spaces, a context string and a zero byte precede the hash (RFC 8446, 4.4.3)
+	signed := bytes.Repeat([]byte{0x20}, 64)
+	signed = append(signed, "TLS 1.3, server CertificateVerify"...)
+	signed = append(signed, 0)
+	signed = append(signed, transcriptHash...)
+
+	var digestHash crypto.Hash
+	switch verify.SignatureAlgorithm {
+	case ECDSAWithP256AndSHA256, PSSWithSHA256:
+		digestHash = crypto.SHA256
+	case ECDSAWithP384AndSHA384, PSSWithSHA384:
+		digestHash = crypto.SHA384
+	case ECDSAWithP521AndSHA512, PSSWithSHA512:
+		digestHash = crypto.SHA512
+	case Ed25519:
+		key, ok := publicKey.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(key, signed, verify.Signature) {
+			return Alert{Level: AlertLevelFatal, Description: 51}
+		}
+		return nil
+	default:
+		return Alert{Level: AlertLevelFatal, Description: 47}
+	}
+
+	digest := digestHash.New()
+	digest.Write(signed)
+	sum := digest.Sum(nil)
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if verify.SignatureAlgorithm >= PSSWithSHA256 || !ecdsa.VerifyASN1(key, sum, verify.Signature) {
+			return Alert{Level: AlertLevelFatal, Description: 51}
+		}
+	case *rsa.PublicKey:
+		options := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+		if verify.SignatureAlgorithm < PSSWithSHA256 || rsa.VerifyPSS(key, digestHash, sum, verify.Signature, options) != nil {
+			return Alert{Level: AlertLevelFatal, Description: 51}
+		}
+	default:
+		return Alert{Level: AlertLevelFatal, Description: 43}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+// Starts a crypto/tls server echoing everything it reads.
+//
+// Returns its address and the state of the first connection once its handshake completes
+func echoServer(t *testing.T, config *tls.Config) (string, <-chan tls.ConnectionState) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	states := make(chan tls.ConnectionState, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		server := tls.Server(conn, config)
+		defer server.Close()
+		if server.Handshake() != nil {
+			close(states)
+			return
+		}
+		states <- server.ConnectionState()
+		io.Copy(server, server)
+	}()
+	return listener.Addr().String(), states
+}
+
+// Sends data through an echo server and checks that it comes back.
+func checkEcho(t *testing.T, conn *Conn) {
+	t.Helper()
+	data := make([]byte, 100000)
+	rand.Read(data)
+	go conn.Write(data)
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("echoed data differs")
+	}
+}
+
+func TestClientHandshake(t *testing.T) {
+	ecdsaCert, ecdsaPool := testCertificate(t, false)
+	rsaCert, rsaPool := testCertificate(t, true)
+
+	tests := []struct {
+		name        string
+		certificate tls.Certificate
+		pool        *x509.CertPool
+		configure   func(config *tls.Config)
+		// The server answers the first ClientHello with a HelloRetryRequest
+		retry bool
+	}{
+		{name: "ECDSA", certificate: ecdsaCert, pool: ecdsaPool},
+		{name: "RSA", certificate: rsaCert, pool: rsaPool},
+		{
+			name: "HelloRetryRequest", certificate: ecdsaCert, pool: ecdsaPool, retry: true,
+			// The client sends an X25519 key share only
+			configure: func(config *tls.Config) { config.CurvePreferences = []tls.CurveID{tls.CurveP256} },
+		},
+		{
+			name: "CertificateRequest", certificate: ecdsaCert, pool: ecdsaPool,
+			configure: func(config *tls.Config) { config.ClientAuth = tls.RequestClientCert },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &tls.Config{Certificates: []tls.Certificate{test.certificate}, NextProtos: []string{"x", "http/1.1"}}
+			if test.configure != nil {
+				test.configure(server)
+			}
+			address, states := echoServer(t, server)
+
+			raw, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorder := &recordingConn{Conn: raw}
+			conn := Client(recorder, &Config{ServerName: "localhost", RootCAs: test.pool, NextProtos: []string{"http/1.1"}})
+			defer conn.Close()
+			if err := conn.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+
+			state, ok := <-states
+			if !ok {
+				t.Fatal("server handshake failed")
+			}
+			if state.Version != tls.VersionTLS13 || state.CipherSuite != conn.CipherSuite {
+				t.Errorf("server negotiated version %x suite %x, client suite %x", state.Version, state.CipherSuite, conn.CipherSuite)
+			}
+			if conn.NegotiatedProtocol != "http/1.1" {
+				t.Errorf("NegotiatedProtocol = %q", conn.NegotiatedProtocol)
+			}
+			if len(conn.PeerCertificates) != 1 || !conn.PeerCertificates[0].Equal(test.certificate.Leaf) {
+				t.Error("PeerCertificates does not hold the server certificate")
+			}
+			checkEcho(t, conn)
+
+			recorder.mu.Lock()
+			received := bytes.Clone(recorder.received.Bytes())
+			recorder.mu.Unlock()
+			message, _, err := ParseHandshake(plaintextHandshake(t, received), VersionTLS13)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if retry := message.(*ServerHelloMessage).IsHelloRetryRequest(); retry != test.retry {
+				t.Errorf("first ServerHello is a HelloRetryRequest: %v, want %v", retry, test.retry)
+			}
+		})
+	}
+}
+
+func TestClientCipherSuites(t *testing.T) {
+	cert, pool := testCertificate(t, false)
+	saved := cipherSuites13
+	defer func() { cipherSuites13 = saved }()
+
+	for _, suite := range saved {
+		// Offering a single suite forces the server to pick it
+		cipherSuites13 = []*cipherSuite{suite}
+		address, _ := echoServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+		conn, err := Dial("tcp", address, &Config{ServerName: "localhost", RootCAs: pool})
+		if err != nil {
+			t.Fatalf("suite %x: %v", suite.id, err)
+		}
+		if conn.CipherSuite != suite.id {
+			t.Errorf("negotiated %x, want %x", conn.CipherSuite, suite.id)
+		}
+		checkEcho(t, conn)
+		conn.Close()
+	}
+}
+
+func TestClientRejectsUnknownRoot(t *testing.T) {
+	cert, _ := testCertificate(t, false)
+	_, otherPool := testCertificate(t, false)
+	address, _ := echoServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	if _, err := Dial("tcp", address, &Config{ServerName: "localhost", RootCAs: otherPool}); err == nil {
+		t.Fatal("handshake succeeded with an untrusted certificate")
+	}
+}
+
+// RFC 8439, section 2.8.2
+func TestChaCha20Poly1305Vector(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	key := decode("808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	nonce := decode("070000004041424344454647")
+	additionalData := decode("50515253c0c1c2c3c4c5c6c7")
+	plaintext := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	ciphertext := decode("d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d63dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b3692ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc3ff4def08e4b7a9de576d26586cec64b6116")
+	tag := decode("1ae10b594f09e26a7e902ecbd0600691")
+
+	aead, err := newChaCha20Poly1305(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := aead.Seal(nil, nonce, plaintext, additionalData)
+	if !bytes.Equal(sealed, append(ciphertext, tag...)) {
+		t.Fatalf("Seal = %x", sealed)
+	}
+	opened, err := aead.Open(nil, nonce, sealed, additionalData)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("Open = %q, %v", opened, err)
+	}
+
+	sealed[0] ^= 1
+	if _, err := aead.Open(nil, nonce, sealed, additionalData); err == nil {
+		t.Fatal("Open accepted a modified ciphertext")
+	}
+}
@@ -0,0 +1,156 @@
+package tls
+
+// Helpers for reading and writing the TLS presentation language.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errShortMessage = errors.New("tls: message too short")
+var errTrailingData = errors.New("tls: trailing data after message")
+var errVectorTooLong = errors.New("tls: vector too long for its length prefix")
+
+// Reads big endian integers and length-prefixed vectors from a byte slice.
+//
+// The first failure is kept in err and every following read returns zero values.
+type parser struct {
+	data []byte
+	err  error
+}
+
+// Takes n bytes from the front of the data.
+func (p *parser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n < 0 || len(p.data) < n {
+		p.err = errShortMessage
+		return nil
+	}
+	out := p.data[:n:n]
+	p.data = p.data[n:]
+	return out
+}
+
+func (p *parser) uint8() byte {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (p *parser) uint16() uint16 {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (p *parser) uint24() uint32 {
+	b := p.bytes(3)
+	if b == nil {
+		return 0
+	}
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func (p *parser) uint32() uint32 {
+	b := p.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// Vector with a 1 byte length prefix.
+func (p *parser) vector8() []byte {
+	return p.bytes(int(p.uint8()))
+}
+
+// Vector with a 2 byte length prefix.
+func (p *parser) vector16() []byte {
+	return p.bytes(int(p.uint16()))
+}
+
+// Vector with a 3 byte length prefix.
+func (p *parser) vector24() []byte {
+	return p.bytes(int(p.uint24()))
+}
+
+// Returns true if all data was consumed.
+func (p *parser) empty() bool {
+	return len(p.data) == 0
+}
+
+// Fails the parser if data is left over.
+//
+// Returns the sticky error (can be nil)
+func (p *parser) finish() error {
+	if p.err == nil && !p.empty() {
+		p.err = errTrailingData
+	}
+	return p.err
+}
+
+// Writes a 3 byte big endian integer.
+func putUint24(buf *bytes.Buffer, v uint32) {
+	buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+func putUint16(buf *bytes.Buffer, v uint16) {
+	buf.Write([]byte{byte(v >> 8), byte(v)})
+}
+
+// Writes a vector with a 1 byte length prefix.
+func putVector8(buf *bytes.Buffer, data []byte) {
+	if len(data) > 0xFF {
+		panic(errVectorTooLong)
+	}
+	buf.WriteByte(byte(len(data)))
+	buf.Write(data)
+}
+
+// Writes a vector with a 2 byte length prefix.
+func putVector16(buf *bytes.Buffer, data []byte) {
+	if len(data) > 0xFFFF {
+		panic(errVectorTooLong)
+	}
+	putUint16(buf, uint16(len(data)))
+	buf.Write(data)
+}
+
+// Writes a vector with a 3 byte length prefix.
+func putVector24(buf *bytes.Buffer, data []byte) {
+	if len(data) > 0xFFFFFF {
+		panic(errVectorTooLong)
+	}
+	putUint24(buf, uint32(len(data)))
+	buf.Write(data)
+}
+
+// Encodes a list of uint16 values (cipher suites, groups, algorithms...).
+func uint16List(values []uint16) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		putUint16(&buf, v)
+	}
+	return buf.Bytes()
+}
+
+// Decodes a list of uint16 values.
+//
+// Returns a error (can be nil)
+func parseUint16List(data []byte) ([]uint16, error) {
+	if len(data)%2 != 0 {
+		return nil, errShortMessage
+	}
+	values := make([]uint16, 0, len(data)/2)
+	for i := 0; i < len(data); i += 2 {
+		values = append(values, binary.BigEndian.Uint16(data[i:]))
+	}
+	return values, nil
+}
@@ -0,0 +1,368 @@
+package tls
+
+// Hello extensions and the registries they draw from.
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Extension types
+const (
+	ExtensionServerName           = uint16(0)
+	ExtensionStatusRequest        = uint16(5)
+	ExtensionSupportedGroups      = uint16(10)
+	ExtensionECPointFormats       = uint16(11)
+	ExtensionSignatureAlgorithms  = uint16(13)
+	ExtensionALPN                 = uint16(16)
+	ExtensionSCT                  = uint16(18)
+	ExtensionPadding              = uint16(21)
+	ExtensionExtendedMasterSecret = uint16(23)
+	ExtensionSessionTicket        = uint16(35)
+	ExtensionPreSharedKey         = uint16(41)
+	ExtensionEarlyData            = uint16(42)
+	ExtensionSupportedVersions    = uint16(43)
+	ExtensionCookie               = uint16(44)
+	ExtensionPSKModes             = uint16(45)
+	ExtensionCertificateAuthority = uint16(47)
+	ExtensionSignatureAlgsCert    = uint16(50)
+	ExtensionKeyShare             = uint16(51)
+	ExtensionRenegotiationInfo    = uint16(0xFF01)
+)
+
+// Named groups
+const (
+	P256   = uint16(23)
+	P384   = uint16(24)
+	P521   = uint16(25)
+	X25519 = uint16(29)
+)
+
+// Signature schemes
+const (
+	PKCS1WithSHA1          = uint16(0x0201)
+	ECDSAWithSHA1          = uint16(0x0203)
+	PKCS1WithSHA256        = uint16(0x0401)
+	ECDSAWithP256AndSHA256 = uint16(0x0403)
+	PKCS1WithSHA384        = uint16(0x0501)
+	ECDSAWithP384AndSHA384 = uint16(0x0503)
+	PKCS1WithSHA512        = uint16(0x0601)
+	ECDSAWithP521AndSHA512 = uint16(0x0603)
+	PSSWithSHA256          = uint16(0x0804)
+	PSSWithSHA384          = uint16(0x0805)
+	PSSWithSHA512          = uint16(0x0806)
+	Ed25519                = uint16(0x0807)
+)
+
+// Cipher suites
+const (
+	TLS_DHE_RSA_WITH_AES_128_CBC_SHA              = uint16(0x0033)
+	TLS_RSA_WITH_AES_128_GCM_SHA256               = uint16(0x009C)
+	TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256       = uint16(0xC02B)
+	TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256         = uint16(0xC02F)
+	TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384       = uint16(0xC02C)
+	TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384         = uint16(0xC030)
+	TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256   = uint16(0xCCA8)
+	TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 = uint16(0xCCA9)
+	TLS_AES_128_GCM_SHA256                        = uint16(0x1301)
+	TLS_AES_256_GCM_SHA384                        = uint16(0x1302)
+	TLS_CHACHA20_POLY1305_SHA256                  = uint16(0x1303)
+)
+
+// PSK key exchange modes
+const (
+	PSKModePlain = byte(0)
+	PSKModeDHE   = byte(1)
+)
+
+var errBadExtension = errors.New("tls: malformed extension")
+
+// A hello extension, kept as raw bytes so unknown extensions survive a round trip.
+type Extension struct {
+	Type uint16
+	Data []byte
+}
+
+// Key share entry
+type KeyShare struct {
+	Group uint16
+	Data  []byte
+}
+
+// Encodes a list of extensions with its 2 byte length prefix.
+func marshalExtensions(buf *bytes.Buffer, extensions []Extension) {
+	var list bytes.Buffer
+	for _, extension := range extensions {
+		putUint16(&list, extension.Type)
+		putVector16(&list, extension.Data)
+	}
+	putVector16(buf, list.Bytes())
+}
+
+// Decodes a list of extensions, rejecting duplicates.
+//
+// Returns a error (can be nil)
+func parseExtensions(data []byte) ([]Extension, error) {
+	p := &parser{data: data}
+	var extensions []Extension
+	seen := make(map[uint16]bool)
+	for !p.empty() && p.err == nil {
+		extension := Extension{Type: p.uint16(), Data: p.vector16()}
+		if p.err != nil {
+			break
+		}
+		if seen[extension.Type] {
+			return nil, errors.New("tls: duplicate extension")
+		}
+		seen[extension.Type] = true
+		extensions = append(extensions, extension)
+	}
+	return extensions, p.err
+}
+
+// Returns the extension of type t from the list.
+func findExtension(extensions []Extension, t uint16) (Extension, bool) {
+	for _, extension := range extensions {
+		if extension.Type == t {
+			return extension, true
+		}
+	}
+	return Extension{}, false
+}
+
+// Decodes extension data consisting of a single uint16.
+func (extension Extension) uint16Value() (uint16, error) {
+	p := &parser{data: extension.Data}
+	value := p.uint16()
+	return value, p.finish()
+}
+
+// Decodes extension data consisting of a uint16 list with a 2 byte length prefix.
+func (extension Extension) uint16Vector() ([]uint16, error) {
+	p := &parser{data: extension.Data}
+	list := p.vector16()
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	return parseUint16List(list)
+}
+
+// Decodes extension data consisting of a byte list with a 1 byte length prefix.
+func (extension Extension) byteVector() ([]byte, error) {
+	p := &parser{data: extension.Data}
+	list := p.vector8()
+	return list, p.finish()
+}
+
+// Extension carrying a single DNS host name.
+func ServerNameExtension(name string) Extension {
+	var entry bytes.Buffer
+	// host_name
+	entry.WriteByte(0)
+	putVector16(&entry, []byte(name))
+
+	var data bytes.Buffer
+	putVector16(&data, entry.Bytes())
+	return Extension{Type: ExtensionServerName, Data: data.Bytes()}
+}
+
+// Returns the host name of a server_name extension.
+//
+// Servers acknowledge SNI with an empty extension, in which case the name is empty.
+func (extension Extension) ServerName() (string, error) {
+	if len(extension.Data) == 0 {
+		return "", nil
+	}
+	p := &parser{data: extension.Data}
+	list := &parser{data: p.vector16()}
+	if err := p.finish(); err != nil {
+		return "", err
+	}
+	for !list.empty() && list.err == nil {
+		nameType := list.uint8()
+		name := list.vector16()
+		if nameType == 0 && list.err == nil {
+			return string(name), nil
+		}
+	}
+	if list.err != nil {
+		return "", list.err
+	}
+	return "", errBadExtension
+}
+
+// Extension offering a list of protocol versions (ClientHello).
+func SupportedVersionsExtension(versions ...uint16) Extension {
+	var data bytes.Buffer
+	putVector8(&data, uint16List(versions))
+	return Extension{Type: ExtensionSupportedVersions, Data: data.Bytes()}
+}
+
+// Extension selecting a protocol version (ServerHello).
+func SelectedVersionExtension(version uint16) Extension {
+	return Extension{Type: ExtensionSupportedVersions, Data: uint16List([]uint16{version})}
+}
+
+// Returns the versions offered in a ClientHello supported_versions extension.
+func (extension Extension) SupportedVersions() ([]uint16, error) {
+	p := &parser{data: extension.Data}
+	list := p.vector8()
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	return parseUint16List(list)
+}
+
+// Returns the version selected in a ServerHello supported_versions extension.
+func (extension Extension) SelectedVersion() (uint16, error) {
+	return extension.uint16Value()
+}
+
+// Extension listing supported key exchange groups.
+func SupportedGroupsExtension(groups ...uint16) Extension {
+	var data bytes.Buffer
+	putVector16(&data, uint16List(groups))
+	return Extension{Type: ExtensionSupportedGroups, Data: data.Bytes()}
+}
+
+// Returns the groups of a supported_groups extension.
+func (extension Extension) SupportedGroups() ([]uint16, error) {
+	return extension.uint16Vector()
+}
+
+// Extension listing supported signature schemes.
+func SignatureAlgorithmsExtension(schemes ...uint16) Extension {
+	var data bytes.Buffer
+	putVector16(&data, uint16List(schemes))
+	return Extension{Type: ExtensionSignatureAlgorithms, Data: data.Bytes()}
+}
+
+// Returns the schemes of a signature_algorithms (or signature_algorithms_cert) extension.
+func (extension Extension) SignatureAlgorithms() ([]uint16, error) {
+	return extension.uint16Vector()
+}
+
+// Extension listing point formats (only 0, uncompressed, is used in practice).
+func ECPointFormatsExtension(formats ...byte) Extension {
+	var data bytes.Buffer
+	putVector8(&data, formats)
+	return Extension{Type: ExtensionECPointFormats, Data: data.Bytes()}
+}
+
+// Returns the formats of an ec_point_formats extension.
+func (extension Extension) ECPointFormats() ([]byte, error) {
+	return extension.byteVector()
+}
+
+// Extension offering application protocols (ClientHello) or selecting one (ServerHello).
+func ALPNExtension(protocols ...string) Extension {
+	var list bytes.Buffer
+	for _, protocol := range protocols {
+		putVector8(&list, []byte(protocol))
+	}
+	var data bytes.Buffer
+	putVector16(&data, list.Bytes())
+	return Extension{Type: ExtensionALPN, Data: data.Bytes()}
+}
+
+// Returns the protocols of an application_layer_protocol_negotiation extension.
+func (extension Extension) ALPNProtocols() ([]string, error) {
+	p := &parser{data: extension.Data}
+	list := &parser{data: p.vector16()}
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	var protocols []string
+	for !list.empty() {
+		protocol := list.vector8()
+		if list.err != nil {
+			return nil, list.err
+		}
+		if len(protocol) == 0 {
+			return nil, errBadExtension
+		}
+		protocols = append(protocols, string(protocol))
+	}
+	return protocols, nil
+}
+
+// Extension offering key shares (ClientHello).
+func KeyShareExtension(shares ...KeyShare) Extension {
+	var list bytes.Buffer
+	for _, share := range shares {
+		putUint16(&list, share.Group)
+		putVector16(&list, share.Data)
+	}
+	var data bytes.Buffer
+	putVector16(&data, list.Bytes())
+	return Extension{Type: ExtensionKeyShare, Data: data.Bytes()}
+}
+
+// Extension carrying the server's key share (ServerHello).
+func ServerKeyShareExtension(share KeyShare) Extension {
+	var data bytes.Buffer
+	putUint16(&data, share.Group)
+	putVector16(&data, share.Data)
+	return Extension{Type: ExtensionKeyShare, Data: data.Bytes()}
+}
+
+// Returns the shares of a ClientHello key_share extension.
+func (extension Extension) KeyShares() ([]KeyShare, error) {
+	p := &parser{data: extension.Data}
+	list := &parser{data: p.vector16()}
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	var shares []KeyShare
+	for !list.empty() {
+		share := KeyShare{Group: list.uint16(), Data: list.vector16()}
+		if list.err != nil {
+			return nil, list.err
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// Returns the share of a ServerHello key_share extension.
+func (extension Extension) ServerKeyShare() (KeyShare, error) {
+	p := &parser{data: extension.Data}
+	share := KeyShare{Group: p.uint16(), Data: p.vector16()}
+	return share, p.finish()
+}
+
+// Returns the group requested by a HelloRetryRequest key_share extension.
+func (extension Extension) SelectedGroup() (uint16, error) {
+	return extension.uint16Value()
+}
+
+// Extension listing PSK key exchange modes.
+func PSKModesExtension(modes ...byte) Extension {
+	var data bytes.Buffer
+	putVector8(&data, modes)
+	return Extension{Type: ExtensionPSKModes, Data: data.Bytes()}
+}
+
+// Returns the modes of a psk_key_exchange_modes extension.
+func (extension Extension) PSKModes() ([]byte, error) {
+	return extension.byteVector()
+}
+
+// Empty renegotiation_info extension for an initial handshake.
+func RenegotiationInfoExtension() Extension {
+	return Extension{Type: ExtensionRenegotiationInfo, Data: []byte{0}}
+}
+
+// Extension echoing a HelloRetryRequest cookie.
+func CookieExtension(cookie []byte) Extension {
+	var data bytes.Buffer
+	putVector16(&data, cookie)
+	return Extension{Type: ExtensionCookie, Data: data.Bytes()}
+}
+
+// Returns the cookie of a cookie extension.
+func (extension Extension) Cookie() ([]byte, error) {
+	p := &parser{data: extension.Data}
+	cookie := p.vector16()
+	return cookie, p.finish()
+}
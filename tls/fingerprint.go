@@ -0,0 +1,240 @@
+package tls
+
+// JA3 and JA4 client fingerprints.
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fingerprints of one ClientHello.
+type Fingerprint struct {
+	// JA3 string and its MD5 hash
+	JA3     string
+	JA3Hash string
+	// JA4 fingerprint (TLS over TCP)
+	JA4 string
+}
+
+// Returns true for the reserved GREASE values (RFC 8701).
+func isGREASE(value uint16) bool {
+	return value&0x0F0F == 0x0A0A && value>>8 == value&0xFF
+}
+
+// Decodes a ClientHello given either as a handshake message or as the records carrying it.
+//
+// Returns a error (can be nil)
+func parseRawClientHello(raw []byte) (*ClientHelloMessage, error) {
+	if len(raw) > 0 && raw[0] == RecordHandshake {
+		var handshake []byte
+		for len(raw) > 0 {
+			record, used, err := ParseRecord(raw)
+			if err != nil {
+				return nil, err
+			}
+			handshake = append(handshake, record.Fragment...)
+			raw = raw[used:]
+		}
+		raw = handshake
+	}
+	info, err := InspectClientHello(raw)
+	if err != nil {
+		return nil, err
+	}
+	return info.Hello, nil
+}
+
+// Computes every fingerprint of a raw ClientHello.
+//
+// Returns a error (can be nil)
+func NewFingerprint(raw []byte) (*Fingerprint, error) {
+	hello, err := parseRawClientHello(raw)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := &Fingerprint{JA3: ja3(hello), JA4: ja4(hello)}
+	sum := md5.Sum([]byte(fingerprint.JA3))
+	fingerprint.JA3Hash = hex.EncodeToString(sum[:])
+	return fingerprint, nil
+}
+
+// Computes the JA3 string of a raw ClientHello.
+//
+// Returns a error (can be nil)
+func JA3(raw []byte) (string, error) {
+	hello, err := parseRawClientHello(raw)
+	if err != nil {
+		return "", err
+	}
+	return ja3(hello), nil
+}
+
+// Computes the JA4 fingerprint of a raw ClientHello.
+//
+// Returns a error (can be nil)
+func JA4(raw []byte) (string, error) {
+	hello, err := parseRawClientHello(raw)
+	if err != nil {
+		return "", err
+	}
+	return ja4(hello), nil
+}
+
+// Joins values in decimal with dashes, leaving out GREASE.
+func joinDecimal(values []uint16) string {
+	var parts []string
+	for _, value := range values {
+		if !isGREASE(value) {
+			parts = append(parts, strconv.Itoa(int(value)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+func ja3(hello *ClientHelloMessage) string {
+	var extensions []uint16
+	for _, extension := range hello.Extensions {
+		extensions = append(extensions, extension.Type)
+	}
+
+	var groups []uint16
+	if extension, ok := hello.Extension(ExtensionSupportedGroups); ok {
+		groups, _ = extension.SupportedGroups()
+	}
+
+	var formats []string
+	if extension, ok := hello.Extension(ExtensionECPointFormats); ok {
+		list, _ := extension.ECPointFormats()
+		for _, format := range list {
+			formats = append(formats, strconv.Itoa(int(format)))
+		}
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(hello.Version)),
+		joinDecimal(hello.CipherSuites),
+		joinDecimal(extensions),
+		joinDecimal(groups),
+		strings.Join(formats, "-"),
+	}, ",")
+}
+
+// Two character version label used by JA4.
+func ja4Version(version uint16) string {
+	switch version {
+	case VersionTLS13:
+		return "13"
+	case VersionTLS12:
+		return "12"
+	case VersionTLS11:
+		return "11"
+	case VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0200:
+		return "s2"
+	}
+	return "00"
+}
+
+// Joins values as 4 digit hex with commas, leaving out GREASE and the skipped types.
+func joinHex(values []uint16, skip ...uint16) string {
+	var parts []string
+outer:
+	for _, value := range values {
+		if isGREASE(value) {
+			continue
+		}
+		for _, skipped := range skip {
+			if value == skipped {
+				continue outer
+			}
+		}
+		parts = append(parts, fmt.Sprintf("%04x", value))
+	}
+	return strings.Join(parts, ",")
+}
+
+// First 12 hex characters of the SHA256 of s, or zeros if s is empty.
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Returns true for ASCII letters and digits.
+func isAlphanumeric(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// JA4 (FoxIO): a_b_c, see https://github.com/FoxIO-LLC/ja4
+func ja4(hello *ClientHelloMessage) string {
+	// Highest offered version, ignoring GREASE
+	version := hello.Version
+	if extension, ok := hello.Extension(ExtensionSupportedVersions); ok {
+		versions, _ := extension.SupportedVersions()
+		version = 0
+		for _, v := range versions {
+			if !isGREASE(v) && v > version {
+				version = v
+			}
+		}
+	}
+
+	sni := "i"
+	if _, ok := hello.Extension(ExtensionServerName); ok {
+		sni = "d"
+	}
+
+	var ciphers []uint16
+	for _, suite := range hello.CipherSuites {
+		if !isGREASE(suite) {
+			ciphers = append(ciphers, suite)
+		}
+	}
+	var extensions []uint16
+	for _, extension := range hello.Extensions {
+		if !isGREASE(extension.Type) {
+			extensions = append(extensions, extension.Type)
+		}
+	}
+
+	alpn := "00"
+	if extension, ok := hello.Extension(ExtensionALPN); ok {
+		if protocols, err := extension.ALPNProtocols(); err == nil && len(protocols) > 0 {
+			first := protocols[0]
+			if isAlphanumeric(first[0]) && isAlphanumeric(first[len(first)-1]) {
+				alpn = string(first[0]) + string(first[len(first)-1])
+			} else {
+				encoded := hex.EncodeToString([]byte(first))
+				alpn = string(encoded[0]) + string(encoded[len(encoded)-1])
+			}
+		}
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	sortedCiphers := append([]uint16(nil), ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+	b := truncatedHash(joinHex(sortedCiphers))
+
+	sortedExtensions := append([]uint16(nil), extensions...)
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+	c := joinHex(sortedExtensions, ExtensionServerName, ExtensionALPN)
+	if extension, ok := hello.Extension(ExtensionSignatureAlgorithms); ok {
+		if algorithms, err := extension.SignatureAlgorithms(); err == nil && len(algorithms) > 0 {
+			c += "_" + joinHex(algorithms)
+		}
+	}
+
+	return a + "_" + b + "_" + truncatedHash(c)
+}
@@ -0,0 +1,199 @@
+package tls
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+)
+
+// Chrome ClientHello from the JA4 reference documentation, GREASE included.
+//
+// Its JA3 hash cd08e31494f9531f560d64c695473da9 is the widely published Chrome fingerprint.
+func chromeHello() *ClientHelloMessage {
+	return &ClientHelloMessage{
+		Version:            VersionTLS12,
+		SessionID:          make([]byte, 32),
+		CipherSuites:       []uint16{0x0A0A, 0x1301, 0x1302, 0x1303, 0xC02B, 0xC02F, 0xC02C, 0xC030, 0xCCA9, 0xCCA8, 0xC013, 0xC014, 0x009C, 0x009D, 0x002F, 0x0035},
+		CompressionMethods: []byte{0},
+		Extensions: []Extension{
+			{Type: 0x1A1A},
+			ServerNameExtension("example.com"),
+			{Type: ExtensionExtendedMasterSecret},
+			RenegotiationInfoExtension(),
+			SupportedGroupsExtension(0x3A3A, X25519, P256, P384),
+			ECPointFormatsExtension(0),
+			{Type: ExtensionSessionTicket},
+			ALPNExtension("h2", "http/1.1"),
+			{Type: ExtensionStatusRequest, Data: []byte{1, 0, 0, 0, 0}},
+			SignatureAlgorithmsExtension(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601),
+			{Type: ExtensionSCT},
+			KeyShareExtension(KeyShare{Group: 0x3A3A, Data: []byte{0}}, KeyShare{Group: X25519, Data: make([]byte, 32)}),
+			PSKModesExtension(PSKModeDHE),
+			SupportedVersionsExtension(0x5A5A, VersionTLS13, VersionTLS12),
+			{Type: 27, Data: []byte{2, 0, 2}},
+			{Type: 0x4469, Data: []byte{0, 3, 2, 'h', '2'}},
+			{Type: 0x2A2A, Data: []byte{0}},
+			{Type: ExtensionPadding, Data: make([]byte, 16)},
+		},
+	}
+}
+
+// Returns the hello without its GREASE values.
+func withoutGREASE(hello *ClientHelloMessage) *ClientHelloMessage {
+	stripped := *hello
+	stripped.CipherSuites = nil
+	for _, suite := range hello.CipherSuites {
+		if !isGREASE(suite) {
+			stripped.CipherSuites = append(stripped.CipherSuites, suite)
+		}
+	}
+	stripped.Extensions = nil
+	for _, extension := range hello.Extensions {
+		switch {
+		case isGREASE(extension.Type):
+		case extension.Type == ExtensionSupportedGroups:
+			stripped.Extensions = append(stripped.Extensions, SupportedGroupsExtension(X25519, P256, P384))
+		case extension.Type == ExtensionSupportedVersions:
+			stripped.Extensions = append(stripped.Extensions, SupportedVersionsExtension(VersionTLS13, VersionTLS12))
+		default:
+			stripped.Extensions = append(stripped.Extensions, extension)
+		}
+	}
+	return &stripped
+}
+
+// Returns the hello without the extension of type t.
+func withoutExtension(hello *ClientHelloMessage, t uint16) *ClientHelloMessage {
+	stripped := *hello
+	stripped.Extensions = nil
+	for _, extension := range hello.Extensions {
+		if extension.Type != t {
+			stripped.Extensions = append(stripped.Extensions, extension)
+		}
+	}
+	return &stripped
+}
+
+// Returns the hello with extension replacing the one of the same type.
+func withExtension(hello *ClientHelloMessage, extension Extension) *ClientHelloMessage {
+	replaced := *hello
+	replaced.Extensions = append([]Extension(nil), hello.Extensions...)
+	for i := range replaced.Extensions {
+		if replaced.Extensions[i].Type == extension.Type {
+			replaced.Extensions[i] = extension
+		}
+	}
+	return &replaced
+}
+
+// Carries a handshake message in records of at most size bytes.
+func smallRecords(message []byte, size int) []byte {
+	var stream []byte
+	for len(message) > 0 {
+		n := min(len(message), size)
+		record := &TLSRecord{ContentType: RecordHandshake, Version: VersionTLS10, Length: uint16(n), Fragment: message[:n]}
+		stream = append(stream, record.Bytes()...)
+		message = message[n:]
+	}
+	return stream
+}
+
+const (
+	chromeJA3     = "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	chromeJA3Hash = "cd08e31494f9531f560d64c695473da9"
+)
+
+func TestFingerprint(t *testing.T) {
+	chrome := chromeHello()
+	tls12 := withoutExtension(withoutExtension(chrome, ExtensionSupportedVersions), ExtensionKeyShare)
+	tests := []struct {
+		name  string
+		hello *ClientHelloMessage
+		ja3   string
+		ja4   string
+	}{
+		{"reference", chrome, chromeJA3, "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		{"without GREASE", withoutGREASE(chrome), chromeJA3, "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		// Part c leaves out server_name anyway, only the flag and the count change
+		{"no SNI", withoutExtension(chrome, ExtensionServerName),
+			"771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+			"t13i1515h2_8daaf6152771_e5627efa2ab1"},
+		// Hex of "@h2" is 406832
+		{"non-alphanumeric ALPN", withExtension(chrome, ALPNExtension("@h2", "http/1.1")), chromeJA3, "t13d151642_8daaf6152771_e5627efa2ab1"},
+		{"non-alphanumeric last ALPN character", withExtension(chrome, ALPNExtension("h2\x00")), chromeJA3, "t13d151660_8daaf6152771_e5627efa2ab1"},
+		{"no ALPN", withoutExtension(chrome, ExtensionALPN),
+			"771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+			"t13d151500_8daaf6152771_e5627efa2ab1"},
+		{"TLS 1.2", tls12,
+			"771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-45-27-17513-21,29-23-24,0",
+			"t12d1514h2_8daaf6152771_a4f86eca8fd9"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := test.hello.Marshal()
+			for name, raw := range map[string][]byte{
+				"handshake":     message,
+				"records":       smallRecords(message, 64),
+				"single record": smallRecords(message, MaxPlaintext),
+			} {
+				fingerprint, err := NewFingerprint(raw)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if fingerprint.JA3 != test.ja3 {
+					t.Errorf("%s: JA3\n%s\nwant\n%s", name, fingerprint.JA3, test.ja3)
+				}
+				sum := md5.Sum([]byte(test.ja3))
+				if fingerprint.JA3Hash != hex.EncodeToString(sum[:]) {
+					t.Errorf("%s: JA3 hash %s", name, fingerprint.JA3Hash)
+				}
+				if fingerprint.JA4 != test.ja4 {
+					t.Errorf("%s: JA4 %s, want %s", name, fingerprint.JA4, test.ja4)
+				}
+				if ja3, err := JA3(raw); err != nil || ja3 != fingerprint.JA3 {
+					t.Errorf("%s: JA3() = %q, %v", name, ja3, err)
+				}
+				if ja4, err := JA4(raw); err != nil || ja4 != fingerprint.JA4 {
+					t.Errorf("%s: JA4() = %q, %v", name, ja4, err)
+				}
+			}
+		})
+	}
+
+	fingerprint, err := NewFingerprint(chrome.Marshal())
+	if err != nil || fingerprint.JA3Hash != chromeJA3Hash {
+		t.Errorf("Chrome JA3 hash %v, %v, want %s", fingerprint, err, chromeJA3Hash)
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	for i := uint16(0); i < 16; i++ {
+		value := 0x0A0A | i<<12 | i<<4
+		if !isGREASE(value) {
+			t.Errorf("%04x is GREASE", value)
+		}
+	}
+	for _, value := range []uint16{0x0A1A, 0x1A0A, 0x0A0B, 0x0000, 0xFAFB, 0x1301} {
+		if isGREASE(value) {
+			t.Errorf("%04x is not GREASE", value)
+		}
+	}
+}
+
+func TestFingerprintErrors(t *testing.T) {
+	message := chromeHello().Marshal()
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"empty", nil},
+		{"truncated message", message[:len(message)-1]},
+		{"truncated record", smallRecords(message, 64)[:100]},
+		{"not a ClientHello", (&ServerHelloMessage{Version: VersionTLS12}).Marshal()},
+	}
+	for _, test := range tests {
+		if _, err := NewFingerprint(test.raw); err == nil {
+			t.Errorf("%s: NewFingerprint succeeded", test.name)
+		}
+	}
+}
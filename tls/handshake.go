@@ -0,0 +1,578 @@
+package tls
+
+// Handshake messages of TLS 1.2 and 1.3.
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Random value of a ServerHello that is really a HelloRetryRequest (RFC 8446, 4.1.3).
+var HelloRetryRequestRandom = [32]byte{
+	0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11,
+	0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+	0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E,
+	0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+}
+
+var errUnsupportedCurveType = errors.New("tls: only named curve key exchange parameters are supported")
+
+// A handshake message.
+type HandshakeMessage interface {
+	// Handshake message type
+	Type() byte
+	// Encodes the message including its 4 byte header.
+	Marshal() []byte
+}
+
+// Prepends the 4 byte handshake header to body.
+func handshakeBytes(messageType byte, body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(messageType)
+	putVector24(&buf, body)
+	return buf.Bytes()
+}
+
+// Decodes the handshake message at the front of data.
+//
+// The version decides the layout of messages that changed in TLS 1.3.
+// Unknown message types are returned as *RawHandshake.
+//
+// Returns the message, the amount of bytes used and a error (can be nil).
+func ParseHandshake(data []byte, version uint16) (HandshakeMessage, int, error) {
+	p := &parser{data: data}
+	messageType := p.uint8()
+	body := p.vector24()
+	if p.err != nil {
+		return nil, 0, p.err
+	}
+	used := len(data) - len(p.data)
+	tls13 := version >= VersionTLS13
+
+	var message HandshakeMessage
+	var err error
+	switch messageType {
+	case TypeClientHello:
+		message, err = parseClientHello(body)
+	case TypeServerHello:
+		message, err = parseServerHello(body)
+	case TypeNewSessionTicket:
+		message, err = parseNewSessionTicket(body, tls13)
+	case TypeEndOfEarlyData:
+		message, err = &EndOfEarlyDataMessage{}, (&parser{data: body}).finish()
+	case TypeEncryptedExtensions:
+		message, err = parseEncryptedExtensions(body)
+	case TypeCertificate:
+		message, err = parseCertificate(body, tls13)
+	case TypeServerKeyExchange:
+		message, err = parseServerKeyExchange(body)
+	case TypeCertificateRequest:
+		message, err = parseCertificateRequest(body, tls13)
+	case TypeServerHelloDone:
+		message, err = &ServerHelloDoneMessage{}, (&parser{data: body}).finish()
+	case TypeCertificateVerify:
+		message, err = parseCertificateVerify(body)
+	case TypeClientKeyExchange:
+		message, err = parseClientKeyExchange(body)
+	case TypeFinished:
+		message, err = &FinishedMessage{VerifyData: body}, nil
+	case TypeKeyUpdate:
+		message, err = parseKeyUpdate(body)
+	default:
+		message, err = &RawHandshake{MessageType: messageType, Body: body}, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return message, used, nil
+}
+
+// Decodes a buffer holding several handshake messages, such as the
+// reassembled handshake records of one flight.
+//
+// Returns a error (can be nil)
+func ParseHandshakeMessages(data []byte, version uint16) ([]HandshakeMessage, error) {
+	var messages []HandshakeMessage
+	for len(data) > 0 {
+		message, used, err := ParseHandshake(data, version)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, message)
+		data = data[used:]
+	}
+	return messages, nil
+}
+
+// Handshake message of a type this package has no structure for.
+type RawHandshake struct {
+	MessageType byte
+	Body        []byte
+}
+
+func (m *RawHandshake) Type() byte { return m.MessageType }
+
+func (m *RawHandshake) Marshal() []byte {
+	return handshakeBytes(m.MessageType, m.Body)
+}
+
+// ClientHello
+type ClientHelloMessage struct {
+	Version            uint16
+	Random             [32]byte
+	SessionID          []byte
+	CipherSuites       []uint16
+	CompressionMethods []byte
+	Extensions         []Extension
+}
+
+func (m *ClientHelloMessage) Type() byte { return TypeClientHello }
+
+func (m *ClientHelloMessage) Marshal() []byte {
+	var body bytes.Buffer
+	putUint16(&body, m.Version)
+	body.Write(m.Random[:])
+	putVector8(&body, m.SessionID)
+	putVector16(&body, uint16List(m.CipherSuites))
+	putVector8(&body, m.CompressionMethods)
+	if m.Extensions != nil {
+		marshalExtensions(&body, m.Extensions)
+	}
+	return handshakeBytes(TypeClientHello, body.Bytes())
+}
+
+// Returns the extension of type t.
+func (m *ClientHelloMessage) Extension(t uint16) (Extension, bool) {
+	return findExtension(m.Extensions, t)
+}
+
+func parseClientHello(body []byte) (*ClientHelloMessage, error) {
+	p := &parser{data: body}
+	m := &ClientHelloMessage{Version: p.uint16()}
+	copy(m.Random[:], p.bytes(32))
+	m.SessionID = p.vector8()
+	suites := p.vector16()
+	m.CompressionMethods = p.vector8()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if len(m.SessionID) > 32 || len(m.CompressionMethods) == 0 {
+		return nil, errors.New("tls: malformed ClientHello")
+	}
+
+	var err error
+	if m.CipherSuites, err = parseUint16List(suites); err != nil {
+		return nil, err
+	}
+	// Extensions are optional before TLS 1.3
+	if !p.empty() {
+		if m.Extensions, err = parseExtensions(p.vector16()); err != nil {
+			return nil, err
+		}
+	}
+	return m, p.finish()
+}
+
+// ServerHello (and HelloRetryRequest)
+type ServerHelloMessage struct {
+	Version           uint16
+	Random            [32]byte
+	SessionID         []byte
+	CipherSuite       uint16
+	CompressionMethod byte
+	Extensions        []Extension
+}
+
+func (m *ServerHelloMessage) Type() byte { return TypeServerHello }
+
+func (m *ServerHelloMessage) Marshal() []byte {
+	var body bytes.Buffer
+	putUint16(&body, m.Version)
+	body.Write(m.Random[:])
+	putVector8(&body, m.SessionID)
+	putUint16(&body, m.CipherSuite)
+	body.WriteByte(m.CompressionMethod)
+	if m.Extensions != nil {
+		marshalExtensions(&body, m.Extensions)
+	}
+	return handshakeBytes(TypeServerHello, body.Bytes())
+}
+
+// Returns the extension of type t.
+func (m *ServerHelloMessage) Extension(t uint16) (Extension, bool) {
+	return findExtension(m.Extensions, t)
+}
+
+// Returns true if the message is a TLS 1.3 HelloRetryRequest.
+func (m *ServerHelloMessage) IsHelloRetryRequest() bool {
+	return m.Random == HelloRetryRequestRandom
+}
+
+// Returns the negotiated version, taking supported_versions into account.
+func (m *ServerHelloMessage) NegotiatedVersion() uint16 {
+	if extension, ok := m.Extension(ExtensionSupportedVersions); ok {
+		if version, err := extension.SelectedVersion(); err == nil {
+			return version
+		}
+	}
+	return m.Version
+}
+
+func parseServerHello(body []byte) (*ServerHelloMessage, error) {
+	p := &parser{data: body}
+	m := &ServerHelloMessage{Version: p.uint16()}
+	copy(m.Random[:], p.bytes(32))
+	m.SessionID = p.vector8()
+	m.CipherSuite = p.uint16()
+	m.CompressionMethod = p.uint8()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if !p.empty() {
+		var err error
+		if m.Extensions, err = parseExtensions(p.vector16()); err != nil {
+			return nil, err
+		}
+	}
+	return m, p.finish()
+}
+
+// EncryptedExtensions (TLS 1.3)
+type EncryptedExtensionsMessage struct {
+	Extensions []Extension
+}
+
+func (m *EncryptedExtensionsMessage) Type() byte { return TypeEncryptedExtensions }
+
+func (m *EncryptedExtensionsMessage) Marshal() []byte {
+	var body bytes.Buffer
+	marshalExtensions(&body, m.Extensions)
+	return handshakeBytes(TypeEncryptedExtensions, body.Bytes())
+}
+
+func parseEncryptedExtensions(body []byte) (*EncryptedExtensionsMessage, error) {
+	p := &parser{data: body}
+	list := p.vector16()
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	extensions, err := parseExtensions(list)
+	return &EncryptedExtensionsMessage{Extensions: extensions}, err
+}
+
+// Entry of a Certificate message, extensions are only used in TLS 1.3.
+type CertificateEntry struct {
+	Data       []byte
+	Extensions []Extension
+}
+
+// Certificate
+type CertificateMessage struct {
+	TLS13 bool
+	// Certificate request context (TLS 1.3)
+	RequestContext []byte
+	Certificates   []CertificateEntry
+}
+
+func (m *CertificateMessage) Type() byte { return TypeCertificate }
+
+func (m *CertificateMessage) Marshal() []byte {
+	var list bytes.Buffer
+	for _, entry := range m.Certificates {
+		putVector24(&list, entry.Data)
+		if m.TLS13 {
+			marshalExtensions(&list, entry.Extensions)
+		}
+	}
+
+	var body bytes.Buffer
+	if m.TLS13 {
+		putVector8(&body, m.RequestContext)
+	}
+	putVector24(&body, list.Bytes())
+	return handshakeBytes(TypeCertificate, body.Bytes())
+}
+
+// Returns the DER encoded certificates, leaf first.
+func (m *CertificateMessage) Chain() [][]byte {
+	chain := make([][]byte, 0, len(m.Certificates))
+	for _, entry := range m.Certificates {
+		chain = append(chain, entry.Data)
+	}
+	return chain
+}
+
+func parseCertificate(body []byte, tls13 bool) (*CertificateMessage, error) {
+	p := &parser{data: body}
+	m := &CertificateMessage{TLS13: tls13}
+	if tls13 {
+		m.RequestContext = p.vector8()
+	}
+	list := &parser{data: p.vector24()}
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	for !list.empty() {
+		entry := CertificateEntry{Data: list.vector24()}
+		if tls13 {
+			extensions, err := parseExtensions(list.vector16())
+			if err != nil {
+				return nil, err
+			}
+			entry.Extensions = extensions
+		}
+		if list.err != nil {
+			return nil, list.err
+		}
+		m.Certificates = append(m.Certificates, entry)
+	}
+	return m, nil
+}
+
+// ServerKeyExchange carrying ECDHE parameters (TLS 1.2)
+type ServerKeyExchangeMessage struct {
+	// Always 3 (named_curve)
+	CurveType          byte
+	NamedCurve         uint16
+	PublicKey          []byte
+	SignatureAlgorithm uint16
+	Signature          []byte
+}
+
+func (m *ServerKeyExchangeMessage) Type() byte { return TypeServerKeyExchange }
+
+// Encodes the parameters covered by the signature.
+func (m *ServerKeyExchangeMessage) Params() []byte {
+	var params bytes.Buffer
+	params.WriteByte(m.CurveType)
+	putUint16(&params, m.NamedCurve)
+	putVector8(&params, m.PublicKey)
+	return params.Bytes()
+}
+
+func (m *ServerKeyExchangeMessage) Marshal() []byte {
+	var body bytes.Buffer
+	body.Write(m.Params())
+	putUint16(&body, m.SignatureAlgorithm)
+	putVector16(&body, m.Signature)
+	return handshakeBytes(TypeServerKeyExchange, body.Bytes())
+}
+
+func parseServerKeyExchange(body []byte) (*ServerKeyExchangeMessage, error) {
+	p := &parser{data: body}
+	m := &ServerKeyExchangeMessage{CurveType: p.uint8()}
+	if p.err == nil && m.CurveType != 3 {
+		return nil, errUnsupportedCurveType
+	}
+	m.NamedCurve = p.uint16()
+	m.PublicKey = p.vector8()
+	m.SignatureAlgorithm = p.uint16()
+	m.Signature = p.vector16()
+	return m, p.finish()
+}
+
+// CertificateRequest
+type CertificateRequestMessage struct {
+	TLS13 bool
+	// Certificate request context and extensions (TLS 1.3)
+	RequestContext []byte
+	Extensions     []Extension
+	// Certificate types, signature algorithms and DER encoded CA names (TLS 1.2)
+	CertificateTypes    []byte
+	SignatureAlgorithms []uint16
+	CertificateAuths    [][]byte
+}
+
+func (m *CertificateRequestMessage) Type() byte { return TypeCertificateRequest }
+
+func (m *CertificateRequestMessage) Marshal() []byte {
+	var body bytes.Buffer
+	if m.TLS13 {
+		putVector8(&body, m.RequestContext)
+		marshalExtensions(&body, m.Extensions)
+	} else {
+		putVector8(&body, m.CertificateTypes)
+		putVector16(&body, uint16List(m.SignatureAlgorithms))
+		var authorities bytes.Buffer
+		for _, authority := range m.CertificateAuths {
+			putVector16(&authorities, authority)
+		}
+		putVector16(&body, authorities.Bytes())
+	}
+	return handshakeBytes(TypeCertificateRequest, body.Bytes())
+}
+
+func parseCertificateRequest(body []byte, tls13 bool) (*CertificateRequestMessage, error) {
+	p := &parser{data: body}
+	m := &CertificateRequestMessage{TLS13: tls13}
+	var err error
+	if tls13 {
+		m.RequestContext = p.vector8()
+		list := p.vector16()
+		if err := p.finish(); err != nil {
+			return nil, err
+		}
+		m.Extensions, err = parseExtensions(list)
+		return m, err
+	}
+
+	m.CertificateTypes = p.vector8()
+	algorithms := p.vector16()
+	authorities := &parser{data: p.vector16()}
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	if m.SignatureAlgorithms, err = parseUint16List(algorithms); err != nil {
+		return nil, err
+	}
+	for !authorities.empty() {
+		authority := authorities.vector16()
+		if authorities.err != nil {
+			return nil, authorities.err
+		}
+		m.CertificateAuths = append(m.CertificateAuths, authority)
+	}
+	return m, nil
+}
+
+// ServerHelloDone (TLS 1.2)
+type ServerHelloDoneMessage struct{}
+
+func (m *ServerHelloDoneMessage) Type() byte { return TypeServerHelloDone }
+
+func (m *ServerHelloDoneMessage) Marshal() []byte {
+	return handshakeBytes(TypeServerHelloDone, nil)
+}
+
+// CertificateVerify
+type CertificateVerifyMessage struct {
+	SignatureAlgorithm uint16
+	Signature          []byte
+}
+
+func (m *CertificateVerifyMessage) Type() byte { return TypeCertificateVerify }
+
+func (m *CertificateVerifyMessage) Marshal() []byte {
+	var body bytes.Buffer
+	putUint16(&body, m.SignatureAlgorithm)
+	putVector16(&body, m.Signature)
+	return handshakeBytes(TypeCertificateVerify, body.Bytes())
+}
+
+func parseCertificateVerify(body []byte) (*CertificateVerifyMessage, error) {
+	p := &parser{data: body}
+	m := &CertificateVerifyMessage{SignatureAlgorithm: p.uint16(), Signature: p.vector16()}
+	return m, p.finish()
+}
+
+// ClientKeyExchange carrying an ECDHE public key (TLS 1.2)
+type ClientKeyExchangeMessage struct {
+	PublicKey []byte
+}
+
+func (m *ClientKeyExchangeMessage) Type() byte { return TypeClientKeyExchange }
+
+func (m *ClientKeyExchangeMessage) Marshal() []byte {
+	var body bytes.Buffer
+	putVector8(&body, m.PublicKey)
+	return handshakeBytes(TypeClientKeyExchange, body.Bytes())
+}
+
+func parseClientKeyExchange(body []byte) (*ClientKeyExchangeMessage, error) {
+	p := &parser{data: body}
+	m := &ClientKeyExchangeMessage{PublicKey: p.vector8()}
+	return m, p.finish()
+}
+
+// Finished
+type FinishedMessage struct {
+	VerifyData []byte
+}
+
+func (m *FinishedMessage) Type() byte { return TypeFinished }
+
+func (m *FinishedMessage) Marshal() []byte {
+	return handshakeBytes(TypeFinished, m.VerifyData)
+}
+
+// NewSessionTicket
+type NewSessionTicketMessage struct {
+	TLS13    bool
+	Lifetime uint32
+	// Age add, nonce and extensions (TLS 1.3)
+	AgeAdd     uint32
+	Nonce      []byte
+	Ticket     []byte
+	Extensions []Extension
+}
+
+func (m *NewSessionTicketMessage) Type() byte { return TypeNewSessionTicket }
+
+func (m *NewSessionTicketMessage) Marshal() []byte {
+	var body bytes.Buffer
+	body.Write([]byte{byte(m.Lifetime >> 24), byte(m.Lifetime >> 16), byte(m.Lifetime >> 8), byte(m.Lifetime)})
+	if m.TLS13 {
+		body.Write([]byte{byte(m.AgeAdd >> 24), byte(m.AgeAdd >> 16), byte(m.AgeAdd >> 8), byte(m.AgeAdd)})
+		putVector8(&body, m.Nonce)
+		putVector16(&body, m.Ticket)
+		marshalExtensions(&body, m.Extensions)
+	} else {
+		putVector16(&body, m.Ticket)
+	}
+	return handshakeBytes(TypeNewSessionTicket, body.Bytes())
+}
+
+func parseNewSessionTicket(body []byte, tls13 bool) (*NewSessionTicketMessage, error) {
+	p := &parser{data: body}
+	m := &NewSessionTicketMessage{TLS13: tls13, Lifetime: p.uint32()}
+	if !tls13 {
+		m.Ticket = p.vector16()
+		return m, p.finish()
+	}
+	m.AgeAdd = p.uint32()
+	m.Nonce = p.vector8()
+	m.Ticket = p.vector16()
+	list := p.vector16()
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	var err error
+	m.Extensions, err = parseExtensions(list)
+	return m, err
+}
+
+// EndOfEarlyData (TLS 1.3)
+type EndOfEarlyDataMessage struct{}
+
+func (m *EndOfEarlyDataMessage) Type() byte { return TypeEndOfEarlyData }
+
+func (m *EndOfEarlyDataMessage) Marshal() []byte {
+	return handshakeBytes(TypeEndOfEarlyData, nil)
+}
+
+// KeyUpdate (TLS 1.3)
+type KeyUpdateMessage struct {
+	UpdateRequested bool
+}
+
+func (m *KeyUpdateMessage) Type() byte { return TypeKeyUpdate }
+
+func (m *KeyUpdateMessage) Marshal() []byte {
+	var request byte
+	if m.UpdateRequested {
+		request = 1
+	}
+	return handshakeBytes(TypeKeyUpdate, []byte{request})
+}
+
+func parseKeyUpdate(body []byte) (*KeyUpdateMessage, error) {
+	p := &parser{data: body}
+	request := p.uint8()
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	if request > 1 {
+		return nil, errors.New("tls: invalid KeyUpdate request")
+	}
+	return &KeyUpdateMessage{UpdateRequested: request == 1}, nil
+}
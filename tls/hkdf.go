@@ -0,0 +1,57 @@
+package tls
+
+// HKDF (RFC 5869) and the TLS 1.3 key schedule helpers (RFC 8446, 7.1).
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"hash"
+)
+
+// Concentrates the entropy of ikm into a pseudorandom key.
+//
+// A nil salt or ikm stands for a string of zeros as long as the hash (RFC 8446, 7.1).
+func hkdfExtract(newHash func() hash.Hash, salt []byte, ikm []byte) []byte {
+	if salt == nil {
+		salt = make([]byte, newHash().Size())
+	}
+	if ikm == nil {
+		ikm = make([]byte, newHash().Size())
+	}
+	mac := hmac.New(newHash, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// Stretches a pseudorandom key into length bytes of output bound to info.
+func hkdfExpand(newHash func() hash.Hash, prk []byte, info []byte, length int) []byte {
+	var out []byte
+	var previous []byte
+	mac := hmac.New(newHash, prk)
+	for counter := byte(1); len(out) < length; counter++ {
+		mac.Reset()
+		mac.Write(previous)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		previous = mac.Sum(nil)
+		out = append(out, previous...)
+	}
+	return out[:length]
+}
+
+// HKDF-Expand-Label
+func expandLabel(newHash func() hash.Hash, secret []byte, label string, context []byte, length int) []byte {
+	var info bytes.Buffer
+	putUint16(&info, uint16(length))
+	putVector8(&info, []byte("tls13 "+label))
+	putVector8(&info, context)
+	return hkdfExpand(newHash, secret, info.Bytes(), length)
+}
+
+// Derive-Secret, transcript is the hash of the handshake messages so far (can be nil for an empty transcript).
+func deriveSecret(newHash func() hash.Hash, secret []byte, label string, transcript hash.Hash) []byte {
+	if transcript == nil {
+		transcript = newHash()
+	}
+	return expandLabel(newHash, secret, label, transcript.Sum(nil), newHash().Size())
+}
@@ -0,0 +1,117 @@
+package tls
+
+// Peeking at the ClientHello of a connection without terminating TLS.
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+)
+
+var errNotHandshake = errors.New("tls: first record is not a handshake record")
+var errNotClientHello = errors.New("tls: first handshake message is not a ClientHello")
+
+// Largest ClientHello accepted while peeking.
+const maxPeekedHello = 64 * 1024
+
+// Information taken from a ClientHello.
+type ClientHelloInfo struct {
+	ServerName        string
+	ALPNProtocols     []string
+	SupportedVersions []uint16
+	// Decoded message
+	Hello *ClientHelloMessage
+	// Raw handshake message (header included)
+	Raw []byte
+}
+
+// Extracts the routing relevant fields of a ClientHello.
+//
+// Returns a error (can be nil)
+func InspectClientHello(raw []byte) (*ClientHelloInfo, error) {
+	message, used, err := ParseHandshake(raw, VersionTLS12)
+	if err != nil {
+		return nil, err
+	}
+	hello, ok := message.(*ClientHelloMessage)
+	if !ok {
+		return nil, errNotClientHello
+	}
+
+	info := &ClientHelloInfo{Hello: hello, Raw: raw[:used]}
+	if extension, ok := hello.Extension(ExtensionServerName); ok {
+		if info.ServerName, err = extension.ServerName(); err != nil {
+			return nil, err
+		}
+	}
+	if extension, ok := hello.Extension(ExtensionALPN); ok {
+		if info.ALPNProtocols, err = extension.ALPNProtocols(); err != nil {
+			return nil, err
+		}
+	}
+	if extension, ok := hello.Extension(ExtensionSupportedVersions); ok {
+		if info.SupportedVersions, err = extension.SupportedVersions(); err != nil {
+			return nil, err
+		}
+	} else {
+		info.SupportedVersions = []uint16{hello.Version}
+	}
+	return info, nil
+}
+
+// Connection that replays the bytes consumed while peeking before reading from the network.
+type PeekedConn struct {
+	net.Conn
+	// ClientHello read from the connection
+	Info   *ClientHelloInfo
+	reader io.Reader
+}
+
+func (conn *PeekedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// Reads the ClientHello of a connection, it can span several records.
+//
+// The returned connection still yields every byte, so it can be handed to
+// crypto/tls or proxied elsewhere. On error the connection is not closed.
+//
+// Returns a error (can be nil)
+func PeekClientHello(conn net.Conn) (*PeekedConn, error) {
+	var consumed bytes.Buffer
+	var handshake []byte
+	source := io.TeeReader(conn, &consumed)
+
+	for {
+		record, err := ReadRecord(source)
+		if err != nil {
+			return nil, err
+		}
+		if record.ContentType != RecordHandshake {
+			return nil, errNotHandshake
+		}
+		handshake = append(handshake, record.Fragment...)
+
+		if len(handshake) >= 4 {
+			if handshake[0] != TypeClientHello {
+				return nil, errNotClientHello
+			}
+			length := 4 + (int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3]))
+			if length > maxPeekedHello {
+				return nil, errRecordOverflow
+			}
+			if len(handshake) >= length {
+				info, err := InspectClientHello(handshake[:length])
+				if err != nil {
+					return nil, err
+				}
+				return &PeekedConn{
+					Conn:   conn,
+					Info:   info,
+					reader: io.MultiReader(bytes.NewReader(consumed.Bytes()), conn),
+				}, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Sends data over a pipe then closes it.
+//
+// Returns the receiving end
+func pipeSending(t *testing.T, data []byte) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	return server
+}
+
+func TestPeekClientHello(t *testing.T) {
+	message := withExtension(chromeHello(), ServerNameExtension("Example.COM")).Marshal()
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"one record", smallRecords(message, MaxPlaintext)},
+		{"many records", smallRecords(message, 64)},
+		// The handshake header itself is split
+		{"one byte records", smallRecords(message, 1)},
+		{"three byte records", smallRecords(message, 3)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Application data sent right after the ClientHello, as 0-RTT data would be
+			trailer := []byte{RecordApplicationData, 3, 3, 0, 2, 'h', 'i'}
+			stream := append(bytes.Clone(test.stream), trailer...)
+			peeked, err := PeekClientHello(pipeSending(t, stream))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if peeked.Info.ServerName != "Example.COM" {
+				t.Errorf("ServerName %q", peeked.Info.ServerName)
+			}
+			if len(peeked.Info.ALPNProtocols) != 2 || peeked.Info.ALPNProtocols[0] != "h2" {
+				t.Errorf("ALPNProtocols %q", peeked.Info.ALPNProtocols)
+			}
+			if !bytes.Equal(peeked.Info.Raw, message) {
+				t.Error("Raw is not the handshake message")
+			}
+
+			replayed, err := io.ReadAll(peeked)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(replayed, stream) {
+				t.Fatalf("replayed %d bytes, sent %d", len(replayed), len(stream))
+			}
+		})
+	}
+}
+
+func TestPeekClientHelloErrors(t *testing.T) {
+	message := chromeHello().Marshal()
+	tests := []struct {
+		name   string
+		stream []byte
+		// Expected error, nil for any
+		err error
+	}{
+		{"empty", nil, io.EOF},
+		{"application data", []byte{RecordApplicationData, 3, 3, 0, 1, 'x'}, errNotHandshake},
+		{"alert", []byte{RecordAlert, 3, 3, 0, 2, 2, 40}, errNotHandshake},
+		{"handshake then application data", append(smallRecords(message[:10], 10), RecordApplicationData, 3, 3, 0, 1, 'x'), errNotHandshake},
+		{"not a ClientHello", smallRecords((&ServerHelloMessage{Version: VersionTLS12}).Marshal(), 64), errNotClientHello},
+		// Refused from the header, before the 64 KiB arrive
+		{"oversize message", smallRecords([]byte{TypeClientHello, 1, 0, 0}, 4), errRecordOverflow},
+		{"oversize record", []byte{RecordHandshake, 3, 3, 0x48, 0x01}, errRecordOverflow},
+		{"truncated record", smallRecords(message, 64)[:30], nil},
+		{"truncated message", smallRecords(message[:len(message)-1], 64), nil},
+		{"malformed ClientHello", smallRecords([]byte{TypeClientHello, 0, 0, 3, 3, 3, 0}, 64), nil},
+		{"HTTP request", []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peeked, err := PeekClientHello(pipeSending(t, test.stream))
+			if err == nil {
+				t.Fatalf("peeked %+v", peeked.Info)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// Connection splitting the records of its first write into records of size bytes.
+type fragmentingConn struct {
+	net.Conn
+	size    int
+	written bool
+}
+
+func (conn *fragmentingConn) Write(b []byte) (int, error) {
+	if conn.written {
+		return conn.Conn.Write(b)
+	}
+	conn.written = true
+	var stream []byte
+	for rest := b; len(rest) > 0; {
+		record, used, err := ParseRecord(rest)
+		if err != nil {
+			return 0, err
+		}
+		stream = append(stream, smallRecords(record.Fragment, conn.size)...)
+		rest = rest[used:]
+	}
+	if _, err := conn.Conn.Write(stream); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// crypto/tls completes the handshake on a peeked connection.
+func TestPeekedConnHandshake(t *testing.T) {
+	cert, pool := testCertificate(t, false)
+	server := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}}
+
+	for _, size := range []int{MaxPlaintext, 100, 7} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		infos := make(chan *ClientHelloInfo, 1)
+		serverErr := make(chan error, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				serverErr <- err
+				return
+			}
+			defer conn.Close()
+			peeked, err := PeekClientHello(conn)
+			if err != nil {
+				serverErr <- err
+				return
+			}
+			infos <- peeked.Info
+			tlsConn := tls.Server(peeked, server)
+			line := make([]byte, 5)
+			if _, err := io.ReadFull(tlsConn, line); err != nil {
+				serverErr <- err
+				return
+			}
+			_, err = tlsConn.Write(line)
+			serverErr <- err
+		}()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		client := tls.Client(&fragmentingConn{Conn: conn, size: size}, &tls.Config{ServerName: "localhost", RootCAs: pool, NextProtos: []string{"h2"}})
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("records of %d bytes: %v", size, err)
+		}
+		if protocol := client.ConnectionState().NegotiatedProtocol; protocol != "h2" {
+			t.Errorf("records of %d bytes: negotiated %q", size, protocol)
+		}
+		client.Write([]byte("hello"))
+		echo := make([]byte, 5)
+		if _, err := io.ReadFull(client, echo); err != nil || string(echo) != "hello" {
+			t.Fatalf("records of %d bytes: echoed %q, %v", size, echo, err)
+		}
+		if err := <-serverErr; err != nil {
+			t.Fatalf("records of %d bytes: %v", size, err)
+		}
+		if info := <-infos; info.ServerName != "localhost" {
+			t.Errorf("records of %d bytes: ServerName %q", size, info.ServerName)
+		}
+		client.Close()
+	}
+}
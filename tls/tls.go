@@ -2,139 +2,254 @@ package tls
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
-	"math/rand/v2"
+	"errors"
+	"io"
 )
 
-// TERRIBLE ATTEMPT AT TLS
-// THIS IS ALL FOR TESTING
+// TLS record layer and handshake message codec.
+// Written to learn how TLS works, use crypto/tls for real connections.
 
+// Record content types
 const (
-	clientHello        = byte(1)
-	serverHello        = byte(2)
-	certificateMessage = byte(0x0B)
-	serverKeyExchange  = byte(0x0C)
-	serverHelloDone    = byte(0x0E)
-	changeCipherSpec   = byte(0x14)
+	RecordChangeCipherSpec = byte(20)
+	RecordAlert            = byte(21)
+	RecordHandshake        = byte(22)
+	RecordApplicationData  = byte(23)
 )
 
-// TLS Record header
+// Protocol versions
+const (
+	VersionTLS10 = uint16(0x0301)
+	VersionTLS11 = uint16(0x0302)
+	VersionTLS12 = uint16(0x0303)
+	VersionTLS13 = uint16(0x0304)
+)
+
+// Handshake message types
+const (
+	TypeClientHello         = byte(1)
+	TypeServerHello         = byte(2)
+	TypeNewSessionTicket    = byte(4)
+	TypeEndOfEarlyData      = byte(5)
+	TypeEncryptedExtensions = byte(8)
+	TypeCertificate         = byte(11)
+	TypeServerKeyExchange   = byte(12)
+	TypeCertificateRequest  = byte(13)
+	TypeServerHelloDone     = byte(14)
+	TypeCertificateVerify   = byte(15)
+	TypeClientKeyExchange   = byte(16)
+	TypeFinished            = byte(20)
+	TypeKeyUpdate           = byte(24)
+	TypeMessageHash         = byte(254)
+)
+
+// Largest plaintext fragment allowed in a record.
+const MaxPlaintext = 16384
+
+// Largest ciphertext fragment allowed in a record (TLS 1.2 allows 2048 bytes of expansion).
+const MaxCiphertext = MaxPlaintext + 2048
+
+// Length of the record header.
+const RecordHeaderLength = 5
+
+var errRecordOverflow = errors.New("tls: record fragment too large")
+
+// TLS Record
 type TLSRecord struct {
-	contentType uint
-	version     uint16
-	length      uint16
+	ContentType byte
+	Version     uint16
+	Length      uint16
+	Fragment    []byte
 }
 
-func (record *TLSRecord) Bytes() []byte {
-	var a []byte = []byte{byte(record.contentType)}
+// Encodes the 5 byte record header.
+func (record *TLSRecord) Header() []byte {
+	var a []byte = []byte{record.ContentType}
 	versionBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(versionBytes, record.version)
+	binary.BigEndian.PutUint16(versionBytes, record.Version)
 	lengthBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(lengthBytes, record.length)
+	binary.BigEndian.PutUint16(lengthBytes, record.Length)
 	a = append(a, versionBytes...)
 	return append(a, lengthBytes...)
 }
 
-// Extensions
-func extensionsMessage(domain string) []byte {
-	// Domain
-	extensionDomain := new(bytes.Buffer)
-
-	domainBytes := []byte(domain)
-	// extension type 2B
-	extensionDomain.Write([]byte{0, 0})
-	// length 2B
-	extensionDomain.Write([]byte{0, byte(len(domainBytes) + 5)})
-	// server name list 2B server name type 1B
-	extensionDomain.Write([]byte{0, byte(len(domainBytes) + 3), 0})
-	// server name length 2B
-	extensionDomain.Write([]byte{0, byte(len(domainBytes))})
-	// server domain
-	extensionDomain.Write(domainBytes)
-
-	// Encryption
-	extensionSignatureAlgorithms := new(bytes.Buffer)
-	// 16B Algorithms
-	algorithms := []byte{
-		6, 1, // SHA512 + RSA
-		6, 3, // SHA512 + ECDSA
-		5, 1, // SHA384 + RSA
-		5, 3, // SHA384 + ECDSA
-		4, 1, // SHA256 + RSA
-		4, 3, // SHA256 + ECDSA
-		2, 1, // SHA1 + RSA
-		2, 3, // SHA1 + ECDSA
-	}
-	// Length of algorithm array
-	algorithmsLength := len(algorithms)
-	// 0x000D => extension type signature_algorithms
-	// byte(algorithmsLength+2) => length  byte(algorithmsLength) => length of algorithm array
-	extensionSignatureAlgorithms.Write([]byte{
-		0x00, 0x0D,
-		byte(algorithmsLength + 2), byte(algorithmsLength),
-	})
-	// 16B algorithm array
-	extensionSignatureAlgorithms.Write(algorithms)
-
-	// Renegotiations info
-	renegotiationInfo := new(bytes.Buffer)
-	renegotiationInfo.Write([]byte{
-		0xFF, 0x01,
-		0x00, 0x01,
-		0x00,
-	})
-
-	return append(append(renegotiationInfo.Bytes(), extensionSignatureAlgorithms.Bytes()...), extensionDomain.Bytes()...)
+// Encodes the record, the length is taken from the fragment.
+func (record *TLSRecord) Bytes() []byte {
+	record.Length = uint16(len(record.Fragment))
+	return append(record.Header(), record.Fragment...)
 }
 
-// Client Hello message
-func ClientHello(record *TLSRecord) []byte {
-	var message bytes.Buffer
-	// Record header
-	message.Write(record.Bytes())
-
-	// Client hello ID 1B
-	message.WriteByte(byte(0x01))
-
-	// Append size 512 bytes 3B
-	message.Write([]byte{0, 2, 0})
+// Decodes one record from the front of data.
+//
+// Returns the record, the amount of bytes used and a error (can be nil).
+func ParseRecord(data []byte) (*TLSRecord, int, error) {
+	if len(data) < RecordHeaderLength {
+		return nil, 0, errShortMessage
+	}
+	record := &TLSRecord{
+		ContentType: data[0],
+		Version:     binary.BigEndian.Uint16(data[1:3]),
+		Length:      binary.BigEndian.Uint16(data[3:5]),
+	}
+	if record.Length > MaxCiphertext {
+		return nil, 0, errRecordOverflow
+	}
+	end := RecordHeaderLength + int(record.Length)
+	if len(data) < end {
+		return nil, 0, errShortMessage
+	}
+	record.Fragment = data[RecordHeaderLength:end:end]
+	return record, end, nil
+}
 
-	// TLS version 2B
-	message.Write([]byte{3, 3})
+// Reads one record from r.
+//
+// Returns a error (can be nil)
+func ReadRecord(r io.Reader) (*TLSRecord, error) {
+	header := make([]byte, RecordHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	record := &TLSRecord{
+		ContentType: header[0],
+		Version:     binary.BigEndian.Uint16(header[1:3]),
+		Length:      binary.BigEndian.Uint16(header[3:5]),
+	}
+	if record.Length > MaxCiphertext {
+		return nil, errRecordOverflow
+	}
+	record.Fragment = make([]byte, record.Length)
+	if _, err := io.ReadFull(r, record.Fragment); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
 
-	// Random 32-bytes 32B
-	var randomBytes []byte = make([]byte, 32)
-	for i := 1; i <= len(randomBytes); i++ {
-		randomBytes[i] = byte(rand.UintN(255))
+// Splits data into records of at most MaxPlaintext bytes.
+func Fragment(contentType byte, version uint16, data []byte) []*TLSRecord {
+	var records []*TLSRecord
+	for len(data) > 0 || records == nil {
+		n := min(len(data), MaxPlaintext)
+		records = append(records, &TLSRecord{
+			ContentType: contentType,
+			Version:     version,
+			Length:      uint16(n),
+			Fragment:    data[:n],
+		})
+		data = data[n:]
 	}
-	message.Write(randomBytes)
+	return records
+}
 
-	// Null session id 1B
-	message.WriteByte(0)
+// Alert levels
+const (
+	AlertLevelWarning = byte(1)
+	AlertLevelFatal   = byte(2)
+)
 
-	// Cipher suit length 2B
-	message.Write([]byte{0, 2})
+// Alert record payload
+type Alert struct {
+	Level       byte
+	Description byte
+}
 
-	// Cipher suit 2B TLS_DHE_RSA_WITH_AES_128_CBC_SHA
-	message.Write([]byte{0, 33})
+func (alert Alert) Bytes() []byte {
+	return []byte{alert.Level, alert.Description}
+}
 
-	// Compression methods 1B
-	message.WriteByte(1)
+func (alert Alert) Error() string {
+	return "tls: received alert " + alertNames[alert.Description]
+}
 
-	// Compression none 1B
-	message.WriteByte(0)
+// Decodes an alert record payload.
+//
+// Returns a error (can be nil)
+func ParseAlert(data []byte) (Alert, error) {
+	if len(data) != 2 {
+		return Alert{}, errShortMessage
+	}
+	return Alert{Level: data[0], Description: data[1]}, nil
+}
 
-	// Extensions
-	extensionBytes := extensionsMessage("www.test.org")
-	extensionsLength := make([]byte, 2)
-	binary.BigEndian.PutUint16(extensionsLength, uint16(len(extensionBytes)))
-	message.Write(extensionsLength)
-	message.Write(extensionBytes)
+var alertNames map[byte]string = map[byte]string{
+	0:   "close_notify",
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	22:  "record_overflow",
+	40:  "handshake_failure",
+	42:  "bad_certificate",
+	43:  "unsupported_certificate",
+	44:  "certificate_revoked",
+	45:  "certificate_expired",
+	46:  "certificate_unknown",
+	47:  "illegal_parameter",
+	48:  "unknown_ca",
+	49:  "access_denied",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	70:  "protocol_version",
+	71:  "insufficient_security",
+	80:  "internal_error",
+	86:  "inappropriate_fallback",
+	90:  "user_canceled",
+	109: "missing_extension",
+	110: "unsupported_extension",
+	112: "unrecognized_name",
+	116: "certificate_required",
+	120: "no_application_protocol",
+}
+
+// Builds a ClientHello record for serverName, padded to 512 bytes of handshake data.
+//
+// Offers TLS 1.2 and 1.3 without a key share, good enough to inspect a server's reply.
+func ClientHello(serverName string) ([]byte, error) {
+	hello := &ClientHelloMessage{
+		Version:            VersionTLS12,
+		SessionID:          make([]byte, 32),
+		CompressionMethods: []byte{0},
+		CipherSuites: []uint16{
+			TLS_AES_128_GCM_SHA256,
+			TLS_AES_256_GCM_SHA384,
+			TLS_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_DHE_RSA_WITH_AES_128_CBC_SHA,
+		},
+		Extensions: []Extension{
+			RenegotiationInfoExtension(),
+			ServerNameExtension(serverName),
+			SupportedGroupsExtension(X25519, P256, P384),
+			ECPointFormatsExtension(0),
+			SignatureAlgorithmsExtension(
+				ECDSAWithP256AndSHA256,
+				PSSWithSHA256,
+				PKCS1WithSHA256,
+				ECDSAWithP384AndSHA384,
+				PSSWithSHA384,
+				PKCS1WithSHA384,
+				PKCS1WithSHA512,
+				PKCS1WithSHA1,
+			),
+			SupportedVersionsExtension(VersionTLS13, VersionTLS12),
+		},
+	}
+	if _, err := rand.Read(hello.Random[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(hello.SessionID); err != nil {
+		return nil, err
+	}
 
-	// Padding
-	messageBytes := message.Bytes()
-	requiredPadding := 512 - len(messageBytes) + 5
-	padding := make([]byte, requiredPadding)
+	// Padding (RFC 7685) up to 512 bytes of handshake data
+	if missing := 512 - len(hello.Marshal()) - 4; missing >= 0 {
+		hello.Extensions = append(hello.Extensions, Extension{Type: ExtensionPadding, Data: make([]byte, missing)})
+	}
 
-	return append(messageBytes, padding...)
+	var message bytes.Buffer
+	for _, record := range Fragment(RecordHandshake, VersionTLS10, hello.Marshal()) {
+		message.Write(record.Bytes())
+	}
+	return message.Bytes(), nil
 }
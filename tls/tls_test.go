@@ -0,0 +1,324 @@
+package tls
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns a self-signed certificate for localhost and its pool.
+func testCertificate(t testing.TB, rsaKey bool) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	var key crypto.Signer
+	var err error
+	if rsaKey {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// Connection recording what it sends and receives.
+type recordingConn struct {
+	net.Conn
+	mu       sync.Mutex
+	sent     bytes.Buffer
+	received bytes.Buffer
+}
+
+func (conn *recordingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	conn.mu.Lock()
+	conn.received.Write(b[:n])
+	conn.mu.Unlock()
+	return n, err
+}
+
+func (conn *recordingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.mu.Lock()
+	conn.sent.Write(b[:n])
+	conn.mu.Unlock()
+	return n, err
+}
+
+// Runs a crypto/tls handshake over loopback TCP.
+//
+// Returns the bytes sent by the client and by the server
+func captureHandshake(t *testing.T, client *tls.Config, server *tls.Config) ([]byte, []byte) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		tlsConn := tls.Server(conn, server)
+		err = tlsConn.Handshake()
+		if err == nil {
+			// Reading lets TLS 1.3 send its session tickets
+			tlsConn.SetReadDeadline(time.Now().Add(time.Second))
+			tlsConn.Read(make([]byte, 1))
+		}
+		serverErr <- err
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordingConn{Conn: conn}
+	tlsConn := tls.Client(recorder, client)
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	tlsConn.Write([]byte("x"))
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+	tlsConn.Close()
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return bytes.Clone(recorder.sent.Bytes()), bytes.Clone(recorder.received.Bytes())
+}
+
+// Splits a capture into records, checking that each encodes back to its bytes.
+//
+// Returns the plaintext handshake bytes sent before the first ChangeCipherSpec
+func plaintextHandshake(t *testing.T, capture []byte) []byte {
+	t.Helper()
+	var handshake []byte
+	plaintext := true
+	for len(capture) > 0 {
+		record, used, err := ParseRecord(capture)
+		if err != nil {
+			t.Fatalf("ParseRecord: %v", err)
+		}
+		if !bytes.Equal(record.Bytes(), capture[:used]) {
+			t.Fatalf("record type %d does not encode back to its bytes", record.ContentType)
+		}
+		capture = capture[used:]
+
+		switch record.ContentType {
+		case RecordChangeCipherSpec, RecordApplicationData:
+			plaintext = false
+		case RecordHandshake:
+			if plaintext {
+				handshake = append(handshake, record.Fragment...)
+			}
+		}
+	}
+	return handshake
+}
+
+// Returns the types of messages.
+func messageTypes(messages []HandshakeMessage) []byte {
+	var types []byte
+	for _, message := range messages {
+		types = append(types, message.Type())
+	}
+	return types
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	ecdsaCert, ecdsaPool := testCertificate(t, false)
+	rsaCert, rsaPool := testCertificate(t, true)
+
+	tests := []struct {
+		name        string
+		version     uint16
+		certificate tls.Certificate
+		pool        *x509.CertPool
+		suites      []uint16
+		// Plaintext messages of each side
+		client []byte
+		server []byte
+	}{
+		{
+			name:        "TLS 1.2 ECDHE-ECDSA",
+			version:     VersionTLS12,
+			certificate: ecdsaCert,
+			pool:        ecdsaPool,
+			suites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			client:      []byte{TypeClientHello, TypeClientKeyExchange},
+			server:      []byte{TypeServerHello, TypeCertificate, TypeServerKeyExchange, TypeServerHelloDone},
+		},
+		{
+			name:        "TLS 1.2 ECDHE-RSA",
+			version:     VersionTLS12,
+			certificate: rsaCert,
+			pool:        rsaPool,
+			suites:      []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256},
+			client:      []byte{TypeClientHello, TypeClientKeyExchange},
+			server:      []byte{TypeServerHello, TypeCertificate, TypeServerKeyExchange, TypeServerHelloDone},
+		},
+		{
+			name:        "TLS 1.3",
+			version:     VersionTLS13,
+			certificate: ecdsaCert,
+			pool:        ecdsaPool,
+			client:      []byte{TypeClientHello},
+			server:      []byte{TypeServerHello},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &tls.Config{ServerName: "localhost", RootCAs: test.pool, MinVersion: test.version, MaxVersion: test.version, CipherSuites: test.suites}
+			server := &tls.Config{Certificates: []tls.Certificate{test.certificate}, MinVersion: test.version, MaxVersion: test.version, CipherSuites: test.suites}
+			sent, received := captureHandshake(t, client, server)
+
+			for _, side := range []struct {
+				name    string
+				capture []byte
+				types   []byte
+			}{
+				{"client", sent, test.client},
+				{"server", received, test.server},
+			} {
+				handshake := plaintextHandshake(t, side.capture)
+				messages, err := ParseHandshakeMessages(handshake, test.version)
+				if err != nil {
+					t.Fatalf("%s: ParseHandshakeMessages: %v", side.name, err)
+				}
+				if !bytes.Equal(messageTypes(messages), side.types) {
+					t.Fatalf("%s: message types %v, want %v", side.name, messageTypes(messages), side.types)
+				}
+				var marshaled []byte
+				for _, message := range messages {
+					marshaled = append(marshaled, message.Marshal()...)
+				}
+				if !bytes.Equal(marshaled, handshake) {
+					t.Fatalf("%s: messages do not marshal back to the capture", side.name)
+				}
+			}
+		})
+	}
+}
+
+func TestClientHelloFields(t *testing.T) {
+	cert, pool := testCertificate(t, false)
+	client := &tls.Config{ServerName: "localhost", RootCAs: pool, NextProtos: []string{"h2", "http/1.1"}}
+	server := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}}
+	sent, received := captureHandshake(t, client, server)
+
+	message, _, err := ParseHandshake(plaintextHandshake(t, sent), VersionTLS13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := message.(*ClientHelloMessage)
+
+	extension, ok := hello.Extension(ExtensionServerName)
+	if !ok {
+		t.Fatal("no server_name extension")
+	}
+	if name, err := extension.ServerName(); err != nil || name != "localhost" {
+		t.Errorf("ServerName() = %q, %v", name, err)
+	}
+	extension, _ = hello.Extension(ExtensionALPN)
+	if protocols, err := extension.ALPNProtocols(); err != nil || len(protocols) != 2 || protocols[0] != "h2" {
+		t.Errorf("ALPNProtocols() = %q, %v", protocols, err)
+	}
+	extension, _ = hello.Extension(ExtensionSupportedVersions)
+	if versions, err := extension.SupportedVersions(); err != nil || versions[0] != VersionTLS13 {
+		t.Errorf("SupportedVersions() = %x, %v", versions, err)
+	}
+	extension, _ = hello.Extension(ExtensionKeyShare)
+	if shares, err := extension.KeyShares(); err != nil || len(shares) == 0 {
+		t.Errorf("KeyShares() = %v, %v", shares, err)
+	}
+
+	message, _, err = ParseHandshake(plaintextHandshake(t, received), VersionTLS13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverHello := message.(*ServerHelloMessage)
+	if serverHello.NegotiatedVersion() != VersionTLS13 || serverHello.IsHelloRetryRequest() {
+		t.Errorf("NegotiatedVersion() = %x, IsHelloRetryRequest() = %v", serverHello.NegotiatedVersion(), serverHello.IsHelloRetryRequest())
+	}
+}
+
+func TestParseRecordErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte{22, 3, 3, 0}},
+		{"short fragment", []byte{22, 3, 3, 0, 5, 1, 2}},
+		{"overflow", []byte{22, 3, 3, 0x48, 0x01}},
+	}
+	for _, test := range tests {
+		if _, _, err := ParseRecord(test.data); err == nil {
+			t.Errorf("%s: ParseRecord succeeded", test.name)
+		}
+	}
+}
+
+func TestFragment(t *testing.T) {
+	data := make([]byte, 2*MaxPlaintext+100)
+	rand.Read(data)
+
+	var stream, joined []byte
+	records := Fragment(RecordHandshake, VersionTLS12, data)
+	for _, record := range records {
+		stream = append(stream, record.Bytes()...)
+	}
+	for len(stream) > 0 {
+		record, used, err := ParseRecord(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(record.Fragment) > MaxPlaintext {
+			t.Fatalf("fragment of %d bytes", len(record.Fragment))
+		}
+		joined = append(joined, record.Fragment...)
+		stream = stream[used:]
+	}
+	if len(records) != 3 || !bytes.Equal(joined, data) {
+		t.Fatalf("%d records did not join back to the data", len(records))
+	}
+}
@@ -0,0 +1,44 @@
+package trace
+
+// Per-message trace context.
+
+// Length of the envelope prefix, a traceparent and a newline
+const EnvelopeSize = 56
+
+// Prefixes payload with sc as a traceparent and a newline:
+//
+//	00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\n<payload>
+//
+// Returns the message, payload itself if sc is not valid
+func Wrap(sc SpanContext, payload []byte) []byte {
+	if !sc.IsValid() {
+		return payload
+	}
+	return AppendEnvelope(make([]byte, 0, EnvelopeSize+len(payload)), sc, payload)
+}
+
+// Appends payload wrapped in an envelope carrying sc to dst, see Wrap.
+//
+// Returns the extended dst
+func AppendEnvelope(dst []byte, sc SpanContext, payload []byte) []byte {
+	if sc.IsValid() {
+		dst = append(dst, sc.Traceparent()...)
+		dst = append(dst, '\n')
+	}
+	return append(dst, payload...)
+}
+
+// Splits a message created by Wrap.
+//
+// Returns the span context, the payload and false if message has no envelope,
+// then the payload is the whole message
+func Unwrap(message []byte) (SpanContext, []byte, bool) {
+	if len(message) < EnvelopeSize || message[EnvelopeSize-1] != '\n' {
+		return SpanContext{}, message, false
+	}
+	sc, err := ParseTraceparent(string(message[:EnvelopeSize-1]))
+	if err != nil {
+		return SpanContext{}, message, false
+	}
+	return sc, message[EnvelopeSize:], true
+}
@@ -0,0 +1,265 @@
+package trace
+
+// Import containing a small tracer with W3C Trace Context propagation.
+//
+// Spans are handed to an Exporter when they end, which can forward them to
+// OpenTelemetry or any other tracing system.
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMalformed  = errors.New("trace: malformed traceparent")
+	ErrInvalidID  = errors.New("trace: trace or span id is zero")
+	ErrBadVersion = errors.New("trace: unsupported traceparent version")
+)
+
+// Identifier of a trace, shared by all of its spans
+type TraceID [16]byte
+
+// Identifier of a span
+type SpanID [8]byte
+
+// Identity of a span, as carried by a traceparent header.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Trace flags, bit 0 means sampled
+	Flags byte
+	// True if it was received from another process
+	Remote bool
+}
+
+// Parses a W3C traceparent header ("00-<trace id>-<span id>-<flags>").
+//
+// Returns the span context and a error (can be nil)
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+	// Later versions may append fields, version 00 is exactly 55 characters
+	if len(value) < 55 || value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return sc, ErrMalformed
+	}
+	if value[:2] == "ff" {
+		return sc, ErrBadVersion
+	}
+	if value[:2] == "00" && len(value) != 55 {
+		return sc, ErrMalformed
+	}
+	if len(value) > 55 && value[55] != '-' {
+		return sc, ErrMalformed
+	}
+
+	var version, flags [1]byte
+	for _, field := range []struct {
+		dst []byte
+		src string
+	}{
+		{version[:], value[:2]},
+		{sc.TraceID[:], value[3:35]},
+		{sc.SpanID[:], value[36:52]},
+		{flags[:], value[53:55]},
+	} {
+		// Only lowercase hex is valid
+		for i := 0; i < len(field.src); i++ {
+			if c := field.src[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+				return SpanContext{}, ErrMalformed
+			}
+		}
+		if _, err := hex.Decode(field.dst, []byte(field.src)); err != nil {
+			return SpanContext{}, ErrMalformed
+		}
+	}
+	sc.Flags = flags[0]
+	sc.Remote = true
+	if !sc.IsValid() {
+		return SpanContext{}, ErrInvalidID
+	}
+	return sc, nil
+}
+
+// Returns the span context as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// Returns true if neither id is zero.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Returns true if the trace is recorded.
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&1 == 1
+}
+
+type contextKey struct{}
+
+// Returns a copy of ctx carrying sc, spans started from it become its children.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// Returns the span context carried by ctx, it is not valid if there is none.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(contextKey{}).(SpanContext)
+	return sc
+}
+
+// Unit of work of a trace, ended by Finish.
+//
+// Methods are safe for concurrent use and do nothing on a nil span.
+type Span struct {
+	Name        string
+	SpanContext SpanContext
+	// Span context of the parent, not valid for the root span
+	Parent SpanContext
+	Start  time.Time
+	// Zero until Finish is called
+	End        time.Time
+	Attributes []slog.Attr
+	// Error the span ended with (can be nil)
+	Err error
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+// Adds attributes to the span.
+func (span *Span) SetAttributes(attrs ...slog.Attr) {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	span.Attributes = append(span.Attributes, attrs...)
+	span.mu.Unlock()
+}
+
+// Marks the span as failed with err (can be nil).
+func (span *Span) SetError(err error) {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	span.Err = err
+	span.mu.Unlock()
+}
+
+// Ends the span and exports it if it is sampled, calling it again does nothing.
+func (span *Span) Finish() {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	if span.ended {
+		span.mu.Unlock()
+		return
+	}
+	span.ended = true
+	span.End = time.Now()
+	span.mu.Unlock()
+
+	if span.SpanContext.IsSampled() && span.tracer.Exporter != nil {
+		span.tracer.Exporter.ExportSpan(span)
+	}
+}
+
+// Receives spans once they end.
+//
+// ExportSpan is called from the goroutine ending the span, it must be safe for
+// concurrent use and should not block. The span must not be modified.
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+// Starts spans and hands them to its exporter.
+//
+// A nil *Tracer starts no spans, so it can be used to turn tracing off.
+type Tracer struct {
+	// Receives ended spans (nil drops them)
+	Exporter Exporter
+	// Fraction of new traces that are recorded, 0 records all of them.
+	// Spans with a parent follow the sampling decision of the parent.
+	SampleRate float64
+}
+
+// Starts a span, as a child of the span carried by ctx or as the root of a new trace.
+//
+// Returns ctx carrying the new span and the span (nil on a nil tracer)
+func (tracer *Tracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	parent := SpanContextFromContext(ctx)
+
+	span := &Span{Name: name, Parent: parent, Start: time.Now(), Attributes: attrs, tracer: tracer}
+	if parent.IsValid() {
+		span.SpanContext.TraceID = parent.TraceID
+		span.SpanContext.Flags = parent.Flags
+	} else {
+		putRandom(span.SpanContext.TraceID[:])
+		if tracer.SampleRate <= 0 || rand.Float64() < tracer.SampleRate {
+			span.SpanContext.Flags = 1
+		}
+	}
+	putRandom(span.SpanContext.SpanID[:])
+	return ContextWithSpanContext(ctx, span.SpanContext), span
+}
+
+// Fills b with random bytes, never all zero.
+func putRandom(b []byte) {
+	for {
+		var zero = true
+		for i := range b {
+			b[i] = byte(rand.Uint32())
+			zero = zero && b[i] == 0
+		}
+		if !zero {
+			return
+		}
+	}
+}
+
+// Exporter keeping spans in memory, for tests and debugging.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (exporter *MemoryExporter) ExportSpan(span *Span) {
+	exporter.mu.Lock()
+	exporter.spans = append(exporter.spans, span)
+	exporter.mu.Unlock()
+}
+
+// Returns the exported spans in the order they ended.
+func (exporter *MemoryExporter) Spans() []*Span {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	return append([]*Span(nil), exporter.spans...)
+}
+
+// Returns the exported spans with the given name.
+func (exporter *MemoryExporter) SpansNamed(name string) []*Span {
+	var spans []*Span
+	for _, span := range exporter.Spans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// Drops the exported spans.
+func (exporter *MemoryExporter) Reset() {
+	exporter.mu.Lock()
+	exporter.spans = nil
+	exporter.mu.Unlock()
+}
@@ -0,0 +1,150 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+const example = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		err   error
+	}{
+		{"valid", example, nil},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", nil},
+		{"future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", nil},
+		{"version 00 with extra field", example + "-extra", ErrMalformed},
+		{"future version without separator", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01x", ErrMalformed},
+		{"version ff", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ErrBadVersion},
+		{"uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", ErrMalformed},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", ErrMalformed},
+		{"short", example[:54], ErrMalformed},
+		{"wrong separator", "00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ErrMalformed},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", ErrInvalidID},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", ErrInvalidID},
+		{"empty", "", ErrMalformed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc, err := ParseTraceparent(test.value)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+			if err != nil {
+				if sc != (SpanContext{}) {
+					t.Errorf("got %+v with an error", sc)
+				}
+				return
+			}
+			if !sc.IsValid() || !sc.Remote {
+				t.Errorf("got %+v, want a valid remote span context", sc)
+			}
+			if got := sc.Traceparent(); got != "00"+test.value[2:55] {
+				t.Errorf("Traceparent() = %q", got)
+			}
+		})
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	sc, err := ParseTraceparent(example)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range [][]byte{nil, []byte("hello"), []byte("line\nbreaks\n"), []byte(example + "\n")} {
+		message := Wrap(sc, payload)
+		if len(message) != EnvelopeSize+len(payload) || string(message[:EnvelopeSize]) != example+"\n" {
+			t.Fatalf("Wrap(%q) = %q", payload, message)
+		}
+		got, unwrapped, ok := Unwrap(message)
+		if !ok || got != sc || !bytes.Equal(unwrapped, payload) {
+			t.Errorf("Unwrap(%q) = %+v, %q, %v", message, got, unwrapped, ok)
+		}
+	}
+
+	// AppendEnvelope extends dst in place
+	dst := append(make([]byte, 0, 128), "prefix"...)
+	if got := AppendEnvelope(dst, sc, []byte("hello")); string(got) != "prefix"+example+"\nhello" || &got[0] != &dst[0] {
+		t.Errorf("AppendEnvelope = %q", got)
+	}
+
+	// Messages without an envelope are returned whole
+	for _, message := range [][]byte{nil, []byte("hello"), []byte(example + "x"), bytes.Repeat([]byte("a"), 100)} {
+		if got, payload, ok := Unwrap(message); ok || got.IsValid() || !bytes.Equal(payload, message) {
+			t.Errorf("Unwrap(%q) = %+v, %q, %v", message, got, payload, ok)
+		}
+	}
+	if message := Wrap(SpanContext{}, []byte("hello")); string(message) != "hello" {
+		t.Errorf("Wrap without a span context = %q", message)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	var nilTracer *Tracer
+	ctx, span := nilTracer.Start(context.Background(), "nothing")
+	if span != nil || SpanContextFromContext(ctx).IsValid() {
+		t.Fatal("a nil tracer started a span")
+	}
+	// Methods of a nil span do nothing
+	span.SetError(errors.New("ignored"))
+	span.Finish()
+
+	exporter := &MemoryExporter{}
+	tracer := &Tracer{Exporter: exporter}
+	ctx, root := tracer.Start(context.Background(), "root")
+	_, child := tracer.Start(ctx, "child")
+	child.SetError(errors.New("failed"))
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	if spans := exporter.Spans(); len(spans) != 2 || spans[0] != child || spans[1] != root {
+		t.Fatalf("exported %v, want the child then the root", spans)
+	}
+	if root.Parent.IsValid() || !root.SpanContext.IsSampled() {
+		t.Errorf("root has parent %+v and flags %x", root.Parent, root.SpanContext.Flags)
+	}
+	if child.Parent != root.SpanContext || child.SpanContext.TraceID != root.SpanContext.TraceID {
+		t.Errorf("child %+v is not a child of %+v", child.SpanContext, root.SpanContext)
+	}
+	if child.Err == nil || child.End.Before(child.Start) {
+		t.Errorf("child ended with %v at %v", child.Err, child.End)
+	}
+	if spans := exporter.SpansNamed("child"); len(spans) != 1 || spans[0] != child {
+		t.Errorf("SpansNamed(child) = %v", spans)
+	}
+	exporter.Reset()
+	if spans := exporter.Spans(); len(spans) != 0 {
+		t.Errorf("%d spans after Reset", len(spans))
+	}
+
+	// Remote parents keep their sampling decision
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, span = tracer.Start(ContextWithSpanContext(context.Background(), remote), "unsampled")
+	span.Finish()
+	if span.SpanContext.TraceID != remote.TraceID || span.Parent != remote || span.SpanContext.IsSampled() {
+		t.Errorf("span %+v does not continue %+v", span.SpanContext, remote)
+	}
+	if spans := exporter.Spans(); len(spans) != 0 {
+		t.Errorf("exported %d unsampled spans", len(spans))
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	exporter := &MemoryExporter{}
+	tracer := &Tracer{Exporter: exporter, SampleRate: 0.25}
+	const n = 4000
+	for i := 0; i < n; i++ {
+		_, span := tracer.Start(context.Background(), "sampled")
+		span.Finish()
+	}
+	// Expected 1000, the standard deviation is about 27
+	if got := len(exporter.Spans()); got < 800 || got > 1200 {
+		t.Errorf("exported %d of %d spans at rate 0.25", got, n)
+	}
+}
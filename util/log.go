@@ -0,0 +1,31 @@
+package util
+
+// Default logger of the library.
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Handler that drops every record.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (handler discardHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return handler
+}
+func (handler discardHandler) WithGroup(string) slog.Handler {
+	return handler
+}
+
+// Logger that drops everything, used wherever no logger was set.
+var DiscardLogger = slog.New(discardHandler{})
+
+// Returns logger, or DiscardLogger if it is nil.
+func LoggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return DiscardLogger
+	}
+	return logger
+}
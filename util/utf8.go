@@ -0,0 +1,98 @@
+package util
+
+// Incremental UTF-8 validation for text messages split across frames.
+
+// Streaming UTF-8 validator.
+//
+// Sequences may be split at any byte, so fragments can be fed as they arrive.
+// The zero value is ready to use.
+type UTF8Validator struct {
+	// Continuation bytes still expected
+	need int
+	// Allowed range of the next continuation byte
+	lower, upper byte
+	invalid      bool
+	// True while the current message is a text message
+	inText bool
+}
+
+// Feeds bytes to the validator.
+//
+// Returns false as soon as the input can no longer be valid UTF-8.
+func (v *UTF8Validator) Write(p []byte) bool {
+	if v.invalid {
+		return false
+	}
+	for _, b := range p {
+		if v.need > 0 {
+			if b < v.lower || b > v.upper {
+				v.invalid = true
+				return false
+			}
+			v.lower, v.upper = 0x80, 0xBF
+			v.need--
+			continue
+		}
+
+		// Lead byte, the ranges exclude overlong forms, surrogates and values above U+10FFFF
+		switch {
+		case b < 0x80:
+		case b >= 0xC2 && b <= 0xDF:
+			v.need, v.lower, v.upper = 1, 0x80, 0xBF
+		case b == 0xE0:
+			v.need, v.lower, v.upper = 2, 0xA0, 0xBF
+		case b == 0xED:
+			v.need, v.lower, v.upper = 2, 0x80, 0x9F
+		case b >= 0xE1 && b <= 0xEF:
+			v.need, v.lower, v.upper = 2, 0x80, 0xBF
+		case b == 0xF0:
+			v.need, v.lower, v.upper = 3, 0x90, 0xBF
+		case b >= 0xF1 && b <= 0xF3:
+			v.need, v.lower, v.upper = 3, 0x80, 0xBF
+		case b == 0xF4:
+			v.need, v.lower, v.upper = 3, 0x80, 0x8F
+		default:
+			v.invalid = true
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if everything written so far is valid and no sequence is left unfinished.
+func (v *UTF8Validator) Complete() bool {
+	return !v.invalid && v.need == 0
+}
+
+// Clears the state for a new message.
+func (v *UTF8Validator) Reset() {
+	*v = UTF8Validator{}
+}
+
+// Validates the payload of a data frame, following text messages across continuation frames.
+//
+// Returns a error (can be nil), invalid UTF-8 is a ProtocolError closing with 1007.
+func (v *UTF8Validator) ValidateFrame(header FrameHeader, payload []byte) error {
+	switch header.Opcode {
+	case 1:
+		v.Reset()
+		v.inText = true
+	case 2:
+		v.inText = false
+	case 0:
+	default:
+		return nil
+	}
+	if !v.inText {
+		return nil
+	}
+
+	if !v.Write(payload) || (header.Fin && !v.Complete()) {
+		v.inText = false
+		return &ProtocolError{Code: 1007, Reason: "invalid UTF-8 in text message"}
+	}
+	if header.Fin {
+		v.inText = false
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package util
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+// Feeds input in two writes split at every position.
+//
+// Returns the input positions whose split gave a different result than want
+func splitResults(input string, want bool) []int {
+	var wrong []int
+	for split := 0; split <= len(input); split++ {
+		var validator UTF8Validator
+		got := validator.Write([]byte(input[:split])) && validator.Write([]byte(input[split:])) && validator.Complete()
+		if got != want {
+			wrong = append(wrong, split)
+		}
+	}
+	return wrong
+}
+
+func TestUTF8Validator(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		valid bool
+	}{
+		{"empty", "", true},
+		{"ascii", "hello", true},
+		{"two bytes", "héllo", true},
+		{"three bytes", "€ and 中文", true},
+		{"four bytes", "𝄞 and 😀", true},
+		{"edges", "\u0080\u07FF\u0800\uD7FF\uE000\uFFFD\uFFFF\U00010000\U0010FFFF", true},
+		{"overlong slash", "\xC0\xAF", false},
+		{"overlong two bytes", "\xC1\xBF", false},
+		{"overlong three bytes", "\xE0\x80\xAF", false},
+		{"overlong four bytes", "\xF0\x80\x80\xAF", false},
+		{"first surrogate", "\xED\xA0\x80", false},
+		{"last surrogate", "\xED\xBF\xBF", false},
+		{"surrogate pair", "\xED\xA0\xBD\xED\xB8\x80", false},
+		{"above U+10FFFF", "\xF4\x90\x80\x80", false},
+		{"F5 lead byte", "\xF5\x80\x80\x80", false},
+		{"FF byte", "a\xFF", false},
+		{"lone continuation", "a\x80b", false},
+		{"missing continuation", "\xE2\x82a", false},
+		{"truncated two bytes", "a\xC3", false},
+		{"truncated three bytes", "a\xE2\x82", false},
+		{"truncated four bytes", "a\xF0\x9D\x84", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if utf8.ValidString(test.input) != test.valid {
+				t.Fatalf("the test is wrong, utf8.ValidString(%q) = %v", test.input, !test.valid)
+			}
+			if wrong := splitResults(test.input, test.valid); len(wrong) > 0 {
+				t.Errorf("%q split at %v: got %v", test.input, wrong, !test.valid)
+			}
+
+			// One byte per write
+			var validator UTF8Validator
+			valid := true
+			for i := 0; i < len(test.input) && valid; i++ {
+				valid = validator.Write([]byte{test.input[i]})
+			}
+			if valid && validator.Complete() != test.valid {
+				t.Errorf("%q byte by byte: got %v", test.input, !test.valid)
+			}
+		})
+	}
+}
+
+// Stays invalid once it failed, until Reset.
+func TestUTF8ValidatorReset(t *testing.T) {
+	var validator UTF8Validator
+	if validator.Write([]byte("\xFF")) || validator.Write([]byte("a")) || validator.Complete() {
+		t.Fatal("valid after invalid input")
+	}
+	validator.Reset()
+	if !validator.Write([]byte("a")) || !validator.Complete() {
+		t.Fatal("invalid after Reset")
+	}
+}
+
+func FuzzUTF8Validator(f *testing.F) {
+	f.Add([]byte("héllo"), 2)
+	f.Add([]byte("\xED\xA0\x80"), 1)
+	f.Add([]byte("\xF4\x90\x80\x80"), 3)
+	f.Fuzz(func(t *testing.T, data []byte, split int) {
+		if len(data) > 0 {
+			split = int(uint(split) % uint(len(data)+1))
+		} else {
+			split = 0
+		}
+		var validator UTF8Validator
+		got := validator.Write(data[:split]) && validator.Write(data[split:]) && validator.Complete()
+		if got != utf8.Valid(data) {
+			t.Fatalf("%q split at %d: got %v, utf8.Valid says %v", data, split, got, !got)
+		}
+	})
+}
+
+func TestValidateFrame(t *testing.T) {
+	type frame struct {
+		fin     bool
+		opcode  byte
+		payload string
+	}
+	tests := []struct {
+		name   string
+		frames []frame
+		// Index of the frame that must fail with 1007, -1 if all are valid
+		fails int
+	}{
+		{"text", []frame{{true, 1, "€"}}, -1},
+		{"invalid text", []frame{{true, 1, "a\xFF"}}, 0},
+		{"invalid binary", []frame{{true, 2, "\xFF"}}, -1},
+		{"code point across fragments", []frame{{false, 1, "a\xE2"}, {false, 0, "\x82"}, {true, 0, "\xACb"}}, -1},
+		{"invalid in a continuation", []frame{{false, 1, "a"}, {true, 0, "\xC0\xAF"}}, 1},
+		{"truncated at FIN", []frame{{false, 1, "a\xE2"}, {true, 0, "\x82"}}, 1},
+		{"truncated single frame", []frame{{true, 1, "\xF0\x9D"}}, 0},
+		{"control frame between fragments", []frame{{false, 1, "\xE2"}, {true, 9, "\xFF"}, {true, 0, "\x82\xAC"}}, -1},
+		{"binary fragments", []frame{{false, 2, "\xE2"}, {true, 0, "\xFF"}}, -1},
+		{"text after a binary message", []frame{{false, 2, "\xE2"}, {true, 0, "x"}, {true, 1, "\x82"}}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var validator UTF8Validator
+			for i, frame := range test.frames {
+				header := FrameHeader{Fin: frame.fin, Opcode: frame.opcode, Length: uint64(len(frame.payload))}
+				err := validator.ValidateFrame(header, []byte(frame.payload))
+				if i == test.fails {
+					if closeCode(t, err) != 1007 {
+						t.Fatalf("frame %d: %v, want 1007", i, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
@@ -3,7 +3,10 @@ package util
 // Import containing utility variables and methods.
 
 import (
+	"encoding/binary"
 	"errors"
+	"strconv"
+	"unicode/utf8"
 )
 
 // Contains WebSocket close codes.
@@ -17,6 +20,9 @@ var CloseCodes map[int]string = map[int]string{
 	1009: "MessageTooBig",
 	1010: "ExtensionError",
 	1011: "InternalError",
+	1012: "ServiceRestart",
+	1013: "TryAgainLater",
+	1014: "BadGateway",
 }
 
 // Contains HTTP error codes.
@@ -29,62 +35,248 @@ var HttpErrorCodes map[string]string = map[string]string{
 	"406": "Not Acceptable",
 	"407": "Proxy Authentication Required",
 	"408": "Request Timeout",
+	"409": "Conflict",
+	"410": "Gone",
+	"411": "Length Required",
+	"412": "Precondition Failed",
+	"413": "Content Too Large",
+	"414": "URI Too Long",
+	"415": "Unsupported Media Type",
+	"417": "Expectation Failed",
+	"421": "Misdirected Request",
+	"422": "Unprocessable Content",
+	"426": "Upgrade Required",
+	"428": "Precondition Required",
+	"429": "Too Many Requests",
+	"431": "Request Header Fields Too Large",
+	"451": "Unavailable For Legal Reasons",
+	"500": "Internal Server Error",
+	"501": "Not Implemented",
+	"502": "Bad Gateway",
+	"503": "Service Unavailable",
+	"504": "Gateway Timeout",
+	"505": "HTTP Version Not Supported",
 }
 
-// Validates the received frame.
+// Protocol violation found while validating a frame.
 //
-// Returns a error (can be nil).
-func Validate(frame []byte, mustMask bool) (string, byte, error) {
-	var err error
+// Code is the close code the connection should be closed with.
+type ProtocolError struct {
+	Code   uint16
+	Reason string
+}
 
-	if len(frame) == 0 {
-		err = errors.New("empty array of bytes")
-		return "empty", byte(0), err
-	}
-
-	var controlFrame bool = false
-	var frameType string
-
-	var fin byte = frame[0] & 128
-	var opcode byte = frame[0] & 15
-	var length byte = frame[1] & 127
-	var maskBit byte = frame[1] & 128
-
-	switch opcode {
-	case 0:
-		frameType = "continuation"
-	case 1:
-		frameType = "text"
-	case 2:
-		frameType = "binary"
-	case 8:
-		frameType = "close"
-		controlFrame = true
-	case 9:
-		frameType = "ping"
-		controlFrame = true
-	case 10:
-		frameType = "pong"
-		controlFrame = true
+func (err *ProtocolError) Error() string {
+	return err.Reason + " (" + strconv.Itoa(int(err.Code)) + " " + CloseCodes[int(err.Code)] + ")"
+}
+
+// Creates a ProtocolError closing with 1002 ProtocolError.
+func protocolError(reason string) *ProtocolError {
+	return &ProtocolError{Code: 1002, Reason: reason}
+}
+
+// Decoded frame header.
+type FrameHeader struct {
+	Fin bool
+	// RSV1-3 bits, in place (RSV1 is 0x40)
+	Rsv    byte
+	Opcode byte
+	Masked bool
+	Mask   [4]byte
+	// Payload length
+	Length uint64
+	// Length of the header in bytes (2 to 14)
+	HeaderLength int
+}
+
+// Returns true for close, ping and pong frames.
+func (header FrameHeader) IsControl() bool {
+	return header.Opcode >= 8
+}
+
+// Decodes the header at the start of frame without validating it.
+//
+// Returns a error (can be nil), a truncated header is a ProtocolError.
+func ParseFrameHeader(frame []byte) (FrameHeader, error) {
+	var header FrameHeader
+	if len(frame) < 2 {
+		return header, protocolError("truncated frame header")
+	}
+
+	header.Fin = frame[0]&128 != 0
+	header.Rsv = frame[0] & 112
+	header.Opcode = frame[0] & 15
+	header.Masked = frame[1]&128 != 0
+	header.HeaderLength = 2
+
+	switch length := frame[1] & 127; length {
+	case 126:
+		header.HeaderLength += 2
+	case 127:
+		header.HeaderLength += 8
+	default:
+		header.Length = uint64(length)
+	}
+	if header.Masked {
+		header.HeaderLength += 4
+	}
+	if len(frame) < header.HeaderLength {
+		return header, protocolError("truncated frame header")
+	}
+
+	switch frame[1] & 127 {
+	case 126:
+		header.Length = uint64(binary.BigEndian.Uint16(frame[2:4]))
+	case 127:
+		header.Length = binary.BigEndian.Uint64(frame[2:10])
+	}
+	if header.Masked {
+		copy(header.Mask[:], frame[header.HeaderLength-4:header.HeaderLength])
+	}
+	return header, nil
+}
+
+// Strict RFC 6455 validator.
+//
+// Keeps track of fragmented messages, so use one per connection and direction.
+// The zero value is ready to use.
+type Validator struct {
+	// RSV bits negotiated by extensions, others are rejected
+	AllowedRsv byte
+	// Largest payload accepted, larger frames fail with 1009 (0 means no limit)
+	MaxPayload uint64
+
+	fragmented bool
+}
+
+// Validates the header of a received frame.
+//
+// mustMask is true when validating frames received by a server (they must be masked)
+// and false for frames received by a client (they must not be masked).
+//
+// Returns the header and a error (can be nil), errors are *ProtocolError.
+func (v *Validator) Validate(frame []byte, mustMask bool) (FrameHeader, error) {
+	header, err := ParseFrameHeader(frame)
+	if err != nil {
+		return header, err
+	}
+
+	if header.Rsv&^v.AllowedRsv != 0 {
+		return header, protocolError("reserved bits set without a negotiated extension")
+	}
+
+	switch header.Opcode {
+	case 0, 1, 2, 8, 9, 10:
 	default:
-		return "unknown", fin, errors.New("used a reserved opcode")
+		return header, protocolError("used a reserved opcode")
+	}
+
+	if header.Masked != mustMask {
+		if mustMask {
+			return header, protocolError("unmasked frame")
+		}
+		return header, protocolError("masked frame received")
+	}
+
+	// Lengths must use the shortest encoding
+	switch frame[1] & 127 {
+	case 126:
+		if header.Length < 126 {
+			return header, protocolError("non-minimal length encoding")
+		}
+	case 127:
+		if header.Length>>63 != 0 {
+			return header, protocolError("most significant bit of 64-bit length set")
+		}
+		if header.Length <= 65535 {
+			return header, protocolError("non-minimal length encoding")
+		}
+	}
+
+	if header.IsControl() {
+		if !header.Fin {
+			return header, protocolError("fragmented control frame")
+		}
+		if header.Length > 125 {
+			return header, protocolError("length of control frame payload larger than 125 bytes")
+		}
+		return header, nil
+	}
+
+	if v.MaxPayload != 0 && header.Length > v.MaxPayload {
+		return header, &ProtocolError{Code: 1009, Reason: "frame payload larger than " + strconv.FormatUint(v.MaxPayload, 10) + " bytes"}
+	}
+
+	// Fragmentation rules
+	if header.Opcode == 0 && !v.fragmented {
+		return header, protocolError("continuation frame without a message to continue")
+	}
+	if header.Opcode != 0 && v.fragmented {
+		return header, protocolError("new message started before the fragmented message ended")
+	}
+	v.fragmented = !header.Fin
+	return header, nil
+}
+
+// Validates the payload of a close frame, checkUTF8 also validates the reason.
+//
+// Returns the status code (1005 NoStatusReceived for an empty payload), the reason and a error (can be nil).
+func ValidateClosePayload(payload []byte, checkUTF8 bool) (uint16, string, error) {
+	if len(payload) == 0 {
+		return 1005, "", nil
+	}
+	if len(payload) == 1 {
+		return 0, "", protocolError("close frame with a 1 byte payload")
+	}
+
+	code := binary.BigEndian.Uint16(payload[:2])
+	if !ValidCloseCode(code) {
+		return code, "", protocolError("invalid close code " + strconv.Itoa(int(code)))
+	}
+	if checkUTF8 && !utf8.Valid(payload[2:]) {
+		return code, "", &ProtocolError{Code: 1007, Reason: "invalid UTF-8 in close reason"}
 	}
+	return code, string(payload[2:]), nil
+}
 
-	// Checks if a control frame is fragmented
-	if fin == 0 && controlFrame {
-		return frameType, fin, errors.New("fragmented control frame")
-		// Checks if a control frame has a larger payload than 125 bytes
-	} else if controlFrame && length > 125 {
-		return frameType, fin, errors.New("length of control frame payload larger than 125 bytes")
-		// checks for a unmasked frame
-	} else if maskBit == 0 && !controlFrame && mustMask {
-		return frameType, fin, errors.New("unmasked frame")
-	} else {
-		return frameType, fin, nil
+// Returns true if code may be sent in a close frame.
+func ValidCloseCode(code uint16) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
 	}
+	return false
+}
 
+// Validates the received frame, stateless version of Validator.Validate.
+//
+// Frames are checked as strictly as by a Validator, except that continuation
+// frames are accepted as there is no message to check them against.
+//
+// Returns the frame type ("continuation", "text", "binary", "close", "ping" or "pong"),
+// the FIN bit in place (128 or 0) and a error (can be nil).
+//
+// Deprecated: use a Validator per connection, which also checks the order of fragments.
+func Validate(frame []byte, mustMask bool) (string, byte, error) {
+	if len(frame) == 0 {
+		return "empty", byte(0), errors.New("empty array of bytes")
+	}
+	validator := Validator{fragmented: frame[0]&15 == 0}
+	_, err := validator.Validate(frame, mustMask)
+	frameType, ok := frameTypes[frame[0]&15]
+	if !ok {
+		frameType = "unknown"
+	}
+	return frameType, frame[0] & 128, err
 }
 
+// Names of the opcodes, as returned by Validate
+var frameTypes = map[byte]string{0: "continuation", 1: "text", 2: "binary", 8: "close", 9: "ping", 10: "pong"}
+
 // Error handler.
 func OnError(err error) {
 	if err != nil {
@@ -0,0 +1,285 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// Describes a frame header for the tests.
+type testFrame struct {
+	fin    bool
+	rsv    byte
+	opcode byte
+	masked bool
+	length uint64
+	// Length field used: 0 picks the shortest, otherwise 126 or 127
+	encoding byte
+}
+
+// Encodes the header of frame.
+func (frame testFrame) header() []byte {
+	var b0 byte = frame.rsv | frame.opcode
+	if frame.fin {
+		b0 |= 128
+	}
+	var mask byte
+	if frame.masked {
+		mask = 128
+	}
+
+	encoding := frame.encoding
+	if encoding == 0 {
+		switch {
+		case frame.length > 65535:
+			encoding = 127
+		case frame.length > 125:
+			encoding = 126
+		}
+	}
+
+	head := []byte{b0, mask}
+	switch encoding {
+	case 126:
+		head[1] |= 126
+		head = binary.BigEndian.AppendUint16(head, uint16(frame.length))
+	case 127:
+		head[1] |= 127
+		head = binary.BigEndian.AppendUint64(head, frame.length)
+	default:
+		head[1] |= byte(frame.length)
+	}
+	if frame.masked {
+		head = append(head, 1, 2, 3, 4)
+	}
+	return head
+}
+
+// Returns the close code of a *ProtocolError, 0 for nil.
+func closeCode(t *testing.T, err error) uint16 {
+	t.Helper()
+	if err == nil {
+		return 0
+	}
+	var protocolError *ProtocolError
+	if !errors.As(err, &protocolError) {
+		t.Fatalf("%v is not a *ProtocolError", err)
+	}
+	return protocolError.Code
+}
+
+func TestValidatorFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame testFrame
+		// Validating frames received by a server
+		server     bool
+		allowedRsv byte
+		maxPayload uint64
+		// Expected close code, 0 for valid frames
+		code uint16
+	}{
+		{name: "masked text to server", frame: testFrame{fin: true, opcode: 1, masked: true, length: 5}, server: true},
+		{name: "unmasked text to client", frame: testFrame{fin: true, opcode: 1, length: 5}},
+		{name: "empty binary", frame: testFrame{fin: true, opcode: 2, masked: true}, server: true},
+
+		// RSV bits
+		{name: "RSV1 without extension", frame: testFrame{fin: true, rsv: 0x40, opcode: 1, masked: true}, server: true, code: 1002},
+		{name: "RSV2 without extension", frame: testFrame{fin: true, rsv: 0x20, opcode: 1, masked: true}, server: true, code: 1002},
+		{name: "RSV3 without extension", frame: testFrame{fin: true, rsv: 0x10, opcode: 1, masked: true}, server: true, code: 1002},
+		{name: "RSV1 negotiated", frame: testFrame{fin: true, rsv: 0x40, opcode: 1, masked: true}, server: true, allowedRsv: 0x40},
+		{name: "RSV2 with only RSV1 negotiated", frame: testFrame{fin: true, rsv: 0x60, opcode: 1, masked: true}, server: true, allowedRsv: 0x40, code: 1002},
+
+		// Reserved opcodes
+		{name: "opcode 3", frame: testFrame{fin: true, opcode: 3, masked: true}, server: true, code: 1002},
+		{name: "opcode 7", frame: testFrame{fin: true, opcode: 7, masked: true}, server: true, code: 1002},
+		{name: "opcode 11", frame: testFrame{fin: true, opcode: 11, masked: true}, server: true, code: 1002},
+		{name: "opcode 15", frame: testFrame{fin: true, opcode: 15, masked: true}, server: true, code: 1002},
+
+		// Masking direction
+		{name: "unmasked frame to server", frame: testFrame{fin: true, opcode: 1, length: 5}, server: true, code: 1002},
+		{name: "masked frame to client", frame: testFrame{fin: true, opcode: 1, masked: true, length: 5}, code: 1002},
+		{name: "unmasked ping to server", frame: testFrame{fin: true, opcode: 9}, server: true, code: 1002},
+
+		// Length encodings
+		{name: "16-bit length of 126", frame: testFrame{fin: true, opcode: 2, masked: true, length: 126}, server: true},
+		{name: "16-bit length of 125", frame: testFrame{fin: true, opcode: 2, masked: true, length: 125, encoding: 126}, server: true, code: 1002},
+		{name: "16-bit length of 0", frame: testFrame{fin: true, opcode: 2, masked: true, length: 0, encoding: 126}, server: true, code: 1002},
+		{name: "64-bit length of 65536", frame: testFrame{fin: true, opcode: 2, masked: true, length: 65536}, server: true},
+		{name: "64-bit length of 65535", frame: testFrame{fin: true, opcode: 2, masked: true, length: 65535, encoding: 127}, server: true, code: 1002},
+		{name: "64-bit length of 125", frame: testFrame{fin: true, opcode: 2, masked: true, length: 125, encoding: 127}, server: true, code: 1002},
+		{name: "64-bit length with the top bit set", frame: testFrame{fin: true, opcode: 2, masked: true, length: 1 << 63}, server: true, code: 1002},
+
+		// Control frames
+		{name: "ping with 125 bytes", frame: testFrame{fin: true, opcode: 9, masked: true, length: 125}, server: true},
+		{name: "ping with 126 bytes", frame: testFrame{fin: true, opcode: 9, masked: true, length: 126}, server: true, code: 1002},
+		{name: "fragmented ping", frame: testFrame{opcode: 9, masked: true}, server: true, code: 1002},
+		{name: "fragmented close", frame: testFrame{opcode: 8, masked: true, length: 2}, server: true, code: 1002},
+		{name: "pong to client", frame: testFrame{fin: true, opcode: 10, length: 4}},
+
+		// Payload limit
+		{name: "payload at the limit", frame: testFrame{fin: true, opcode: 2, masked: true, length: 1000}, server: true, maxPayload: 1000},
+		{name: "payload over the limit", frame: testFrame{fin: true, opcode: 2, masked: true, length: 1001}, server: true, maxPayload: 1000, code: 1009},
+		{name: "control frames ignore the limit", frame: testFrame{fin: true, opcode: 9, masked: true, length: 100}, server: true, maxPayload: 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validator := &Validator{AllowedRsv: test.allowedRsv, MaxPayload: test.maxPayload}
+			header, err := validator.Validate(test.frame.header(), test.server)
+			if code := closeCode(t, err); code != test.code {
+				t.Fatalf("close code %d, want %d (%v)", code, test.code, err)
+			}
+			if err == nil && header.Length != test.frame.length {
+				t.Fatalf("length %d, want %d", header.Length, test.frame.length)
+			}
+		})
+	}
+}
+
+func TestValidatorTruncated(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{0x81}},
+		{"16-bit length cut off", []byte{0x82, 0xFE, 0x01}},
+		{"64-bit length cut off", []byte{0x82, 0xFF, 0, 0, 0, 0}},
+		{"mask cut off", []byte{0x81, 0x85, 1, 2}},
+	}
+	for _, test := range tests {
+		var validator Validator
+		if _, err := validator.Validate(test.frame, true); closeCode(t, err) != 1002 {
+			t.Errorf("%s: %v, want 1002", test.name, err)
+		}
+	}
+}
+
+func TestValidatorFragmentation(t *testing.T) {
+	var (
+		textStart    = testFrame{opcode: 1, masked: true}
+		binaryStart  = testFrame{opcode: 2, masked: true}
+		continuation = testFrame{opcode: 0, masked: true}
+		final        = testFrame{fin: true, opcode: 0, masked: true}
+		text         = testFrame{fin: true, opcode: 1, masked: true}
+		ping         = testFrame{fin: true, opcode: 9, masked: true}
+	)
+
+	tests := []struct {
+		name   string
+		frames []testFrame
+		// Index of the frame that must fail, -1 if all are valid
+		fails int
+	}{
+		{"whole messages", []testFrame{text, text}, -1},
+		{"three fragments", []testFrame{textStart, continuation, final}, -1},
+		{"binary fragments", []testFrame{binaryStart, final, text}, -1},
+		{"ping between fragments", []testFrame{textStart, ping, continuation, ping, final}, -1},
+		{"continuation without a message", []testFrame{continuation}, 0},
+		{"final fragment without a message", []testFrame{final}, 0},
+		{"continuation after a whole message", []testFrame{text, final}, 1},
+		{"continuation after the final fragment", []testFrame{textStart, final, final}, 2},
+		{"text inside a fragmented message", []testFrame{textStart, text}, 1},
+		{"new fragmented message inside another", []testFrame{textStart, continuation, binaryStart}, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var validator Validator
+			for i, frame := range test.frames {
+				_, err := validator.Validate(frame.header(), true)
+				if i == test.fails {
+					if closeCode(t, err) != 1002 {
+						t.Fatalf("frame %d: %v, want 1002", i, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+// The deprecated Validate checks single frames as strictly as a Validator.
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		frame     []byte
+		frameType string
+		fin       byte
+		// 0 if the frame is valid
+		code uint16
+	}{
+		{"text", testFrame{fin: true, opcode: 1, masked: true, length: 5}.header(), "text", 128, 0},
+		{"continuation", testFrame{opcode: 0, masked: true}.header(), "continuation", 0, 0},
+		{"ping", testFrame{fin: true, opcode: 9, masked: true}.header(), "ping", 128, 0},
+		{"unmasked", testFrame{fin: true, opcode: 2}.header(), "binary", 128, 1002},
+		{"rsv bit", testFrame{fin: true, rsv: 64, opcode: 1, masked: true}.header(), "text", 128, 1002},
+		{"reserved opcode", testFrame{fin: true, opcode: 3, masked: true}.header(), "unknown", 128, 1002},
+		{"fragmented ping", testFrame{opcode: 9, masked: true}.header(), "ping", 0, 1002},
+		{"non-minimal length", testFrame{fin: true, opcode: 2, masked: true, length: 5, encoding: 126}.header(), "binary", 128, 1002},
+		{"truncated", []byte{0x81}, "text", 128, 1002},
+	}
+	for _, test := range tests {
+		frameType, fin, err := Validate(test.frame, true)
+		if frameType != test.frameType || fin != test.fin {
+			t.Errorf("%s: got %s and FIN %d, want %s and %d", test.name, frameType, fin, test.frameType, test.fin)
+		}
+		if test.code == 0 && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if test.code != 0 && closeCode(t, err) != test.code {
+			t.Errorf("%s: %v, want %d", test.name, err, test.code)
+		}
+	}
+	if _, _, err := Validate(nil, true); err == nil {
+		t.Error("empty frame accepted")
+	}
+}
+
+func TestValidateClosePayload(t *testing.T) {
+	payload := func(code uint16, reason string) []byte {
+		return append(binary.BigEndian.AppendUint16(nil, code), reason...)
+	}
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		checkUTF8 bool
+		wantCode  uint16
+		// Expected close code of the error, 0 for valid payloads
+		errCode uint16
+	}{
+		{name: "empty", payload: nil, wantCode: 1005},
+		{name: "one byte", payload: []byte{0x03}, errCode: 1002},
+		{name: "normal closure", payload: payload(1000, ""), wantCode: 1000},
+		{name: "with reason", payload: payload(1001, "going away"), checkUTF8: true, wantCode: 1001},
+		{name: "1003", payload: payload(1003, ""), wantCode: 1003},
+		{name: "1004 reserved", payload: payload(1004, ""), errCode: 1002},
+		{name: "1005 not sendable", payload: payload(1005, ""), errCode: 1002},
+		{name: "1006 not sendable", payload: payload(1006, ""), errCode: 1002},
+		{name: "1014", payload: payload(1014, ""), wantCode: 1014},
+		{name: "1015 not sendable", payload: payload(1015, ""), errCode: 1002},
+		{name: "999", payload: payload(999, ""), errCode: 1002},
+		{name: "2999", payload: payload(2999, ""), errCode: 1002},
+		{name: "3000", payload: payload(3000, ""), wantCode: 3000},
+		{name: "4999", payload: payload(4999, ""), wantCode: 4999},
+		{name: "5000", payload: payload(5000, ""), errCode: 1002},
+		{name: "invalid UTF-8 reason", payload: payload(1000, "\xff\xfe"), checkUTF8: true, errCode: 1007},
+		{name: "invalid UTF-8 unchecked", payload: payload(1000, "\xff\xfe"), wantCode: 1000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, _, err := ValidateClosePayload(test.payload, test.checkUTF8)
+			if errCode := closeCode(t, err); errCode != test.errCode {
+				t.Fatalf("error close code %d, want %d (%v)", errCode, test.errCode, err)
+			}
+			if err == nil && code != test.wantCode {
+				t.Fatalf("code %d, want %d", code, test.wantCode)
+			}
+		})
+	}
+}
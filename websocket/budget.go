@@ -0,0 +1,86 @@
+package websocket
+
+// Limits on how much received data connections may buffer.
+
+import (
+	"mithril/util"
+	"net"
+	"sync"
+)
+
+// Read limit given to new connections (32 MiB).
+const DefaultReadLimit int64 = 32 << 20
+
+// Memory shared by many connections for buffering received messages.
+//
+// Connections reserve payloads in chunks of up to 64 KiB as they read them and
+// give them back once the message is returned. When the budget is used up,
+// readers wait, which stops reading from the socket and lets TCP push back.
+// A connection already holding part of a message never waits, the bytes it
+// would wait for could be its own, so its read fails with 1009 instead.
+type MemoryBudget struct {
+	limit int64
+	used  int64
+	mu    sync.Mutex
+	cond  *sync.Cond
+}
+
+// Creates a budget of limit bytes.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	budget := &MemoryBudget{limit: limit}
+	budget.cond = sync.NewCond(&budget.mu)
+	return budget
+}
+
+// Reserves n bytes for ws, waiting until enough is free.
+//
+// A single request larger than the whole budget waits until nothing else is reserved.
+// Fails instead of waiting when ws holds reserved bytes itself, and when ws gets closed.
+//
+// Returns a error (can be nil)
+func (budget *MemoryBudget) acquire(ws *Conn, n int64) error {
+	if budget == nil || n == 0 {
+		return nil
+	}
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	for budget.used > 0 && budget.used+n > budget.limit {
+		if ws.reserved > 0 {
+			return &util.ProtocolError{Code: 1009, Reason: "message larger than the memory budget allows"}
+		}
+		if ws.IsClosed() {
+			return net.ErrClosed
+		}
+		budget.cond.Wait()
+	}
+	budget.used += n
+	return nil
+}
+
+// Gives n bytes back.
+func (budget *MemoryBudget) release(n int64) {
+	if budget == nil || n == 0 {
+		return
+	}
+	budget.mu.Lock()
+	budget.used -= n
+	budget.cond.Broadcast()
+	budget.mu.Unlock()
+}
+
+// Wakes waiting readers so closed connections stop waiting.
+func (budget *MemoryBudget) wake() {
+	if budget == nil {
+		return
+	}
+	budget.mu.Lock()
+	budget.cond.Broadcast()
+	budget.mu.Unlock()
+}
+
+// Returns the amount of bytes currently reserved.
+func (budget *MemoryBudget) Used() int64 {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	return budget.used
+}
@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"mithril/util"
+	"net"
+	"testing"
+	"time"
+)
+
+// Encodes a masked client frame of up to 65535 bytes with a zero masking key.
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	if fin {
+		opcode |= 128
+	}
+	frame := []byte{opcode, 128 | byte(len(payload))}
+	if len(payload) > 125 {
+		frame = binary.BigEndian.AppendUint16([]byte{opcode, 128 | 126}, uint16(len(payload)))
+	}
+	frame = append(frame, 0, 0, 0, 0)
+	return append(frame, payload...)
+}
+
+// Returns a server connection and the client end of a pipe, whose output is discarded.
+func pipeConn(t *testing.T) (*Conn, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go io.Copy(io.Discard, client)
+	return NewConn(server, nil, ServerRole), client
+}
+
+// Reads a message in the background, returning its error.
+func readError(ws *Conn) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := ws.ReadMessage()
+		errs <- err
+	}()
+	return errs
+}
+
+// Waits for the error of readError or fails the test after a few seconds.
+func waitError(t *testing.T, errs <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(3 * time.Second):
+		t.Fatal("read is still waiting")
+		return nil
+	}
+}
+
+func TestBudgetOwnFragments(t *testing.T) {
+	ws, client := pipeConn(t)
+	ws.Budget = NewMemoryBudget(64 << 10)
+
+	errs := readError(ws)
+	go func() {
+		client.Write(clientFrame(false, 2, make([]byte, 40<<10)))
+		client.Write(clientFrame(true, 0, make([]byte, 40<<10)))
+	}()
+	var protocolError *util.ProtocolError
+	if err := waitError(t, errs); !errors.As(err, &protocolError) || protocolError.Code != 1009 {
+		t.Fatalf("got %v, want a 1009 error", err)
+	}
+	if code, _ := ws.CloseStatus(); code != 1009 {
+		t.Errorf("closed with %d, want 1009", code)
+	}
+	if used := ws.Budget.Used(); used != 0 {
+		t.Errorf("%d bytes still reserved", used)
+	}
+}
+
+func TestBudgetWakesOnClose(t *testing.T) {
+	ws, client := pipeConn(t)
+	ws.Budget = NewMemoryBudget(64 << 10)
+	// Another connection holds most of the budget
+	other := &Conn{}
+	ws.Budget.acquire(other, 60<<10)
+
+	errs := readError(ws)
+	go client.Write(clientFrame(true, 2, make([]byte, 10<<10)))
+	time.Sleep(50 * time.Millisecond)
+	ws.Close(1001, "")
+	if err := waitError(t, errs); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v, want net.ErrClosed", err)
+	}
+	if used := ws.Budget.Used(); used != 60<<10 {
+		t.Errorf("%d bytes reserved, want %d", used, 60<<10)
+	}
+}
+
+func TestHugeHeaderReservesChunks(t *testing.T) {
+	ws, client := pipeConn(t)
+	ws.SetReadLimit(0)
+	ws.Budget = NewMemoryBudget(1 << 50)
+
+	errs := readError(ws)
+	// Claims 1 TiB and sends 10 bytes of it
+	header := binary.BigEndian.AppendUint64([]byte{0x82, 128 | 127}, 1<<40)
+	client.Write(append(append(header, 0, 0, 0, 0), make([]byte, 10)...))
+	time.Sleep(50 * time.Millisecond)
+	if used := ws.Budget.Used(); used > readChunk {
+		t.Errorf("%d bytes reserved for 10 bytes received", used)
+	}
+
+	client.Close()
+	if err := waitError(t, errs); err == nil {
+		t.Fatal("read of a truncated frame succeeded")
+	}
+	if used := ws.Budget.Used(); used != 0 {
+		t.Errorf("%d bytes still reserved", used)
+	}
+}
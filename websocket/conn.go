@@ -0,0 +1,858 @@
+package websocket
+
+// Framing shared by server and client connections.
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	mtls "mithril/tls"
+	"mithril/trace"
+	"mithril/util"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Unmasked payloads at least this large are sent with writev instead of being
+// copied into the write buffer (4 KiB, the default bufio size)
+const vectoredWriteMin = 4096
+
+// Payloads are read and reserved in steps of this size (64 KiB)
+const readChunk = 64 << 10
+
+// Returned by a MessageLimiter to skip a message.
+var ErrDropMessage = errors.New("message dropped by the rate limit")
+
+// Rate limit for received messages, applied by ReadMessage and ReadMessageInto.
+//
+// Allow is called with the size of every complete text or binary message. It can
+// block to slow the reader down, return ErrDropMessage to skip the message, or
+// return any other error (a *util.ProtocolError closes with its code) to fail the read.
+type MessageLimiter interface {
+	Allow(ws *Conn, size int) error
+}
+
+// Side of the connection, it decides the masking rules.
+type Role byte
+
+const (
+	// Receives masked frames and sends unmasked ones
+	ServerRole Role = iota
+	// Sends masked frames and receives unmasked ones
+	ClientRole
+)
+
+// WebSocket connection after the opening handshake.
+//
+// Concurrency: one goroutine may read (Read, ReadMessage, ReadMessageInto, ReadFrame) at a time,
+// while any number of goroutines may call the write methods, Ping and Close
+// concurrently with it and with each other. Every frame is written whole,
+// and control frames skip ahead of data frames waiting to be written.
+type Conn struct {
+	Conn     net.Conn
+	Buffer   *bufio.ReadWriter
+	Role     Role
+	PingSent bool
+	// Handshake headers (request headers on servers, response headers on clients)
+	Headers map[string]string
+	// TLS fingerprint of the client (nil without TLS or on clients)
+	Fingerprint *mtls.Fingerprint
+	// Skips UTF-8 validation of text messages and close reasons, for trusted peers
+	SkipUTF8Validation bool
+	// Path and query of the handshake request
+	Path  string
+	Query url.Values
+	// Memory shared with other connections for received data (can be nil)
+	Budget *MemoryBudget
+	// Buffers for fragmented messages and masking (nil uses a shared pool)
+	Pool BufferPool
+	// Rate limit for received text and binary messages (can be nil)
+	Limiter MessageLimiter
+	// Logger of the connection (nil logs nothing)
+	Logger *slog.Logger
+	// Counters of the traffic, usually shared with other connections (can be nil)
+	Metrics Metrics
+	// Traces received messages and writes (nil traces nothing)
+	Tracer *trace.Tracer
+	// Unwraps the trace context of received messages and wraps it around sent
+	// text and binary messages, see trace.Wrap. Both sides must enable it.
+	TraceEnvelope bool
+
+	// Largest reassembled message, 0 means no limit
+	readLimit int64
+	validator util.Validator
+	utf8      util.UTF8Validator
+	// Header of the frame being read or written, kept here so they do not escape
+	readHead  [14]byte
+	writeHead [14]byte
+	// Payload of the last control frame
+	control [125]byte
+	// Fragments of an unfinished message, its type and their budget
+	partial     *[]byte
+	messageType MessageType
+	reserved    int64
+	writeLock   writeLock
+	// Unix nanoseconds of the last frame received
+	lastActivity atomic.Int64
+	// Guards PingSent, pingAt, closed, the close status and the context
+	stateMu     sync.Mutex
+	pingAt      time.Time
+	closed      bool
+	closeCode   uint16
+	closeReason string
+	parent      context.Context
+	ctx         context.Context
+	cancel      context.CancelFunc
+	// Span and context of the message being handled, used by the reader only
+	messageSpan *trace.Span
+	messageCtx  context.Context
+	// Values set by Set, guarded by valuesMu
+	values   map[string]any
+	valuesMu sync.RWMutex
+}
+
+// Wraps an established connection, buffer can be nil.
+func NewConn(conn net.Conn, buffer *bufio.ReadWriter, role Role) *Conn {
+	if buffer == nil {
+		buffer = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	}
+	ws := &Conn{Conn: conn, Buffer: buffer, Role: role, readLimit: DefaultReadLimit}
+	ws.lastActivity.Store(time.Now().UnixNano())
+	return ws
+}
+
+// Returns when the last frame was received, or when the connection was created.
+func (ws *Conn) LastActivity() time.Time {
+	return time.Unix(0, ws.lastActivity.Load())
+}
+
+// Sets the largest message that may be received, larger ones close the connection with 1009.
+//
+// 0 removes the limit. Must not be called while reading.
+func (ws *Conn) SetReadLimit(limit int64) {
+	ws.readLimit = limit
+}
+
+// Sets the largest single frame that may be received, larger ones close the connection with 1009.
+//
+// 0 removes the limit. Must not be called while reading.
+func (ws *Conn) SetFrameLimit(limit int64) {
+	ws.validator.MaxPayload = uint64(limit)
+}
+
+// Fails with 1009 if a message would grow beyond the read limit.
+//
+// Returns a error (can be nil)
+func (ws *Conn) checkReadLimit(size uint64) error {
+	if ws.readLimit > 0 && size > uint64(ws.readLimit) {
+		return ws.fail(&util.ProtocolError{Code: 1009, Reason: "message larger than " + strconv.FormatInt(ws.readLimit, 10) + " bytes"})
+	}
+	return nil
+}
+
+// Reads a frame and returns it as a string.
+//
+// Returns a bytearray and error (error can be nil, protocol violations are *util.ProtocolError)
+func (ws *Conn) ReadFrame(frame []byte) ([]byte, error, bool) {
+	// Validating
+	header, err := ws.validator.Validate(frame, ws.Role == ServerRole)
+	if err != nil {
+		return []byte{}, ws.fail(err), false
+	}
+
+	// payload variable
+	var payload []byte = frame[header.HeaderLength:]
+	if uint64(len(payload)) > header.Length {
+		payload = payload[:header.Length]
+	}
+	payload = append([]byte(nil), payload...)
+	if header.Masked {
+		maskBytes(header.Mask, 0, payload)
+	}
+
+	err = ws.handleFrame(header, payload)
+	return payload, err, header.Opcode == 8
+}
+
+// Reads and validates the next frame header.
+//
+// received is the size of the message read so far, for the read limit.
+//
+// Returns the header and a error (can be nil)
+func (ws *Conn) nextHeader(received uint64) (util.FrameHeader, error) {
+	head := &ws.readHead
+	if _, err := io.ReadFull(ws.Buffer, head[:2]); err != nil {
+		return util.FrameHeader{}, err
+	}
+
+	// Rest of the header: extended length and mask
+	headerLength := 2
+	switch head[1] & 127 {
+	case 126:
+		headerLength += 2
+	case 127:
+		headerLength += 8
+	}
+	if head[1]&128 != 0 {
+		headerLength += 4
+	}
+	if _, err := io.ReadFull(ws.Buffer, head[2:headerLength]); err != nil {
+		return util.FrameHeader{}, err
+	}
+
+	header, err := ws.validator.Validate(head[:headerLength], ws.Role == ServerRole)
+	if err != nil {
+		return header, ws.fail(err)
+	}
+	ws.lastActivity.Store(time.Now().UnixNano())
+	return header, ws.checkReadLimit(received + header.Length)
+}
+
+// Reads the payload of a frame, unmasks it in place after dst and handles the frame.
+//
+// The payload is read in steps of readChunk, so memory follows the bytes that arrived
+// rather than the length the header claims. Data chunks are reserved in the memory
+// budget before being read and added to ws.reserved, the caller releases them with
+// releaseBudget even on errors.
+//
+// Returns dst extended by the payload and a error (can be nil)
+func (ws *Conn) readPayload(header util.FrameHeader, dst []byte) ([]byte, error) {
+	start := len(dst)
+	for remaining := header.Length; remaining > 0; {
+		n := min(remaining, readChunk)
+		// Control payloads land in ws.control and need no budget
+		if !header.IsControl() {
+			if err := ws.Budget.acquire(ws, int64(n)); err != nil {
+				return dst[:start], ws.fail(err)
+			}
+			ws.reserved += int64(n)
+		}
+		offset := len(dst)
+		dst = slices.Grow(dst, int(n))[:offset+int(n)]
+		if _, err := io.ReadFull(ws.Buffer, dst[offset:]); err != nil {
+			return dst[:start], err
+		}
+		remaining -= n
+	}
+
+	payload := dst[start:]
+	if header.Masked {
+		maskBytes(header.Mask, 0, payload)
+	}
+
+	if err := ws.handleFrame(header, payload); err != nil {
+		return dst[:start], err
+	}
+	return dst, nil
+}
+
+// Validates the payload and answers control frames.
+//
+// Returns a error (can be nil)
+func (ws *Conn) handleFrame(header util.FrameHeader, payload []byte) error {
+	switch header.Opcode {
+	case 0, 1, 2:
+		if !ws.SkipUTF8Validation {
+			if err := ws.utf8.ValidateFrame(header, payload); err != nil {
+				return ws.fail(err)
+			}
+		}
+
+	case 9:
+		// pongs echo the ping payload
+		ws.WriteMessage(PongMessage, payload)
+
+	case 10:
+		ws.stateMu.Lock()
+		pingSent, pingAt := ws.PingSent, ws.pingAt
+		ws.PingSent = false
+		ws.stateMu.Unlock()
+		if !pingSent {
+			ws.logger().Debug("received pong", "solicited", false)
+			break
+		}
+		rtt := time.Since(pingAt)
+		ws.metrics().PingRTT(rtt)
+		ws.logger().Debug("received pong", "solicited", true, "rtt", rtt)
+
+	case 8:
+		code, _, err := util.ValidateClosePayload(payload, !ws.SkipUTF8Validation)
+		if err != nil {
+			return ws.fail(err)
+		}
+		// Echo the status code back and close
+		if code == 1005 {
+			code = 1000
+		}
+		ws.Close(code, "")
+	}
+	return nil
+}
+
+// Closes the connection with the close code of a protocol violation.
+//
+// Returns err
+func (ws *Conn) fail(err error) error {
+	var protocolError *util.ProtocolError
+	if errors.As(err, &protocolError) {
+		ws.Close(protocolError.Code, protocolError.Reason)
+	}
+	return err
+}
+
+// Writes a frame header into head, with a random masking key on clients.
+//
+// Returns the header length and the masking key
+func (ws *Conn) putHeader(head *[14]byte, flags byte, length int) (int, [4]byte) {
+	var mask [4]byte
+	head[0] = flags
+
+	// if length is less than 125, just attach it as a integer to the header
+	n := 2
+	if length <= 125 {
+		head[1] = byte(length)
+	} else if length <= 65535 {
+		head[1] = 126
+		binary.BigEndian.PutUint16(head[2:], uint16(length))
+		n += 2
+	} else {
+		head[1] = 127
+		binary.BigEndian.PutUint64(head[2:], uint64(length))
+		n += 8
+	}
+
+	if ws.Role == ServerRole {
+		return n, mask
+	}
+
+	// Clients mask every frame with a random key
+	binary.LittleEndian.PutUint32(mask[:], rand.Uint32())
+	head[1] |= 128
+	n += copy(head[n:], mask[:])
+	return n, mask
+}
+
+// Returns the logger of the connection.
+func (ws *Conn) logger() *slog.Logger {
+	return util.LoggerOrDiscard(ws.Logger)
+}
+
+// Returns Metrics, or metrics recording nothing if it is nil.
+func (ws *Conn) metrics() Metrics {
+	if ws.Metrics == nil {
+		return noMetrics{}
+	}
+	return ws.Metrics
+}
+
+// Returns the buffer pool of the connection.
+func (ws *Conn) pool() BufferPool {
+	if ws.Pool != nil {
+		return ws.Pool
+	}
+	return defaultPool
+}
+
+// Reads one frame.
+//
+// Returns the payload, error and whether it was a close frame
+func (ws *Conn) Read() ([]byte, error, bool) {
+	header, err := ws.nextHeader(0)
+	if err != nil {
+		return nil, err, false
+	}
+	payload, err := ws.readPayload(header, nil)
+	ws.releaseBudget()
+	return payload, err, header.Opcode == 8
+}
+
+// Reads a whole message, joining fragmented messages.
+//
+// Control frames are returned as they arrive, pings are answered automatically.
+// A message interrupted by a control frame continues on the next call.
+//
+// Returns the message type, the payload and a error (can be nil)
+func (ws *Conn) ReadMessage() (MessageType, []byte, error) {
+	messageType, message, err := ws.ReadMessageInto(nil)
+	if err != nil {
+		return messageType, nil, err
+	}
+	return messageType, message, nil
+}
+
+// Reads a whole message like ReadMessage, appending it to buffer[:0].
+//
+// Reusing the returned slice for the next call avoids allocating per message.
+//
+// Returns the message type, buffer holding the payload and a error (can be nil)
+func (ws *Conn) ReadMessageInto(buffer []byte) (MessageType, []byte, error) {
+	// Reading the next message means the last one was handled
+	ws.FinishMessage(nil)
+
+	for {
+		messageType, message, err := ws.readMessage(buffer)
+		if err == nil {
+			ws.metrics().MessageReceived(messageType, len(message))
+		}
+		if err != nil || messageType.IsControl() {
+			return messageType, message, err
+		}
+
+		var parent trace.SpanContext
+		if ws.TraceEnvelope {
+			var payload []byte
+			var ok bool
+			parent, payload, ok = trace.Unwrap(message)
+			if ok {
+				// Moved down so the returned slice can be reused as a buffer
+				message = message[:copy(message, payload)]
+			}
+		}
+
+		if ws.Limiter != nil {
+			err = ws.Limiter.Allow(ws, len(message))
+			if errors.Is(err, ErrDropMessage) {
+				ws.metrics().MessageDropped("rate_limit")
+				buffer = message
+				continue
+			}
+			if err != nil {
+				return messageType, message, ws.fail(err)
+			}
+		}
+
+		ws.startMessage(parent, messageType, len(message))
+		return messageType, message, nil
+	}
+}
+
+// Starts the span of a received message, as a child of parent if it is valid
+// or of the connection otherwise.
+func (ws *Conn) startMessage(parent trace.SpanContext, messageType MessageType, size int) {
+	if ws.Tracer == nil {
+		if parent.IsValid() {
+			ws.messageCtx = trace.ContextWithSpanContext(ws.Context(), parent)
+		}
+		return
+	}
+	ctx := ws.Context()
+	if parent.IsValid() {
+		ctx = trace.ContextWithSpanContext(ctx, parent)
+	}
+	ws.messageCtx, ws.messageSpan = ws.Tracer.Start(ctx, "websocket.message",
+		slog.String("message.type", messageType.String()), slog.Int("message.size", size))
+}
+
+// Ends the span of the last message read, marking it as failed with err (can be nil).
+//
+// Servers call it once the handler returns, reading the next message calls it too.
+// Must be called from the reading goroutine.
+func (ws *Conn) FinishMessage(err error) {
+	if ws.messageSpan != nil {
+		if err != nil {
+			ws.messageSpan.SetError(err)
+		}
+		ws.messageSpan.Finish()
+		ws.messageSpan = nil
+	}
+	ws.messageCtx = nil
+}
+
+// Returns the context of the last message read, carrying its trace, or Context()
+// if it has none. Must be called from the reading goroutine.
+func (ws *Conn) MessageContext() context.Context {
+	if ws.messageCtx != nil {
+		return ws.messageCtx
+	}
+	return ws.Context()
+}
+
+// Reads a whole message into buffer[:0], see ReadMessageInto.
+//
+// Returns the message type, buffer holding the payload and a error (can be nil)
+func (ws *Conn) readMessage(buffer []byte) (MessageType, []byte, error) {
+	message := buffer[:0]
+
+	for {
+		var received uint64
+		if ws.partial != nil {
+			received = uint64(len(*ws.partial))
+		}
+		header, err := ws.nextHeader(received)
+		if err != nil {
+			ws.dropPartial()
+			return MessageType(header.Opcode), message, err
+		}
+
+		// Control frames use their own buffer, they can arrive between fragments
+		if header.IsControl() {
+			payload, err := ws.readPayload(header, ws.control[:0])
+			if err != nil {
+				ws.dropPartial()
+				return MessageType(header.Opcode), message, err
+			}
+			return MessageType(header.Opcode), append(message, payload...), nil
+		}
+
+		if header.Opcode != 0 {
+			ws.messageType = MessageType(header.Opcode)
+		}
+
+		// Unfragmented messages go straight into the buffer
+		if header.Fin && ws.partial == nil {
+			message, err = ws.readPayload(header, message)
+			ws.releaseBudget()
+			return ws.messageType, message, err
+		}
+
+		// Fragments are collected in a pooled buffer
+		if ws.partial == nil {
+			ws.partial = ws.pool().Get()
+			*ws.partial = (*ws.partial)[:0]
+		}
+		*ws.partial, err = ws.readPayload(header, *ws.partial)
+		if err != nil {
+			ws.dropPartial()
+			return ws.messageType, message, err
+		}
+		if header.Fin {
+			message = append(message, *ws.partial...)
+			ws.dropPartial()
+			return ws.messageType, message, nil
+		}
+	}
+}
+
+// Returns the fragment buffer to the pool and releases its budget.
+func (ws *Conn) dropPartial() {
+	if ws.partial != nil {
+		ws.pool().Put(ws.partial)
+		ws.partial = nil
+	}
+	ws.releaseBudget()
+}
+
+// Gives the budget reserved by the reader back.
+func (ws *Conn) releaseBudget() {
+	ws.Budget.release(ws.reserved)
+	ws.reserved = 0
+}
+
+// Simplified Write function, sends a binary message.
+func (ws *Conn) Write(byteArray []byte) (int, error) {
+	return ws.WriteMessage(BinaryMessage, byteArray)
+}
+
+// Sends a single frame message of the given type.
+//
+// Safe to call from several goroutines.
+//
+// Returns the amount of bytes written and error (can be nil)
+func (ws *Conn) WriteMessage(messageType MessageType, byteArray []byte) (int, error) {
+	if !messageType.IsControl() && (ws.Tracer != nil || ws.TraceEnvelope) {
+		return ws.WriteMessageContext(ws.Context(), messageType, byteArray)
+	}
+	return ws.writeMessage(messageType, byteArray)
+}
+
+// Sends a message like WriteMessage, traced as a child of the span carried by ctx.
+//
+// Pass ws.MessageContext() to link a reply to the message it answers.
+//
+// Returns the amount of bytes written and error (can be nil)
+func (ws *Conn) WriteMessageContext(ctx context.Context, messageType MessageType, byteArray []byte) (int, error) {
+	if messageType.IsControl() {
+		return ws.writeMessage(messageType, byteArray)
+	}
+	ctx, span := ws.Tracer.Start(ctx, "websocket.write",
+		slog.String("message.type", messageType.String()), slog.Int("message.size", len(byteArray)))
+	defer span.Finish()
+
+	payload := byteArray
+	if sc := trace.SpanContextFromContext(ctx); ws.TraceEnvelope && sc.IsValid() {
+		buffer := ws.pool().Get()
+		defer ws.pool().Put(buffer)
+		*buffer = trace.AppendEnvelope((*buffer)[:0], sc, byteArray)
+		payload = *buffer
+	}
+	n, err := ws.writeMessage(messageType, payload)
+	span.SetError(err)
+	return n, err
+}
+
+// Sends a single frame message, see WriteMessage.
+//
+// Returns the amount of bytes written and error (can be nil)
+func (ws *Conn) writeMessage(messageType MessageType, byteArray []byte) (int, error) {
+	if messageType.IsControl() && len(byteArray) > 125 {
+		return 0, errors.New("control frame length exceeded 125")
+	}
+	ws.writeLock.lock(messageType.IsControl(), ws.metrics())
+	defer ws.writeLock.unlock()
+	n, err := ws.writeFrame(byte(messageType), byteArray)
+	if err == nil {
+		ws.metrics().MessageSent(messageType, len(byteArray))
+	}
+	return n, err
+}
+
+// Writes and flushes one final frame, the caller must hold the write lock.
+//
+// Returns the amount of bytes written and error (can be nil)
+func (ws *Conn) writeFrame(opcode byte, byteArray []byte) (int, error) {
+	headerLength, mask := ws.putHeader(&ws.writeHead, 128|opcode, len(byteArray))
+	if ws.Role == ServerRole && len(byteArray) >= vectoredWriteMin && ws.canWritev() {
+		return ws.writeVectored(ws.writeHead[:headerLength], byteArray)
+	}
+
+	nn, err := ws.Buffer.Write(ws.writeHead[:headerLength])
+	if err != nil {
+		return nn, err
+	}
+
+	payload := byteArray
+	if ws.Role == ClientRole {
+		// Masked in a pooled copy, the caller's slice stays untouched
+		buffer := ws.pool().Get()
+		defer ws.pool().Put(buffer)
+		*buffer = append((*buffer)[:0], byteArray...)
+		maskBytes(mask, 0, *buffer)
+		payload = *buffer
+	}
+	n, err := ws.Buffer.Write(payload)
+	nn += n
+	if err != nil {
+		return nn, err
+	}
+
+	// return amount of bytes written and error
+	return nn, ws.Buffer.Flush()
+}
+
+// Returns true if the connection gathers several buffers in one writev call.
+func (ws *Conn) canWritev() bool {
+	switch ws.Conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// Sends header and payload with one writev call, skipping the write buffer.
+//
+// Returns the amount of bytes written and error (can be nil)
+func (ws *Conn) writeVectored(header []byte, payload []byte) (int, error) {
+	// Anything still buffered goes first
+	if err := ws.Buffer.Flush(); err != nil {
+		return 0, err
+	}
+	buffers := net.Buffers{header, payload}
+	nn, err := buffers.WriteTo(ws.Conn)
+	return int(nn), err
+}
+
+// Sends a text message.
+func (ws *Conn) WriteText(text string) (int, error) {
+	return ws.WriteMessage(TextMessage, []byte(text))
+}
+
+// Sends a binary message.
+func (ws *Conn) WriteBinary(byteArray []byte) (int, error) {
+	return ws.WriteMessage(BinaryMessage, byteArray)
+}
+
+// Sends a close frame with status code and a reason, then closes the connection.
+//
+// 1005, 1006 and 1015 only report what happened locally and must not be sent,
+// they close the connection without a close frame. Calling it again does nothing.
+//
+// Returns a error (can be nil)
+func (ws *Conn) Close(statusCode uint16, reason string) error {
+	if len(reason)+2 > 125 {
+		err := errors.New("control frame length exceeded 125")
+		return err
+	}
+	ws.stateMu.Lock()
+	closed := ws.closed
+	if !closed {
+		ws.closed = true
+		ws.closeCode = statusCode
+		ws.closeReason = reason
+		if ws.cancel != nil {
+			ws.cancel()
+		}
+	}
+	ws.stateMu.Unlock()
+	if closed {
+		return nil
+	}
+	// A reader waiting for memory stops waiting
+	ws.Budget.wake()
+
+	if statusCode == 1005 || statusCode == 1006 || statusCode == 1015 {
+		ws.writeLock.lock(true, ws.metrics())
+		err := ws.Conn.Close()
+		ws.writeLock.unlock()
+		ws.logger().Debug("connection closed without a close frame", "code", statusCode, "reason", reason)
+		return err
+	}
+
+	var data [125]byte
+	binary.BigEndian.PutUint16(data[:], statusCode)
+	length := 2 + copy(data[2:], reason)
+
+	// Nothing may be written after the close frame
+	ws.writeLock.lock(true, ws.metrics())
+	_, err := ws.writeFrame(byte(CloseMessage), data[:length])
+	ws.Conn.Close()
+	ws.writeLock.unlock()
+	if err == nil {
+		ws.metrics().MessageSent(CloseMessage, length)
+	}
+	ws.metrics().CloseSent(statusCode)
+	ws.logger().Debug("connection closed", "code", statusCode, "reason", reason)
+	return err
+}
+
+// Returns a context that is cancelled when the connection is closed.
+func (ws *Conn) Context() context.Context {
+	ws.stateMu.Lock()
+	defer ws.stateMu.Unlock()
+	if ws.ctx == nil {
+		parent := ws.parent
+		if parent == nil {
+			parent = context.Background()
+		}
+		ws.ctx, ws.cancel = context.WithCancel(parent)
+		if ws.closed {
+			ws.cancel()
+		}
+	}
+	return ws.ctx
+}
+
+// Sets the context Context derives from, for example one carrying the trace of the handshake.
+//
+// Contexts returned before keep being cancelled when the connection closes.
+func (ws *Conn) SetContext(parent context.Context) {
+	ws.stateMu.Lock()
+	defer ws.stateMu.Unlock()
+	ws.parent = parent
+	if ws.ctx == nil {
+		return
+	}
+	previous := ws.cancel
+	ctx, cancel := context.WithCancel(parent)
+	ws.ctx = ctx
+	ws.cancel = func() {
+		cancel()
+		previous()
+	}
+	if ws.closed {
+		ws.cancel()
+	}
+}
+
+// Stores a value on the connection, for example the authenticated user.
+func (ws *Conn) Set(key string, value any) {
+	ws.valuesMu.Lock()
+	defer ws.valuesMu.Unlock()
+	if ws.values == nil {
+		ws.values = make(map[string]any)
+	}
+	ws.values[key] = value
+}
+
+// Returns a value stored with Set and whether it exists.
+func (ws *Conn) Get(key string) (any, bool) {
+	ws.valuesMu.RLock()
+	defer ws.valuesMu.RUnlock()
+	value, ok := ws.values[key]
+	return value, ok
+}
+
+// Returns a value stored with Set, ok is false if it is missing or not a T.
+func Value[T any](ws *Conn, key string) (T, bool) {
+	value, _ := ws.Get(key)
+	typed, ok := value.(T)
+	return typed, ok
+}
+
+// Returns the value of a handshake header, the name is case-insensitive.
+func (ws *Conn) Header(name string) string {
+	if value, ok := ws.Headers[name]; ok {
+		return value
+	}
+	for key, value := range ws.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// Returns the address of the peer.
+func (ws *Conn) RemoteAddr() net.Addr {
+	return ws.Conn.RemoteAddr()
+}
+
+// Sets Path and Query from the target of the handshake request.
+func (ws *Conn) SetRequestURI(uri string) {
+	parsed, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return
+	}
+	ws.Path = parsed.Path
+	ws.Query = parsed.Query()
+}
+
+// Returns true once the connection was closed, by Close or by a close frame of the peer.
+func (ws *Conn) IsClosed() bool {
+	ws.stateMu.Lock()
+	defer ws.stateMu.Unlock()
+	return ws.closed
+}
+
+// Returns the status code and reason of the close frame that was sent, 0 while open.
+func (ws *Conn) CloseStatus() (uint16, string) {
+	ws.stateMu.Lock()
+	defer ws.stateMu.Unlock()
+	return ws.closeCode, ws.closeReason
+}
+
+// Sends a ping with an optional message.
+//
+// Returns a error (can be nil)
+func (ws *Conn) Ping(message string) error {
+	// Set first, the pong can arrive before WriteMessage returns
+	ws.stateMu.Lock()
+	ws.PingSent = true
+	ws.pingAt = time.Now()
+	ws.stateMu.Unlock()
+
+	_, err := ws.WriteMessage(PingMessage, []byte(message))
+	if err != nil {
+		ws.stateMu.Lock()
+		ws.PingSent = false
+		ws.stateMu.Unlock()
+	}
+	return err
+}
+
+// Sends an unsolicited pong with an optional message.
+//
+// Returns a error (can be nil)
+func (ws *Conn) Pong(message string) error {
+	_, err := ws.WriteMessage(PongMessage, []byte(message))
+	return err
+}
@@ -0,0 +1,167 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"mithril/util"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// Returns a server and a client connected through a pipe.
+func connPair(t testing.TB) (*Conn, *Conn) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+	return NewConn(serverConn, nil, ServerRole), NewConn(clientConn, nil, ClientRole)
+}
+
+// Sends payload from sender to receiver n times, reading into a reused buffer.
+//
+// Returns the last message received
+func exchange(t testing.TB, sender *Conn, receiver *Conn, payload []byte, n int) []byte {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := sender.WriteMessage(BinaryMessage, payload); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	var buffer []byte
+	for i := 0; i < n; i++ {
+		var err error
+		_, buffer, err = receiver.ReadMessageInto(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return buffer
+}
+
+func TestExchange(t *testing.T) {
+	server, client := connPair(t)
+	payload := bytes.Repeat([]byte("mithril"), 20000)
+	if got := exchange(t, client, server, payload, 3); !bytes.Equal(got, payload) {
+		t.Fatal("server received a different message")
+	}
+	if got := exchange(t, server, client, payload, 3); !bytes.Equal(got, payload) {
+		t.Fatal("client received a different message")
+	}
+}
+
+// Reading into a reused buffer and writing must not allocate once buffers are warm.
+func TestMessageAllocs(t *testing.T) {
+	server, client := connPair(t)
+	payload := make([]byte, 1024)
+	turn, done := make(chan struct{}), make(chan struct{})
+	defer close(turn)
+	go func() {
+		var buffer []byte
+		for range turn {
+			client.WriteMessage(BinaryMessage, payload)
+			_, buffer, _ = client.ReadMessageInto(buffer)
+			done <- struct{}{}
+		}
+	}()
+
+	var buffer []byte
+	allocs := testing.AllocsPerRun(100, func() {
+		turn <- struct{}{}
+		_, buffer, _ = server.ReadMessageInto(buffer)
+		server.WriteMessage(BinaryMessage, buffer)
+		<-done
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations per message round trip", allocs)
+	}
+}
+
+// Reports allocations per message received and sent by each role.
+func BenchmarkMessage(b *testing.B) {
+	for _, size := range []int{16, 1024, 64 << 10} {
+		payload := make([]byte, size)
+		b.Run("server/"+strconv.Itoa(size), func(b *testing.B) {
+			server, client := connPair(b)
+			exchange(b, client, server, payload, 1)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			exchange(b, client, server, payload, b.N)
+		})
+		b.Run("client/"+strconv.Itoa(size), func(b *testing.B) {
+			server, client := connPair(b)
+			exchange(b, server, client, payload, 1)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			exchange(b, server, client, payload, b.N)
+		})
+	}
+}
+
+func TestTextUTF8(t *testing.T) {
+	type frame struct {
+		fin     bool
+		opcode  byte
+		payload string
+	}
+	tests := []struct {
+		name   string
+		skip   bool
+		frames []frame
+		// Message read, or the close code if it fails
+		message string
+		code    uint16
+	}{
+		{name: "split code point", frames: []frame{{false, 1, "a\xE2"}, {false, 0, "\x82"}, {true, 0, "\xAC"}}, message: "a€"},
+		{name: "ping between fragments", frames: []frame{{false, 1, "\xF0\x9D"}, {true, 9, "\xFF"}, {true, 0, "\x84\x9E"}}, message: "𝄞"},
+		{name: "invalid text", frames: []frame{{true, 1, "a\xFF"}}, code: 1007},
+		{name: "surrogate in a continuation", frames: []frame{{false, 1, "a"}, {true, 0, "\xED\xA0\x80"}}, code: 1007},
+		{name: "truncated at FIN", frames: []frame{{false, 1, "a\xE2"}, {true, 0, "\x82"}}, code: 1007},
+		{name: "invalid close reason", frames: []frame{{true, 8, "\x03\xE8\xFF"}}, code: 1007},
+		{name: "binary", frames: []frame{{true, 2, "\xFF"}}, message: "\xFF"},
+		{name: "opt-out", skip: true, frames: []frame{{false, 1, "a\xE2"}, {true, 0, "\xFF"}}, message: "a\xE2\xFF"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ws, client := pipeConn(t)
+			ws.SkipUTF8Validation = test.skip
+			go func() {
+				for _, frame := range test.frames {
+					client.Write(clientFrame(frame.fin, frame.opcode, []byte(frame.payload)))
+				}
+			}()
+
+			// Control frames are returned too
+			messageType, message, err := ws.ReadMessage()
+			for err == nil && messageType.IsControl() {
+				messageType, message, err = ws.ReadMessage()
+			}
+			if test.code == 0 {
+				if err != nil || string(message) != test.message {
+					t.Fatalf("read %q, %v, want %q", message, err, test.message)
+				}
+				return
+			}
+			var protocolError *util.ProtocolError
+			if !errors.As(err, &protocolError) || protocolError.Code != test.code {
+				t.Fatalf("got %q, %v, want a %d error", message, err, test.code)
+			}
+			if code, _ := ws.CloseStatus(); code != test.code {
+				t.Errorf("closed with %d, want %d", code, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package websocket
+
+// Payload masking (RFC 6455 section 5.3).
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// XORs data with the masking key, starting pos bytes into the key.
+//
+// Works 8 bytes at a time, a payload split across buffers is masked by
+// passing the returned position to the next call.
+//
+// Returns the key position after data
+func maskBytes(mask [4]byte, pos int, data []byte) int {
+	pos &= 3
+	if len(data) < 8 {
+		for i := range data {
+			data[i] ^= mask[(pos+i)&3]
+		}
+		return (pos + len(data)) & 3
+	}
+
+	// Key repeated over 8 bytes, rotated so its first byte lines up with data[0]
+	key32 := bits.RotateLeft32(binary.LittleEndian.Uint32(mask[:]), -8*pos)
+	key := uint64(key32)<<32 | uint64(key32)
+
+	i := 0
+	for ; len(data)-i >= 32; i += 32 {
+		chunk := data[i : i+32]
+		binary.LittleEndian.PutUint64(chunk, binary.LittleEndian.Uint64(chunk)^key)
+		binary.LittleEndian.PutUint64(chunk[8:], binary.LittleEndian.Uint64(chunk[8:])^key)
+		binary.LittleEndian.PutUint64(chunk[16:], binary.LittleEndian.Uint64(chunk[16:])^key)
+		binary.LittleEndian.PutUint64(chunk[24:], binary.LittleEndian.Uint64(chunk[24:])^key)
+	}
+	for ; len(data)-i >= 8; i += 8 {
+		chunk := data[i : i+8]
+		binary.LittleEndian.PutUint64(chunk, binary.LittleEndian.Uint64(chunk)^key)
+	}
+
+	// Tail, i is a multiple of 8 so the key lines up as it did at data[0]
+	for ; i < len(data); i++ {
+		data[i] ^= mask[(pos+i)&3]
+	}
+	return (pos + len(data)) & 3
+}
@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"testing"
+)
+
+// Masks one byte at a time, the way RFC 6455 section 5.3 describes it.
+func maskReference(mask [4]byte, pos int, data []byte) int {
+	for i := range data {
+		data[i] ^= mask[(pos+i)&3]
+	}
+	return (pos + len(data)) & 3
+}
+
+func FuzzMaskBytes(f *testing.F) {
+	f.Add(uint32(0x01020304), 0, 0, []byte("hello"))
+	f.Add(uint32(0xdeadbeef), 3, 7, bytes.Repeat([]byte{0xAA}, 100))
+	f.Add(uint32(0x80808080), 1, 33, make([]byte, 64))
+
+	f.Fuzz(func(t *testing.T, key uint32, pos int, split int, data []byte) {
+		var mask [4]byte
+		binary.LittleEndian.PutUint32(mask[:], key)
+		if pos < 0 {
+			pos = -pos
+		}
+		want := bytes.Clone(data)
+		wantPos := maskReference(mask, pos&3, want)
+
+		// Whole, and split in two calls as readers of buffered payloads do
+		got := bytes.Clone(data)
+		if gotPos := maskBytes(mask, pos, got); gotPos != wantPos || !bytes.Equal(got, want) {
+			t.Fatalf("maskBytes(%x, %d) = %x, %d, want %x, %d", mask, pos, got, gotPos, want, wantPos)
+		}
+		if len(data) > 0 {
+			split = int(uint(split) % uint(len(data)+1))
+		} else {
+			split = 0
+		}
+		got = bytes.Clone(data)
+		gotPos := maskBytes(mask, maskBytes(mask, pos, got[:split]), got[split:])
+		if gotPos != wantPos || !bytes.Equal(got, want) {
+			t.Fatalf("split at %d: %x, %d, want %x, %d", split, got, gotPos, want, wantPos)
+		}
+	})
+}
+
+func BenchmarkMaskBytes(b *testing.B) {
+	mask := [4]byte{1, 2, 3, 4}
+	for _, size := range []int{7, 125, 1024, 64 << 10} {
+		data := make([]byte, size)
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				maskBytes(mask, 1, data)
+			}
+		})
+		b.Run("reference/"+strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				maskReference(mask, 1, data)
+			}
+		})
+	}
+}
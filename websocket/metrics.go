@@ -0,0 +1,34 @@
+package websocket
+
+// Hooks for counting the traffic of connections.
+
+import "time"
+
+// Receives the traffic of connections, see Conn.Metrics.
+//
+// The methods are called by the reading and writing goroutines of every connection
+// sharing it, so they must be safe for concurrent use and must not block.
+type Metrics interface {
+	// A message or control frame was read by ReadMessage or ReadMessageInto
+	MessageReceived(messageType MessageType, size int)
+	// A message or control frame was written
+	MessageSent(messageType MessageType, size int)
+	// A received message was skipped, reason is a short label such as "rate_limit"
+	MessageDropped(reason string)
+	// A pong answered the last ping after rtt
+	PingRTT(rtt time.Duration)
+	// A close frame with code was sent, including echoes of the peer's close frame
+	CloseSent(code uint16)
+	// A writer started (1) or stopped (-1) waiting for another writer to finish
+	WriteQueued(delta int)
+}
+
+// Metrics that records nothing, used wherever none were set.
+type noMetrics struct{}
+
+func (noMetrics) MessageReceived(MessageType, int) {}
+func (noMetrics) MessageSent(MessageType, int)     {}
+func (noMetrics) MessageDropped(string)            {}
+func (noMetrics) PingRTT(time.Duration)            {}
+func (noMetrics) CloseSent(uint16)                 {}
+func (noMetrics) WriteQueued(int)                  {}
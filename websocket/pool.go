@@ -0,0 +1,44 @@
+package websocket
+
+// Reusable buffers for reading and writing frames.
+
+import "sync"
+
+// Buffers larger than this are dropped instead of pooled (64 KiB)
+const maxPooledBuffer = 64 << 10
+
+// Source of reusable byte buffers, can be shared by many connections.
+//
+// Get returns a buffer of any length, Put gives it back once it is unused.
+type BufferPool interface {
+	Get() *[]byte
+	Put(buffer *[]byte)
+}
+
+// BufferPool backed by a sync.Pool.
+type syncPool struct {
+	pool sync.Pool
+}
+
+// Creates a BufferPool backed by a sync.Pool, buffers over 64 KiB are not kept.
+func NewBufferPool() BufferPool {
+	return &syncPool{pool: sync.Pool{New: func() any {
+		buffer := make([]byte, 0, 512)
+		return &buffer
+	}}}
+}
+
+func (pool *syncPool) Get() *[]byte {
+	return pool.pool.Get().(*[]byte)
+}
+
+func (pool *syncPool) Put(buffer *[]byte) {
+	if cap(*buffer) > maxPooledBuffer {
+		return
+	}
+	*buffer = (*buffer)[:0]
+	pool.pool.Put(buffer)
+}
+
+// Pool used by connections without their own
+var defaultPool = NewBufferPool()
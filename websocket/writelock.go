@@ -0,0 +1,66 @@
+package websocket
+
+// Write serialization for connections shared between goroutines.
+
+import "sync"
+
+// Lets one writer at a time use the connection.
+//
+// Data frames are written in the order their writers arrived, so a busy goroutine can't starve the others.
+// Control frames waiting for the lock are let in before waiting data frames,
+// so pongs and close frames are not stuck behind a queue of messages.
+// The zero value is ready to use.
+type writeLock struct {
+	mu             sync.Mutex
+	cond           *sync.Cond
+	busy           bool
+	controlWaiting int
+	// Ticket of the next data writer to arrive and of the one allowed in
+	nextTicket uint64
+	serving    uint64
+}
+
+// Blocks until the caller may write, reporting the wait to metrics.
+func (l *writeLock) lock(control bool, metrics Metrics) {
+	l.mu.Lock()
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+	}
+	var ticket uint64
+	if control {
+		l.controlWaiting++
+	} else {
+		ticket = l.nextTicket
+		l.nextTicket++
+	}
+	wait := func() bool {
+		if control {
+			return l.busy
+		}
+		return l.busy || l.controlWaiting > 0 || ticket != l.serving
+	}
+	if wait() {
+		metrics.WriteQueued(1)
+		for wait() {
+			l.cond.Wait()
+		}
+		metrics.WriteQueued(-1)
+	}
+	if control {
+		l.controlWaiting--
+	} else {
+		l.serving++
+	}
+	l.busy = true
+	l.mu.Unlock()
+}
+
+// Hands the connection to the next writer.
+func (l *writeLock) unlock() {
+	l.mu.Lock()
+	l.busy = false
+	if l.cond != nil {
+		l.cond.Broadcast()
+	}
+	l.mu.Unlock()
+}
@@ -0,0 +1,39 @@
+package wsclient
+
+// TLS settings for wss:// connections.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// Options used when connecting to a wss:// server.
+type TLSOptions struct {
+	// Root CAs used to verify the server, the system pool is used when nil.
+	RootCAs *x509.CertPool
+	// Client certificates presented to servers requiring mutual TLS.
+	Certificates []tls.Certificate
+	// Overrides the name used for SNI and certificate verification.
+	ServerName string
+	// Disables verification of the server certificate.
+	// Only meant for testing against self-signed servers.
+	InsecureSkipVerify bool
+}
+
+// Builds a tls.Config for connecting to host.
+func (options *TLSOptions) config(host string) *tls.Config {
+	config := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if options == nil {
+		return config
+	}
+	if options.ServerName != "" {
+		config.ServerName = options.ServerName
+	}
+	config.RootCAs = options.RootCAs
+	config.Certificates = options.Certificates
+	config.InsecureSkipVerify = options.InsecureSkipVerify
+	return config
+}
@@ -5,189 +5,85 @@ package wsclient
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/tls"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
-	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"math/rand/v2"
+	"mithril/trace"
 	"mithril/util"
+	"mithril/websocket"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
 )
 
-// Type describing a (client) WebSocket connection
-type ClientWs struct {
-	Conn    net.Conn
-	Buffer  *bufio.ReadWriter
-	Headers map[string]string
-}
-
-// Closes the connection
-func (ws *ClientWs) Close(statusCode uint16, reason string) error {
-	if len(reason)+2 > 125 {
-		err := errors.New("control frame length exceeded 125")
-		return err
-	}
-
-	var data = new(bytes.Buffer)
-
-	binary.Write(data, binary.BigEndian, statusCode)
-	binary.Write(data, binary.BigEndian, []byte(reason))
-	_, err := ws.Write(data.Bytes(), 136)
-	ws.Conn.Close()
-	return err
-}
+// Type describing a (client) WebSocket connection, see websocket.Conn.
+type ClientWs = websocket.Conn
 
-// sends a Pong.
+// Settings of client connections, the zero value connects silently without metrics or tracing.
 //
-// Returns a error in case of one happening.
-func (ws *ClientWs) Pong(pongMessage string) error {
-	ws.Buffer.Write([]byte{138})
-	_, err := ws.Buffer.Write([]byte(pongMessage))
-	ws.Buffer.Flush()
-	return err
+// The package level Connect functions use the zero value, two Clients can differ
+// within one process. The fields must not change while the Client connects.
+type Client struct {
+	// TLS settings for wss:// (nil uses the system root CAs)
+	TLS *TLSOptions
+	// Logger of the connections, nil keeps the client silent
+	Logger *slog.Logger
+	// Counters of handshakes and traffic (can be nil), metrics.NewRegistry implements them
+	Metrics ClientMetrics
+	// Traces handshakes, received messages and writes (nil traces nothing).
+	// The handshake sends its span as a traceparent header.
+	Tracer *trace.Tracer
+	// Carries the trace context inside text and binary messages, see websocket.Conn.TraceEnvelope
+	TraceEnvelope bool
 }
 
-// sends a Ping.
+// Receives the handshakes of the client and the traffic of its connections.
 //
-// Returns a error in case of one happening.
-func (ws *ClientWs) Ping(pongMessage string) error {
-	ws.Buffer.Write([]byte{137})
-	_, err := ws.Buffer.Write([]byte(pongMessage))
-	ws.Buffer.Flush()
-	return err
+// The methods must be safe for concurrent use and must not block.
+type ClientMetrics interface {
+	websocket.Metrics
+	// The server accepted the handshake, the connection stays open until ConnectionClosed
+	HandshakeAccepted()
+	// The handshake failed, reason is "status", "aborted" or "accept"
+	HandshakeRejected(reason string)
+	// The handler of an accepted connection returned
+	ConnectionClosed()
 }
 
-// Creates a payload frame.
+// Handshake the server did not accept, returned by the Connect functions.
 //
-// In case of an error it returns a empty byte array containing 1 zero byte and an error.
-func (ws *ClientWs) createFrame(data []byte, flags byte) ([]byte, error) {
-	var bytes = new(bytes.Buffer)
-	// full payload length in bytes as variable
-	var length []byte
-	var payloadLength int = len(data)
-	bytes.WriteByte(flags)
-	// Random mask
-	var mask []byte = []byte{byte(rand.Uint()), byte(rand.Uint()), byte(rand.Uint()), byte(rand.Uint())}
-
-	if len(data) < 65535 {
-		// Writes length
-		bytes.WriteByte(byte(128 + payloadLength))
-		// Writes the mask to the buffer
-		bytes.Write(mask)
-		// Writes the masked data to the buffer
-		for i := 0; i <= payloadLength-1; i++ {
-			err := bytes.WriteByte(data[i] ^ mask[i%4])
-			if err != nil {
-				return []byte{0}, err
-			}
-		}
-	} else if payloadLength >= 65535 && payloadLength < 65536 {
-		// Writes length
-		bytes.WriteByte(254)
-		// Writes the mask to the buffer
-		bytes.Write(mask)
-		// Writes the extended payload length
-		binary.LittleEndian.PutUint16(length, uint16(payloadLength))
-		bytes.Write(length)
-		// Writes the masked data to the buffer
-		for i := 0; i <= payloadLength-1; i++ {
-			err := bytes.WriteByte(data[i] ^ mask[i%4])
-			if err != nil {
-				return []byte{0}, err
-			}
-		}
-
-	} else {
-		// Writes length
-		bytes.WriteByte(255)
-		// Writes the mask to the buffer
-		bytes.Write(mask)
-		// Writes the extended payload length
-		binary.LittleEndian.PutUint64(length, uint64(payloadLength))
-		bytes.Write(length)
-		// Writes the masked data to the buffer
-		for i := 0; i <= payloadLength-1; i++ {
-			err := bytes.WriteByte(data[i] ^ mask[i%4])
-			if err != nil {
-				return []byte{0}, err
-			}
-		}
-	}
-
-	return bytes.Bytes(), nil
-}
-
-// Writes to the connection.
-//
-// Returns the amount of bytes written and error
-func (ws *ClientWs) Write(data []byte, flags byte) (int, error) {
-	frame, err := ws.createFrame(data, flags)
-	if err != nil {
-		return 0, err
-	}
-	n, err := ws.Buffer.Write(frame)
-	ws.Buffer.Flush()
-	return n, err
+// Servers reject with 401, 403, 429 or 503 among others, Headers holds the
+// reply so Retry-After or WWW-Authenticate can be read.
+type HandshakeError struct {
+	// HTTP status code of the reply, 0 if no status line was received
+	StatusCode int
+	// Status line of the reply, empty if none was received
+	Status string
+	// "status", "aborted" or "accept", see ClientMetrics.HandshakeRejected
+	Reason string
+	// Headers of the reply (can be nil)
+	Headers map[string]string
+	// Error that aborted the handshake (can be nil)
+	Err error
 }
 
-func (ws *ClientWs) decodeFrame(data []byte) ([]byte, string, error) {
-	if data[1]&128 != 0 {
-		util.OnError(errors.New("masked frame received"))
-	}
-	frameType, fin, err := util.Validate(data, false)
-	if err != nil {
-		return []byte{0}, "unknown", err
-	}
-
-	// implement continuation frames
-	if fin == 0 {
-		fmt.Println("Continuation frame!!!!!!!")
+func (err *HandshakeError) Error() string {
+	switch {
+	case err.Err != nil:
+		return "handshake " + err.Reason + ": " + err.Err.Error()
+	case err.Status != "":
+		return "handshake " + err.Reason + ": " + err.Status
 	}
-	switch data[1] & 127 {
-	case 127:
-		return data[10:], frameType, err
-	case 126:
-		return data[4:], frameType, err
-	default:
-		return data[2:], frameType, err
-	}
-
+	return "handshake " + err.Reason
 }
 
-// Reads from the connection.
-//
-// Returns the amount of bytes written and error
-func (ws *ClientWs) Read() ([]byte, error) {
-	var data []byte = make([]byte, 4096)
-	length, err := ws.Buffer.Read(data)
-	if err != nil {
-		return []byte{0}, err
-	}
-	decodedFrame, frameType, err := ws.decodeFrame(data[:length])
-	if err != nil {
-		return []byte{0}, err
-	}
-	switch frameType {
-	case "binary":
-		fallthrough
-	case "text":
-		// switch statement
-		return decodedFrame, err
-	case "ping":
-		ws.Pong("Pong!")
-		return decodedFrame, err
-	case "pong":
-		fmt.Println("Received a pong frame!")
-		return decodedFrame, err
-	case "close":
-		ws.Close(1000, "Closing!")
-	}
-	ws.Buffer.Flush()
-	return decodedFrame, err
+func (err *HandshakeError) Unwrap() error {
+	return err.Err
 }
 
 // Generate Secure WebSocket key.
@@ -199,14 +95,19 @@ func generateWebSocketKey() string {
 	return base64.StdEncoding.EncodeToString(nonce.Bytes())
 }
 
-// Create a HTTP handshake to the server.
-func serverHandshake(key string) []byte {
+// Create a HTTP handshake to the server, traceparent is omitted if empty.
+func serverHandshake(host string, path string, key string, traceparent string) []byte {
 	var request strings.Builder
-	request.WriteString("GET /ws HTTP/1.1\r\n")
-	request.WriteString("Host: test.com:2000\r\n")
+	request.WriteString("GET " + path + " HTTP/1.1\r\n")
+	request.WriteString("Host: " + host + "\r\n")
 	request.WriteString("Upgrade: websocket\r\n")
+	request.WriteString("Connection: Upgrade\r\n")
 	request.WriteString("Sec-WebSocket-Key: " + key + "\r\n")
-	request.WriteString("Sec-WebSocket-Version: 13\r\n\r\n")
+	request.WriteString("Sec-WebSocket-Version: 13\r\n")
+	if traceparent != "" {
+		request.WriteString("traceparent: " + traceparent + "\r\n")
+	}
+	request.WriteString("\r\n")
 
 	return []byte(request.String())
 }
@@ -219,70 +120,201 @@ func validateWebsocketAccept(accept string, key string) bool {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil)) == accept
 }
 
-// Create a connection to a websocket.
-func ConnectWebSocket(address string, port string, handler func(ws *ClientWs)) {
-	connection, err := net.Dial("tcp", address+":"+port)
-	util.OnError(err)
+// Performs the opening handshake on an established connection and hands it over to the handler.
+//
+// Returns a *HandshakeError if the server did not accept the handshake (can be nil)
+func (client *Client) handshake(connection net.Conn, host string, path string, handler func(ws *ClientWs)) error {
 	defer connection.Close()
-	var connectionEstablished bool = false
+
+	var logger *slog.Logger = util.LoggerOrDiscard(client.Logger).With("remote", connection.RemoteAddr().String(), "path", path)
 
 	// Buffer for the connection
 	buffer := bufio.NewReadWriter(bufio.NewReader(connection), bufio.NewWriter(connection))
 
-	// Scanner
-	scanner := bufio.NewScanner(connection)
-
 	// Sec-WebSocket-Key
 	websocketKey := generateWebSocketKey()
 
+	ctx, span := client.Tracer.Start(context.Background(), "websocket.connect", slog.String("host", host), slog.String("path", path))
+	var traceparent string
+	if span != nil {
+		traceparent = span.SpanContext.Traceparent()
+	}
+
 	// Handshake with server
-	handshake := serverHandshake(websocketKey)
-	connection.Write(handshake)
+	buffer.Write(serverHandshake(host, path, websocketKey, traceparent))
+	if err := buffer.Flush(); err != nil {
+		logger.Warn("could not send the handshake", "error", err)
+		return client.rejected(span, &HandshakeError{Reason: "aborted", Err: err})
+	}
+
+	// Read status line
+	output, err := buffer.ReadString('\n')
+	if err != nil {
+		logger.Warn("connection closed before the HTTP reply", "error", err)
+		return client.rejected(span, &HandshakeError{Reason: "aborted", Err: err})
+	}
+	output = strings.TrimRight(output, "\r\n")
+	statusCode := parseStatusCode(output)
 
 	// Map of obtained headers
 	var headers map[string]string = make(map[string]string)
-
-	// If connection was established, hands over control to the handler
-	if connectionEstablished {
-		handler(&ClientWs{Conn: connection, Buffer: buffer, Headers: headers})
-	} else {
-		// Scan first line
-		ok := scanner.Scan()
-		if !ok {
-			panic(io.EOF)
-		}
-		output := scanner.Text()
-		if string(output) == "HTTP/1.1 101 Switching Protocols" {
-			for {
-				ok := scanner.Scan()
-				if !ok {
-					log.Println("EOF from server. Closing connection.")
-					connection.Close()
-					return
-				}
-
-				output := scanner.Text()
-				if output != "" {
-					keyValue := strings.Split(output, ":")
-					headers[keyValue[0]] = strings.ReplaceAll(keyValue[1], " ", "")
-				} else {
-					break
-				}
+	for {
+		line, err := buffer.ReadString('\n')
+		if err != nil {
+			if statusCode != 101 {
+				// The status is what the caller needs, servers close right after rejecting
+				break
 			}
-			log.Println("Successfully obtained the headers from the HTTP reply")
+			logger.Warn("connection closed during the handshake", "error", err)
+			return client.rejected(span, &HandshakeError{StatusCode: statusCode, Status: output, Reason: "aborted", Headers: headers, Err: err})
+		}
 
-		} else {
-			log.Println("Invalid HTTP Reply: " + string(output) + ". Closing connection.")
-			connection.Close()
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
 		}
+		keyValue := strings.SplitN(line, ":", 2)
+		if len(keyValue) == 2 {
+			headers[keyValue[0]] = strings.TrimSpace(keyValue[1])
+		}
+	}
+	logger.Debug("obtained the headers of the HTTP reply")
+
+	if statusCode != 101 {
+		logger.Warn("invalid HTTP reply, closing connection", "status", output)
+		return client.rejected(span, &HandshakeError{StatusCode: statusCode, Status: output, Reason: "status", Headers: headers})
+	}
+	if !validateWebsocketAccept(headers["Sec-WebSocket-Accept"], websocketKey) {
+		logger.Warn("invalid Sec-WebSocket-Accept, closing connection")
+		return client.rejected(span, &HandshakeError{StatusCode: statusCode, Status: output, Reason: "accept", Headers: headers})
+	}
+
+	logger.Debug("handshake accepted")
+	ws := websocket.NewConn(connection, buffer, websocket.ClientRole)
+	ws.Logger = logger
+	ws.Metrics = client.Metrics
+	ws.Tracer = client.Tracer
+	ws.TraceEnvelope = client.TraceEnvelope
+	ws.SetContext(ctx)
+	span.Finish()
+	ws.Headers = headers
+	ws.SetRequestURI(path)
+	if client.Metrics != nil {
+		client.Metrics.HandshakeAccepted()
+	}
+	handler(ws)
+	// Close normally if the handler didn't, this also cancels ws.Context()
+	ws.Close(1000, "")
+	if client.Metrics != nil {
+		client.Metrics.ConnectionClosed()
+	}
+	return nil
+}
 
-		if validateWebsocketAccept(headers["Sec-WebSocket-Accept"], websocketKey) {
-			log.Println("Sec-WebSocket-Accept field is valid. Handing over control to the handler function.")
-			connectionEstablished = true
-			handler(&ClientWs{Conn: connection, Buffer: buffer, Headers: headers})
-		} else {
-			log.Println("Invalid Sec-WebSocket-Accept. Closed connection with WebSocket")
-			connection.Close()
+// Returns the status code of a "HTTP/1.1 <code> <text>" status line, 0 if it is malformed.
+func parseStatusCode(statusLine string) int {
+	version, rest, found := strings.Cut(statusLine, " ")
+	if !found || !strings.HasPrefix(version, "HTTP/") || len(rest) < 3 || (len(rest) > 3 && rest[3] != ' ') {
+		return 0
+	}
+	code, err := strconv.Atoi(rest[:3])
+	if err != nil || code < 100 {
+		return 0
+	}
+	return code
+}
+
+// Records a failed handshake.
+//
+// Returns err
+func (client *Client) rejected(span *trace.Span, err *HandshakeError) error {
+	span.SetError(err)
+	span.Finish()
+	if client.Metrics != nil {
+		client.Metrics.HandshakeRejected(err.Reason)
+	}
+	return err
+}
+
+// Create a connection to a websocket, panics if it cannot connect.
+//
+// Returns a *HandshakeError if the server did not accept the handshake (can be nil)
+func ConnectWebSocket(address string, port string, handler func(ws *ClientWs)) error {
+	connection, err := net.Dial("tcp", address+":"+port)
+	util.OnError(err)
+
+	return (&Client{}).handshake(connection, address+":"+port, "/ws", handler)
+}
+
+// Create a TLS secured connection to a websocket (wss://).
+//
+// options can be nil, in which case the system root CAs are used.
+// Panics if it cannot connect.
+//
+// Returns a *HandshakeError if the server did not accept the handshake (can be nil)
+func ConnectWebSocketTLS(address string, port string, handler func(ws *ClientWs), options *TLSOptions) error {
+	connection, err := tls.Dial("tcp", address+":"+port, options.config(address))
+	util.OnError(err)
+
+	return (&Client{TLS: options}).handshake(connection, address+":"+port, "/ws", handler)
+}
+
+// Performs the WebSocket handshake over an already established connection, see Client.ConnectConn.
+//
+// Returns a error (can be nil)
+func ConnectConn(connection net.Conn, host string, path string, handler func(ws *ClientWs)) error {
+	return (&Client{}).ConnectConn(connection, host, path, handler)
+}
+
+// Create a connection to a websocket from a ws:// or wss:// URL, see Client.ConnectURL.
+//
+// options is only used for wss:// and can be nil.
+//
+// Returns a error (can be nil)
+func ConnectURL(rawURL string, handler func(ws *ClientWs), options *TLSOptions) error {
+	return (&Client{TLS: options}).ConnectURL(rawURL, handler)
+}
+
+// Performs the WebSocket handshake over an already established connection.
+//
+// Lets the client run over any transport, such as a connection from mithril/tls.Dial.
+//
+// Returns a *HandshakeError if the server did not accept the handshake (can be nil)
+func (client *Client) ConnectConn(connection net.Conn, host string, path string, handler func(ws *ClientWs)) error {
+	return client.handshake(connection, host, path, handler)
+}
+
+// Create a connection to a websocket from a ws:// or wss:// URL.
+//
+// Returns a error (can be nil), a *HandshakeError if the server did not accept the handshake
+func (client *Client) ConnectURL(rawURL string, handler func(ws *ClientWs)) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	path := parsed.RequestURI()
+	host := parsed.Hostname()
+	port := parsed.Port()
+
+	var connection net.Conn
+	switch parsed.Scheme {
+	case "ws":
+		if port == "" {
+			port = "80"
 		}
+		connection, err = net.Dial("tcp", net.JoinHostPort(host, port))
+	case "wss":
+		if port == "" {
+			port = "443"
+		}
+		connection, err = tls.Dial("tcp", net.JoinHostPort(host, port), client.TLS.config(host))
+	default:
+		return errors.New("unsupported URL scheme: " + parsed.Scheme)
+	}
+	if err != nil {
+		return err
 	}
+
+	return client.handshake(connection, parsed.Host, path, handler)
 }
@@ -0,0 +1,193 @@
+package wsclient_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log/slog"
+	"mithril/metrics"
+	"mithril/websocket"
+	"mithril/wsclient"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Starts a server echoing one message per connection.
+//
+// Returns its address
+func echoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ws := websocket.NewConn(conn, nil, websocket.ServerRole)
+				var request []byte
+				for !bytes.HasSuffix(request, []byte("\r\n\r\n")) {
+					line, err := ws.Buffer.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					request = append(request, line...)
+				}
+				headers, err := ws.GetHTTPHeaders(request)
+				if err != nil {
+					return
+				}
+				ws.AcceptHandshake(headers["Sec-WebSocket-Key"], nil)
+				if messageType, data, err := ws.ReadMessage(); err == nil {
+					ws.WriteMessage(messageType, data)
+				}
+				ws.ReadMessage()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// Returns the value of a sample in the text exposition of registry.
+func sample(t *testing.T, registry *metrics.Registry, name string) string {
+	t.Helper()
+	var out bytes.Buffer
+	registry.WriteTo(&out)
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), name+" "); ok {
+			return value
+		}
+	}
+	t.Fatalf("no sample %s in\n%s", name, out.String())
+	return ""
+}
+
+// Two clients in one process keep their own settings, run with -race.
+func TestClientsKeepTheirSettings(t *testing.T) {
+	address := echoServer(t)
+	var logs [2]bytes.Buffer
+	var clients [2]*wsclient.Client
+	var registries [2]*metrics.Registry
+	for i := range clients {
+		registries[i] = metrics.NewRegistry([]string{"a", "b"}[i])
+		clients[i] = &wsclient.Client{
+			Logger:  slog.New(slog.NewTextHandler(&logs[i], &slog.HandlerOptions{Level: slog.LevelDebug})),
+			Metrics: registries[i],
+		}
+	}
+
+	// Client i opens i+1 connections
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		for n := 0; n <= i; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := client.ConnectURL("ws://"+address+"/ws", func(ws *wsclient.ClientWs) {
+					ws.WriteText("hello")
+					if _, data, err := ws.ReadMessage(); err != nil || string(data) != "hello" {
+						t.Errorf("echo %q, %v", data, err)
+					}
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	// slog handlers serialize their writes, the logs are read once every connection is done
+	for i, registry := range registries {
+		name := []string{"a", "b"}[i]
+		if got, want := sample(t, registry, name+"_handshakes_accepted_total"), []string{"1", "2"}[i]; got != want {
+			t.Errorf("client %d accepted %s handshakes, want %s", i, got, want)
+		}
+		if count := strings.Count(logs[i].String(), "handshake accepted"); count != i+1 {
+			t.Errorf("client %d logged %d handshakes, want %d", i, count, i+1)
+		}
+	}
+}
+
+// Starts a server answering every handshake with reply and closing the connection.
+//
+// Returns its address
+func replyServer(t *testing.T, reply string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Read the whole request, closing with unread data would reset the reply
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil || line == "\r\n" {
+						break
+					}
+				}
+				conn.Write([]byte(reply))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		reply      string
+		statusCode int
+		reason     string
+		header     string
+	}{
+		{"forbidden", "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n", 403, "status", ""},
+		{"unauthorized", "HTTP/1.1 401 Unauthorized\r\nWWW-Authenticate: Bearer\r\n\r\n", 401, "status", "WWW-Authenticate"},
+		{"too many requests", "HTTP/1.1 429 Too Many Requests\r\nRetry-After: 3\r\n\r\n", 429, "status", "Retry-After"},
+		{"full", "HTTP/1.1 503 Service Unavailable\r\nRetry-After: 5\r\n", 503, "status", "Retry-After"},
+		{"closed before the status line", "", 0, "aborted", ""},
+		{"garbage", "SSH-2.0-OpenSSH\r\n\r\n", 0, "status", ""},
+		{"closed during the headers", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n", 101, "aborted", ""},
+		{"wrong accept", "HTTP/1.1 101 Switching Protocols\r\nSec-WebSocket-Accept: wrong\r\n\r\n", 101, "accept", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := metrics.NewRegistry("test")
+			client := &wsclient.Client{Metrics: registry}
+			err := client.ConnectURL("ws://"+replyServer(t, test.reply)+"/ws", func(ws *wsclient.ClientWs) {
+				t.Error("handler called for a rejected handshake")
+			})
+			var handshakeError *wsclient.HandshakeError
+			if !errors.As(err, &handshakeError) {
+				t.Fatalf("got %v, want a *HandshakeError", err)
+			}
+			if handshakeError.StatusCode != test.statusCode || handshakeError.Reason != test.reason {
+				t.Errorf("got status %d and reason %q, want %d and %q", handshakeError.StatusCode, handshakeError.Reason, test.statusCode, test.reason)
+			}
+			if test.header != "" && handshakeError.Headers[test.header] == "" {
+				t.Errorf("no %s header in %v", test.header, handshakeError.Headers)
+			}
+			if got := sample(t, registry, `test_handshakes_rejected_total{reason="`+test.reason+`"}`); got != "1" {
+				t.Errorf("%s rejections counted", got)
+			}
+		})
+	}
+}
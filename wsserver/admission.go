@@ -0,0 +1,88 @@
+package wsserver
+
+// Connection limit of the server.
+
+import (
+	"math"
+	"mithril/websocket"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Retry-After sent when the server is full and RetryAfter is 0
+const defaultRetryAfter = 5 * time.Second
+
+// Applies MaxConnections to a client that sent its handshake request, making room
+// by shedding an idle client if allowed. Admitted clients count as handshaking
+// until finishHandshake.
+//
+// Returns false if the client was rejected with 503, its connection is closed then.
+func (srv *Server) admitConnection(ws *websocket.Ws) bool {
+	srv.ClientsMu.Lock()
+	if srv.MaxConnections <= 0 || len(srv.Clients)+srv.handshaking < srv.MaxConnections {
+		srv.handshaking++
+		srv.ClientsMu.Unlock()
+		return true
+	}
+	victim := srv.idlestClient()
+	if victim != nil {
+		// Removed right away so concurrent admissions don't pick it again
+		for i := range srv.Clients {
+			if srv.Clients[i] == victim {
+				srv.Clients[i] = srv.Clients[len(srv.Clients)-1]
+				srv.Clients = srv.Clients[:len(srv.Clients)-1]
+				break
+			}
+		}
+		srv.handshaking++
+	}
+	srv.ClientsMu.Unlock()
+
+	if victim != nil {
+		victim.Logger.Info("server full, closing idle client", "idle", time.Since(victim.LastActivity()).Round(time.Second))
+		victim.Close(1013, "Try again later.")
+		if srv.RateLimits != nil {
+			srv.RateLimits.release(victim)
+		}
+		return true
+	}
+
+	retryAfter := srv.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	headers := http.Header{"Retry-After": {strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))}}
+	ws.SendHTTPResponse("503", headers, "Server is full.")
+	ws.Logger.Info("server full, rejected client")
+	ws.Conn.Close()
+	return false
+}
+
+// Ends the handshake of an admitted client, adding it to Clients if it was accepted.
+func (srv *Server) finishHandshake(ws *websocket.Ws, accepted bool) {
+	srv.ClientsMu.Lock()
+	defer srv.ClientsMu.Unlock()
+	srv.handshaking--
+	if accepted {
+		srv.Clients = append(srv.Clients, ws)
+	}
+}
+
+// Returns the client that has been idle the longest, if it exceeds ShedIdleAfter (can be nil).
+//
+// Clients still in the handshake are not in Clients and never picked.
+// The caller must hold ClientsMu.
+func (srv *Server) idlestClient() *websocket.Ws {
+	if srv.ShedIdleAfter <= 0 {
+		return nil
+	}
+	var idlest *websocket.Ws
+	oldest := time.Now().Add(-srv.ShedIdleAfter)
+	for _, client := range srv.Clients {
+		if activity := client.LastActivity(); !activity.After(oldest) {
+			idlest, oldest = client, activity
+		}
+	}
+	return idlest
+}
@@ -0,0 +1,124 @@
+package wsserver
+
+import (
+	"errors"
+	"io"
+	"mithril/wsclient"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSilentConnectionsDoNotCount(t *testing.T) {
+	srv := NewServer("", "")
+	srv.MaxConnections = 2
+	srv.ShedIdleAfter = time.Nanosecond
+	srv.HandshakeTimeout = 200 * time.Millisecond
+	address := startServer(t, func(srv *Server) { srv.ListenAndServe(echoHandler, "/ws") }, srv)
+
+	var silent []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		silent = append(silent, conn)
+	}
+
+	// Full if the silent connections counted, the clients would get 503
+	for i := 0; i < 2; i++ {
+		var echo string
+		err := wsclient.ConnectURL("ws://"+address+"/ws", func(ws *wsclient.ClientWs) {
+			ws.WriteText("hello")
+			_, data, _ := ws.ReadMessage()
+			echo = string(data)
+		}, nil)
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		if echo != "hello" {
+			t.Fatalf("client %d received %q, want hello", i, echo)
+		}
+	}
+
+	// Dropped at the deadline, without a close frame from shedding
+	for _, conn := range silent {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		received, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(received) != 0 {
+			t.Fatalf("silent connection received %q", received)
+		}
+	}
+}
+
+func TestServerFull(t *testing.T) {
+	tests := []struct {
+		name          string
+		retryAfter    time.Duration
+		shedIdleAfter time.Duration
+		header        string
+	}{
+		{"default Retry-After", 0, 0, "5"},
+		{"rounded up", 1500 * time.Millisecond, 0, "2"},
+		// The connected client is not idle for long enough to be shed
+		{"no idle client", 0, time.Hour, "5"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := NewServer("", "")
+			srv.MaxConnections = 1
+			srv.RetryAfter = test.retryAfter
+			srv.ShedIdleAfter = test.shedIdleAfter
+			address := startServer(t, func(srv *Server) { srv.ListenAndServe(echoHandler, "/ws") }, srv)
+
+			first, _ := dialRaw(t, address)
+			_, _, response := handshakeRaw(t, address, "/ws", "")
+			if response.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("got %s, want 503", response.Status)
+			}
+			if got := response.Header.Get("Retry-After"); got != test.header {
+				t.Errorf("Retry-After %q, want %q", got, test.header)
+			}
+			err := wsclient.ConnectURL("ws://"+address+"/ws", func(ws *wsclient.ClientWs) {
+				t.Error("handler called while the server is full")
+			}, nil)
+			var handshakeError *wsclient.HandshakeError
+			if !errors.As(err, &handshakeError) || handshakeError.StatusCode != 503 {
+				t.Errorf("client got %v, want a 503 handshake error", err)
+			}
+
+			// Room again once the client left
+			first.Close()
+			waitClients(t, srv, 0)
+			dialRaw(t, address)
+		})
+	}
+}
+
+func TestShedIdleClient(t *testing.T) {
+	srv := NewServer("", "")
+	srv.MaxConnections = 1
+	srv.ShedIdleAfter = 50 * time.Millisecond
+	address := startServer(t, func(srv *Server) { srv.ListenAndServe(echoHandler, "/ws") }, srv)
+
+	_, idleReader := dialRaw(t, address)
+	time.Sleep(100 * time.Millisecond)
+	newest, newestReader := dialRaw(t, address)
+
+	if code := readCloseCode(t, idleReader); code != 1013 {
+		t.Fatalf("idle client closed with %d, want 1013", code)
+	}
+	waitClients(t, srv, 1)
+
+	// The new client is served, masked "a" with a zero key
+	newest.Write([]byte{0x81, 0x81, 0, 0, 0, 0, 'a'})
+	echo := make([]byte, 3)
+	if _, err := io.ReadFull(newestReader, echo); err != nil || string(echo) != "\x81\x01a" {
+		t.Fatalf("new client received %q, %v", echo, err)
+	}
+}
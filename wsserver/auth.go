@@ -0,0 +1,104 @@
+package wsserver
+
+// JWT bearer token authentication.
+
+import (
+	"errors"
+	"mithril/jwt"
+	"mithril/websocket"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Key of the verified claims on authenticated connections, see JWTClaims.
+const ClaimsKey = "jwt.claims"
+
+// Authenticates clients with JWT bearer tokens, set Server.CheckHandshake to its CheckHandshake.
+//
+// The token is taken from the Authorization header ("Bearer <token>"), from
+// Sec-WebSocket-Protocol ("bearer, <token>", for browsers, the server then selects
+// "bearer") or from the query parameter QueryParameter. Missing, invalid and expired
+// tokens are rejected with 401. Connections are closed with 1008 when their token expires.
+type JWTAuth struct {
+	Verifier *jwt.Verifier
+	// Query parameter carrying the token (empty disables it, URLs tend to end up in logs)
+	QueryParameter string
+}
+
+// Handshake hook, see Server.CheckHandshake.
+//
+// Returns the response headers and a error (can be nil)
+func (auth *JWTAuth) CheckHandshake(ws *websocket.Ws) (http.Header, error) {
+	token, responseHeaders := auth.token(ws)
+	if token == "" {
+		return nil, &HandshakeError{
+			Code:    "401",
+			Reason:  "Missing bearer token.",
+			Headers: http.Header{"WWW-Authenticate": {"Bearer"}},
+		}
+	}
+
+	claims, err := auth.Verifier.Verify(token)
+	if err != nil {
+		description := "invalid token"
+		if errors.Is(err, jwt.ErrExpired) {
+			description = "token expired"
+		}
+		return nil, &HandshakeError{
+			Code:    "401",
+			Reason:  "Invalid bearer token.",
+			Headers: http.Header{"WWW-Authenticate": {`Bearer error="invalid_token", error_description="` + description + `"`}},
+		}
+	}
+
+	ws.Set(ClaimsKey, claims)
+	if expires, ok := claims.ExpiresAt(); ok {
+		go auth.expire(ws, expires)
+	}
+	return responseHeaders, nil
+}
+
+// Finds the token of a handshake.
+//
+// Returns the token (empty if there is none) and the headers the response needs for it
+func (auth *JWTAuth) token(ws *websocket.Ws) (string, http.Header) {
+	if scheme, token, ok := strings.Cut(ws.Header("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token), nil
+	}
+
+	// Browsers can't set headers, the token is offered as a subprotocol after "bearer"
+	protocols := strings.Split(ws.Header("Sec-WebSocket-Protocol"), ",")
+	for i := 0; i < len(protocols)-1; i++ {
+		if strings.TrimSpace(protocols[i]) == "bearer" {
+			return strings.TrimSpace(protocols[i+1]), http.Header{"Sec-WebSocket-Protocol": {"bearer"}}
+		}
+	}
+
+	if auth.QueryParameter != "" {
+		return ws.Query.Get(auth.QueryParameter), nil
+	}
+	return "", nil
+}
+
+// Closes the connection with 1008 once its token expired.
+func (auth *JWTAuth) expire(ws *websocket.Ws, expires time.Time) {
+	now := time.Now()
+	if auth.Verifier.Now != nil {
+		now = auth.Verifier.Now()
+	}
+	timer := time.NewTimer(expires.Add(auth.Verifier.Leeway).Sub(now))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		ws.Close(1008, "Token expired.")
+	case <-ws.Context().Done():
+	}
+}
+
+// Returns the verified claims of a connection authenticated by JWTAuth (nil otherwise).
+func JWTClaims(ws *websocket.Ws) jwt.Claims {
+	claims, _ := websocket.Value[jwt.Claims](ws, ClaimsKey)
+	return claims
+}
@@ -0,0 +1,109 @@
+package wsserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"mithril/jwt"
+	"mithril/websocket"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("secret")
+
+// Creates a HS256 token signed with testSecret.
+func testToken(claims map[string]any) string {
+	encode := func(value any) string {
+		data, _ := json.Marshal(value)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encode(claims)
+	mac := hmac.New(sha256.New, testSecret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuth(t *testing.T) {
+	subjects := make(chan string, 10)
+	srv := NewServer("", "")
+	auth := &JWTAuth{Verifier: &jwt.Verifier{Keys: jwt.KeySet{"": testSecret}}, QueryParameter: "access_token"}
+	srv.CheckHandshake = auth.CheckHandshake
+	handler := srv.Handle(&Handlers{OnOpen: func(ws *websocket.Ws) { subjects <- JWTClaims(ws).Subject() }})
+	address := startServer(t, func(srv *Server) { srv.ListenAndServe(handler, "/ws") }, srv)
+
+	valid := testToken(map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	expired := testToken(map[string]any{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()})
+	tests := []struct {
+		name         string
+		target       string
+		headers      string
+		status       int
+		authenticate string
+		protocol     string
+	}{
+		{"authorization header", "/ws", "Authorization: Bearer " + valid + "\r\n", 101, "", ""},
+		{"subprotocol", "/ws", "Sec-WebSocket-Protocol: bearer, " + valid + "\r\n", 101, "", "bearer"},
+		{"query parameter", "/ws?access_token=" + valid, "", 101, "", ""},
+		{"missing", "/ws", "", 401, "Bearer", ""},
+		{"other scheme", "/ws", "Authorization: Basic YWxpY2U6c2VjcmV0\r\n", 401, "Bearer", ""},
+		{"bearer without token", "/ws", "Sec-WebSocket-Protocol: chat, bearer\r\n", 401, "Bearer", ""},
+		{"expired", "/ws", "Authorization: Bearer " + expired + "\r\n", 401, `Bearer error="invalid_token", error_description="token expired"`, ""},
+		{"bad signature", "/ws", "Authorization: Bearer " + expired[:strings.LastIndex(expired, ".")] + valid[strings.LastIndex(valid, "."):] + "\r\n", 401, `Bearer error="invalid_token", error_description="invalid token"`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, response := handshakeRaw(t, address, test.target, test.headers)
+			if response.StatusCode != test.status {
+				t.Fatalf("got %s, want %d", response.Status, test.status)
+			}
+			if got := response.Header.Get("WWW-Authenticate"); got != test.authenticate {
+				t.Errorf("WWW-Authenticate %q, want %q", got, test.authenticate)
+			}
+			if got := response.Header.Get("Sec-WebSocket-Protocol"); got != test.protocol {
+				t.Errorf("Sec-WebSocket-Protocol %q, want %q", got, test.protocol)
+			}
+			if test.status == http.StatusSwitchingProtocols {
+				if subject := receive(t, subjects); subject != "alice" {
+					t.Errorf("claims of %q, want alice", subject)
+				}
+			}
+		})
+	}
+}
+
+func TestJWTExpiresMidConnection(t *testing.T) {
+	srv := NewServer("", "")
+	// The clock runs 100 seconds ahead, a token expiring in 101 seconds has at most one left
+	verifier := &jwt.Verifier{Keys: jwt.KeySet{"": testSecret}, Now: func() time.Time { return time.Now().Add(100 * time.Second) }}
+	srv.CheckHandshake = (&JWTAuth{Verifier: verifier}).CheckHandshake
+	address := startServer(t, func(srv *Server) { srv.ListenAndServe(echoHandler, "/ws") }, srv)
+
+	token := testToken(map[string]any{"sub": "alice", "exp": time.Now().Add(101 * time.Second).Unix()})
+	_, reader, response := handshakeRaw(t, address, "/ws", "Authorization: Bearer "+token+"\r\n")
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %s", response.Status)
+	}
+	start := time.Now()
+	if code := readCloseCode(t, reader); code != 1008 {
+		t.Fatalf("closed with %d, want 1008", code)
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Errorf("closed after %v, the token had at most a second left", elapsed)
+	}
+}
+
+func TestJWTQueryParameterDisabled(t *testing.T) {
+	srv := NewServer("", "")
+	srv.CheckHandshake = (&JWTAuth{Verifier: &jwt.Verifier{Keys: jwt.KeySet{"": testSecret}}}).CheckHandshake
+	address := startServer(t, func(srv *Server) { srv.ListenAndServe(echoHandler, "/ws") }, srv)
+
+	token := testToken(map[string]any{"sub": "alice"})
+	_, _, response := handshakeRaw(t, address, "/ws?access_token="+token, "")
+	if response.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(response.Header.Get("WWW-Authenticate"), "Bearer") {
+		t.Fatalf("got %s with WWW-Authenticate %q, want 401", response.Status, response.Header.Get("WWW-Authenticate"))
+	}
+}
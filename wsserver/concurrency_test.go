@@ -0,0 +1,127 @@
+package wsserver
+
+import (
+	"bytes"
+	"fmt"
+	"mithril/websocket"
+	"mithril/wsclient"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Writes from many goroutines must reach the client as whole frames, run with -race.
+func TestConcurrentWrites(t *testing.T) {
+	opened := make(chan *websocket.Ws, 1)
+	srv := NewServer("", "")
+	var pongs atomic.Int64
+	handler := srv.Handle(&Handlers{
+		OnOpen: func(ws *websocket.Ws) { opened <- ws },
+		OnPong: func(ws *websocket.Ws, data []byte) { pongs.Add(1) },
+	})
+	address := startServer(t, func(srv *Server) { srv.ListenAndServe(handler, "/ws") }, srv)
+
+	type result struct {
+		// Data messages received per writer byte
+		counts map[byte]int
+		code   uint16
+		err    error
+	}
+	results := make(chan result, 1)
+	go wsclient.ConnectURL("ws://"+address+"/ws", func(ws *wsclient.ClientWs) {
+		counts := make(map[byte]int)
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				results <- result{counts: counts, err: err}
+				return
+			}
+			switch messageType {
+			case websocket.CloseMessage:
+				results <- result{counts: counts, code: uint16(data[0])<<8 | uint16(data[1])}
+				return
+			case websocket.BinaryMessage:
+				// Every message is one byte repeated, a torn frame mixes bytes or lengths
+				if len(data) == 0 || !bytes.Equal(data, bytes.Repeat(data[:1], len(data))) {
+					results <- result{counts: counts, err: fmt.Errorf("corrupted message of %d bytes", len(data))}
+					return
+				}
+				counts[data[0]]++
+			}
+		}
+	}, nil)
+	ws := receive(t, opened)
+
+	const writers, pings = 4, 200
+	var sent [writers]atomic.Int64
+	var broadcasts atomic.Int64
+	var wg sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Sizes cross the 126 and 65536 length encodings and the writev threshold
+			sizes := []int{1, 125, 126, 4095, 4096, 70000}
+			for i := 0; ; i++ {
+				payload := bytes.Repeat([]byte{byte('a' + writer)}, sizes[i%len(sizes)])
+				if _, err := ws.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+					return
+				}
+				sent[writer].Add(1)
+			}
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < pings; i++ {
+			ws.Ping("ping")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for !ws.IsClosed() {
+			srv.BroadcastToAll(bytes.Repeat([]byte{'B'}, 300))
+			broadcasts.Add(1)
+		}
+	}()
+
+	// Every writer gets going, and closing with pongs unread would make the kernel
+	// reset the connection and drop what the client has not read yet
+	busy := func() bool {
+		for writer := 0; writer < writers; writer++ {
+			if sent[writer].Load() == 0 {
+				return true
+			}
+		}
+		return broadcasts.Load() < 10 || pongs.Load() < pings
+	}
+	for deadline := time.Now().Add(3 * time.Second); busy() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if busy() {
+		t.Fatalf("writers stalled, %d broadcasts and %d pongs", broadcasts.Load(), pongs.Load())
+	}
+	// Broadcasts finished before Close were delivered
+	delivered := int(broadcasts.Load())
+	ws.Close(1001, "done")
+	wg.Wait()
+
+	received := receive(t, results)
+	if received.err != nil {
+		t.Fatal(received.err)
+	}
+	if received.code != 1001 {
+		t.Errorf("close code %d, want 1001", received.code)
+	}
+	// A write that returned nil was flushed before the close frame
+	for writer := 0; writer < writers; writer++ {
+		if got, want := received.counts[byte('a'+writer)], int(sent[writer].Load()); got != want {
+			t.Errorf("writer %d: received %d messages, sent %d", writer, got, want)
+		}
+	}
+	if received.counts['B'] < delivered {
+		t.Errorf("received %d broadcasts, want at least %d", received.counts['B'], delivered)
+	}
+}
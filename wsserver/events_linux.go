@@ -0,0 +1,209 @@
+//go:build linux
+
+package wsserver
+
+// Event loop server mode, one epoll instance watches every idle client.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"mithril/util"
+	"mithril/websocket"
+	"sync"
+	"syscall"
+)
+
+// Write buffer of event loop clients, larger frames skip it
+const eventWriteBuffer = 256
+
+// Read buffers lent to clients while they are readable
+var readerPool = sync.Pool{New: func() any { return bufio.NewReader(nil) }}
+
+// Clients of a server in event loop mode.
+type eventLoop struct {
+	server      *Server
+	handler     func(websocket *websocket.Ws, server *Server) (uint16, error)
+	routeString string
+	epfd        int
+
+	// Guards clients and nextID
+	mu      sync.Mutex
+	clients map[uint64]*eventClient
+	nextID  uint64
+}
+
+// Client registered in the event loop.
+type eventClient struct {
+	ws  *websocket.Ws
+	raw syscall.RawConn
+	// Key of the client in the epoll events, file descriptors are reused too quickly
+	id uint64
+	// Held while handling an event, orders the handlers of consecutive events
+	mu sync.Mutex
+}
+
+// Serves WebSockets over plain TCP from an epoll event loop (Linux only).
+//
+// Idle clients hold no goroutine and no read buffer, only their connection and
+// a small write buffer. When a client becomes readable the handler runs in a
+// new goroutine with a pooled read buffer, and again while buffered data is left.
+// The handler should read one message per call like with ListenAndServe.
+//
+// TLS is not supported, terminate it in front of the server (see Route.Backend).
+// On other systems this is ListenAndServe.
+func (srv *Server) ListenAndServeEvents(handler func(websocket *websocket.Ws, server *Server) (uint16, error), routeString string) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	util.OnError(err)
+	loop := &eventLoop{
+		server:      srv,
+		handler:     handler,
+		routeString: routeString,
+		epfd:        epfd,
+		clients:     make(map[uint64]*eventClient),
+	}
+	go loop.wait()
+
+	srv.listen()
+	defer srv.Listener.Close()
+	for {
+		connection, err := srv.Listener.Accept()
+		util.OnError(err)
+
+		// The reader is only attached while the client is readable
+		buffer := bufio.NewReadWriter(nil, bufio.NewWriterSize(connection, eventWriteBuffer))
+		ws := srv.newClient(connection, buffer)
+		go loop.open(ws)
+	}
+}
+
+// Runs the handshake, then registers the client.
+func (loop *eventLoop) open(ws *websocket.Ws) {
+	if !loop.server.upgrade(ws, loop.routeString) {
+		loop.server.removeClient(ws)
+		return
+	}
+
+	syscallConn, ok := ws.Conn.(syscall.Conn)
+	if !ok {
+		loop.server.closeWithError(ws, 1011, errors.New("connection has no file descriptor"))
+		loop.server.removeClient(ws)
+		loop.server.closed()
+		return
+	}
+	raw, err := syscallConn.SyscallConn()
+	if err != nil {
+		loop.server.closeWithError(ws, 1011, err)
+		loop.server.removeClient(ws)
+		loop.server.closed()
+		return
+	}
+
+	loop.mu.Lock()
+	client := &eventClient{ws: ws, raw: raw, id: loop.nextID}
+	loop.clients[client.id] = client
+	loop.nextID++
+	loop.mu.Unlock()
+	// Close cancels the context, also when the connection is closed outside the handler
+	// (idle shedding, token expiry, a failed broadcast), which gives no epoll event
+	context.AfterFunc(ws.Context(), func() { loop.forget(client) })
+
+	if err := loop.arm(client, syscall.EPOLL_CTL_ADD); err != nil {
+		loop.close(client, 1011, err)
+	}
+}
+
+// Asks for one readable event of the client.
+//
+// Returns a error (can be nil), also when the connection was closed
+func (loop *eventLoop) arm(client *eventClient, op int) error {
+	var armErr error
+	// Control keeps the descriptor from being closed and reused meanwhile
+	err := client.raw.Control(func(fd uintptr) {
+		event := syscall.EpollEvent{
+			Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+			Fd:     int32(client.id),
+			Pad:    int32(client.id >> 32),
+		}
+		armErr = syscall.EpollCtl(loop.epfd, op, int(fd), &event)
+	})
+	if err != nil {
+		return err
+	}
+	return armErr
+}
+
+// Waits for readable clients and starts their handlers.
+func (loop *eventLoop) wait() {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(loop.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		util.OnError(err)
+
+		for _, event := range events[:n] {
+			id := uint64(uint32(event.Fd)) | uint64(uint32(event.Pad))<<32
+			loop.mu.Lock()
+			client := loop.clients[id]
+			loop.mu.Unlock()
+			if client != nil {
+				go loop.handle(client)
+			}
+		}
+	}
+}
+
+// Runs the handler of a readable client, then waits for the next event.
+func (loop *eventLoop) handle(client *eventClient) {
+	ws := client.ws
+	client.mu.Lock()
+	reader := readerPool.Get().(*bufio.Reader)
+	reader.Reset(ws.Conn)
+	ws.Buffer.Reader = reader
+
+	var status uint16
+	var err error
+	for {
+		status, err = loop.handler(ws, loop.server)
+		ws.FinishMessage(err)
+		// epoll does not know about buffered data, so it is handled right away,
+		// unless the handler or the client closed the connection
+		if err != nil || ws.IsClosed() || reader.Buffered() == 0 {
+			break
+		}
+	}
+
+	ws.Buffer.Reader = nil
+	reader.Reset(nil)
+	readerPool.Put(reader)
+	client.mu.Unlock()
+
+	if err != nil {
+		loop.close(client, status, err)
+		return
+	}
+	// Fails once the connection was closed, which forgets the client
+	if err := loop.arm(client, syscall.EPOLL_CTL_MOD); err != nil {
+		client.ws.Close(1000, "")
+	}
+}
+
+// Closes a client after an error, which forgets it.
+func (loop *eventLoop) close(client *eventClient, status uint16, err error) {
+	loop.server.closeWithError(client.ws, status, err)
+}
+
+// Removes a closed client from the event loop and the server, once.
+func (loop *eventLoop) forget(client *eventClient) {
+	loop.mu.Lock()
+	_, ok := loop.clients[client.id]
+	delete(loop.clients, client.id)
+	loop.mu.Unlock()
+	if !ok {
+		return
+	}
+	loop.server.removeClient(client.ws)
+	loop.server.closed()
+}
@@ -0,0 +1,121 @@
+//go:build linux
+
+package wsserver
+
+import (
+	"mithril/websocket"
+	"mithril/wsclient"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestEventsForgetClosedClients(t *testing.T) {
+	opened := make(chan *websocket.Ws, 1)
+	srv := NewServer("", "")
+	srv.RateLimits = &RateLimits{MaxConnectionsPerIP: 1}
+	handler := srv.Handle(&Handlers{OnOpen: func(ws *websocket.Ws) { opened <- ws }})
+	address := startServer(t, func(srv *Server) { srv.ListenAndServeEvents(handler, "/ws") }, srv)
+
+	for i := 0; i < 3; i++ {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- wsclient.ConnectURL("ws://"+address+"/ws", func(ws *wsclient.ClientWs) {
+				for !ws.IsClosed() {
+					if _, _, err := ws.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}, nil)
+		}()
+		// Closed by the application, the event loop gets no epoll event for it
+		receive(t, opened).Close(1000, "")
+		if err := receive(t, errs); err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		waitClients(t, srv, 0)
+	}
+}
+
+// Returns the heap and stack memory in use after a garbage collection.
+func memoryInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse + stats.StackInuse
+}
+
+// Reports the memory each idle connection costs in goroutine and event loop mode.
+//
+// Both ends live in this process, the client sockets cost the same in both modes.
+func BenchmarkIdleConnections(b *testing.B) {
+	const clients = 1000
+	modes := []struct {
+		name  string
+		serve func(srv *Server)
+	}{
+		{"goroutines", func(srv *Server) { srv.ListenAndServe(echoHandler, "/ws") }},
+		{"events", func(srv *Server) { srv.ListenAndServeEvents(echoHandler, "/ws") }},
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			srv := NewServer("", "")
+			address := startServer(b, mode.serve, srv)
+			conns := make([]net.Conn, 0, clients)
+
+			var total uint64
+			for i := 0; i < b.N; i++ {
+				before := memoryInUse()
+				for len(conns) < clients {
+					conn, _ := dialRaw(b, address)
+					conns = append(conns, conn)
+				}
+				waitClients(b, srv, clients)
+				total += memoryInUse() - before
+
+				for _, conn := range conns {
+					conn.Close()
+				}
+				conns = conns[:0]
+				waitClients(b, srv, 0)
+			}
+			b.ReportMetric(float64(total)/float64(b.N*clients), "bytes/conn")
+		})
+	}
+}
+
+func TestEventsStopAfterClose(t *testing.T) {
+	srv := NewServer("", "")
+	messages, closes := make(chan string, 10), make(chan uint16, 10)
+	handler := srv.Handle(&Handlers{
+		OnMessage: func(ws *websocket.Ws, messageType websocket.MessageType, data []byte) {
+			messages <- string(data)
+			ws.Close(1000, "")
+		},
+		OnClose: func(ws *websocket.Ws, code uint16, reason string) { closes <- code },
+	})
+	address := startServer(t, func(srv *Server) { srv.ListenAndServeEvents(handler, "/ws") }, srv)
+
+	conn, _ := dialRaw(t, address)
+	defer conn.Close()
+	// Three masked text frames in one TCP write
+	var frames []byte
+	for _, text := range []string{"a", "b", "c"} {
+		frames = append(frames, 0x81, 0x81, 0, 0, 0, 0, text[0])
+	}
+	conn.Write(frames)
+
+	if got := receive(t, messages); got != "a" {
+		t.Fatalf("first message %q", got)
+	}
+	receive(t, closes)
+	waitClients(t, srv, 0)
+	select {
+	case got := <-messages:
+		t.Fatalf("OnMessage called with %q after Close", got)
+	case <-closes:
+		t.Fatal("OnClose called twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package wsserver
+
+import "mithril/websocket"
+
+// Serves WebSockets over plain TCP, the event loop needs epoll.
+//
+// Without Linux this is ListenAndServe.
+func (srv *Server) ListenAndServeEvents(handler func(websocket *websocket.Ws, server *Server) (uint16, error), routeString string) {
+	srv.ListenAndServe(handler, routeString)
+}
@@ -0,0 +1,97 @@
+package wsserver
+
+// Callback based alternative to handler functions.
+
+import (
+	"errors"
+	"io"
+	"mithril/util"
+	"mithril/websocket"
+)
+
+// Callbacks of a server that owns the read loop, each of them can be nil.
+//
+// Use Server.Handle to turn them into a handler for the ListenAndServe methods.
+type Handlers struct {
+	// Called after the handshake, before the first message is read
+	OnOpen func(ws *websocket.Ws)
+	// Called for every text and binary message, ws.MessageContext() carries its trace
+	OnMessage func(ws *websocket.Ws, messageType websocket.MessageType, data []byte)
+	// Called for pings, the pong has already been sent
+	OnPing func(ws *websocket.Ws, data []byte)
+	// Called for pongs
+	OnPong func(ws *websocket.Ws, data []byte)
+	// Called once when the connection closes, with the code sent by either side.
+	// A connection dropped without a close frame reports 1006.
+	OnClose func(ws *websocket.Ws, code uint16, reason string)
+	// Called for read errors and protocol violations, before OnClose
+	OnError func(ws *websocket.Ws, err error)
+}
+
+// Returns a handler that reads messages and calls handlers, for the ListenAndServe methods.
+//
+// OnOpen is registered on the server, a server serves one set of Handlers.
+func (srv *Server) Handle(handlers *Handlers) func(websocket *websocket.Ws, server *Server) (uint16, error) {
+	srv.onOpen = handlers.OnOpen
+	return handlers.handle
+}
+
+// Reads one message and dispatches it.
+//
+// Returns the close code and a error (can be nil)
+func (handlers *Handlers) handle(ws *websocket.Ws, srv *Server) (uint16, error) {
+	messageType, data, err := ws.ReadMessage()
+	if err != nil {
+		// Protocol violations were answered with a close frame, anything else dropped the connection
+		var code uint16 = 1006
+		var reason string
+		var protocolError *util.ProtocolError
+		if errors.As(err, &protocolError) {
+			code, reason = protocolError.Code, protocolError.Reason
+		} else if ws.IsClosed() {
+			// Closed from another goroutine while reading
+			code, reason = ws.CloseStatus()
+			handlers.close(ws, code, reason)
+			return code, err
+		}
+		if handlers.OnError != nil && !errors.Is(err, io.EOF) {
+			handlers.OnError(ws, err)
+		}
+		handlers.close(ws, code, reason)
+		return code, err
+	}
+
+	switch messageType {
+	case websocket.TextMessage, websocket.BinaryMessage:
+		if handlers.OnMessage != nil {
+			handlers.OnMessage(ws, messageType, data)
+		}
+	case websocket.PingMessage:
+		if handlers.OnPing != nil {
+			handlers.OnPing(ws, data)
+		}
+	case websocket.PongMessage:
+		if handlers.OnPong != nil {
+			handlers.OnPong(ws, data)
+		}
+	case websocket.CloseMessage:
+		// Already validated and echoed by ReadMessage
+		code, reason, _ := util.ValidateClosePayload(data, false)
+		handlers.close(ws, code, reason)
+		return code, nil
+	}
+
+	// Closed by a callback
+	if ws.IsClosed() {
+		code, reason := ws.CloseStatus()
+		handlers.close(ws, code, reason)
+	}
+	return 1000, nil
+}
+
+// Calls OnClose.
+func (handlers *Handlers) close(ws *websocket.Ws, code uint16, reason string) {
+	if handlers.OnClose != nil {
+		handlers.OnClose(ws, code, reason)
+	}
+}
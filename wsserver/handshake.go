@@ -0,0 +1,46 @@
+package wsserver
+
+// Hook for accepting or rejecting handshakes.
+
+import (
+	"errors"
+	"mithril/util"
+	"mithril/websocket"
+	"net/http"
+)
+
+// Rejection of a handshake, returned by Server.CheckHandshake.
+type HandshakeError struct {
+	// HTTP status code, see util.HttpErrorCodes
+	Code string
+	// Body of the response
+	Reason string
+	// Extra response headers, for example WWW-Authenticate (can be nil)
+	Headers http.Header
+}
+
+func (err *HandshakeError) Error() string {
+	return err.Code + " " + util.HttpErrorCodes[err.Code] + ": " + err.Reason
+}
+
+// Runs CheckHandshake and answers rejected clients.
+//
+// Returns the headers for the 101 response and false if the client was rejected.
+func (srv *Server) checkHandshake(ws *websocket.Ws) (http.Header, bool) {
+	if srv.CheckHandshake == nil {
+		return nil, true
+	}
+	headers, err := srv.CheckHandshake(ws)
+	if err == nil {
+		return headers, true
+	}
+
+	var handshakeError *HandshakeError
+	if !errors.As(err, &handshakeError) {
+		handshakeError = &HandshakeError{Code: "403", Reason: err.Error()}
+	}
+	ws.SendHTTPResponse(handshakeError.Code, handshakeError.Headers, handshakeError.Reason)
+	ws.Logger.Info("handshake rejected", "status", handshakeError.Code, "error", err)
+	ws.Conn.Close()
+	return nil, false
+}
@@ -0,0 +1,41 @@
+package wsserver
+
+// Hooks for counting handshakes and connections, see mithril/metrics for a Prometheus implementation.
+
+import "mithril/websocket"
+
+// Receives the events of a server and the traffic of its clients.
+//
+// The methods are called from the goroutines of every client, so they must be
+// safe for concurrent use and must not block.
+type Metrics interface {
+	websocket.Metrics
+	// A client completed the handshake, it stays open until ConnectionClosed
+	HandshakeAccepted()
+	// A client was turned away before the handshake completed, reason is a short
+	// label such as "origin", "rate_limit" or "capacity"
+	HandshakeRejected(reason string)
+	// An accepted client was removed from the server
+	ConnectionClosed()
+}
+
+// Records a rejected handshake.
+func (srv *Server) rejected(reason string) {
+	if srv.Metrics != nil {
+		srv.Metrics.HandshakeRejected(reason)
+	}
+}
+
+// Records an accepted handshake.
+func (srv *Server) accepted() {
+	if srv.Metrics != nil {
+		srv.Metrics.HandshakeAccepted()
+	}
+}
+
+// Records the removal of an accepted client.
+func (srv *Server) closed() {
+	if srv.Metrics != nil {
+		srv.Metrics.ConnectionClosed()
+	}
+}
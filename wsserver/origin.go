@@ -0,0 +1,80 @@
+package wsserver
+
+// Origin policy against cross-site WebSocket hijacking.
+
+import (
+	"mithril/websocket"
+	"net/url"
+	"strings"
+)
+
+// Applies the origin policy.
+//
+// Returns false if the client was rejected with 403, its connection is closed then.
+func (srv *Server) checkOrigin(ws *websocket.Ws) bool {
+	origin := ws.Header("Origin")
+	var allowed bool
+	if srv.CheckOrigin != nil {
+		allowed = srv.CheckOrigin(ws, origin)
+	} else {
+		allowed = srv.allowedOrigin(ws, origin)
+	}
+	if allowed {
+		return true
+	}
+
+	ws.SendHTTPError("403", "Origin not allowed.")
+	ws.Logger.Info("rejected origin", "origin", origin)
+	ws.Conn.Close()
+	return false
+}
+
+// Default policy: AllowedOrigins, or the origin of the Host header when it is empty.
+func (srv *Server) allowedOrigin(ws *websocket.Ws, origin string) bool {
+	// Browsers always send an Origin, other clients can't be hijacked
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host == "" {
+		// Includes "null" from sandboxed pages and local files
+		return len(srv.AllowedOrigins) == 1 && srv.AllowedOrigins[0] == "*"
+	}
+
+	if len(srv.AllowedOrigins) == 0 {
+		return strings.EqualFold(parsed.Host, ws.Header("Host"))
+	}
+	for _, pattern := range srv.AllowedOrigins {
+		if matchOrigin(pattern, parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches an origin against "*", "https://example.com", "https://*.example.com"
+// or patterns without a scheme like "*.example.com", which allow any scheme.
+// Wildcard patterns without a port allow any port.
+func matchOrigin(pattern string, origin *url.URL) bool {
+	if pattern == "*" {
+		return true
+	}
+	scheme, host, found := strings.Cut(pattern, "://")
+	if !found {
+		scheme, host = "", pattern
+	}
+	if scheme != "" && !strings.EqualFold(scheme, origin.Scheme) {
+		return false
+	}
+
+	// Subdomains only, not the domain itself
+	if suffix, ok := strings.CutPrefix(host, "*."); ok {
+		originHost := origin.Hostname()
+		if strings.Contains(suffix, ":") {
+			originHost = origin.Host
+		}
+		suffix = "." + strings.ToLower(suffix)
+		return len(originHost) > len(suffix) && strings.HasSuffix(strings.ToLower(originHost), suffix)
+	}
+	return strings.EqualFold(host, origin.Host)
+}
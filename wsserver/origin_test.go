@@ -0,0 +1,46 @@
+package wsserver
+
+import (
+	"mithril/websocket"
+	"testing"
+)
+
+func TestAllowedOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{name: "no origin", allowed: []string{"https://example.com"}, origin: "", want: true},
+		{name: "same host", origin: "https://example.com", want: true},
+		{name: "same host other port", origin: "https://example.com:8443", want: false},
+		{name: "other host", origin: "https://evil.com", want: false},
+		{name: "null", allowed: []string{"https://example.com"}, origin: "null", want: false},
+		{name: "null with any origin", allowed: []string{"*"}, origin: "null", want: true},
+		{name: "exact", allowed: []string{"https://example.com"}, origin: "https://example.com", want: true},
+		{name: "exact other scheme", allowed: []string{"https://example.com"}, origin: "http://example.com", want: false},
+		{name: "exact other port", allowed: []string{"https://example.com"}, origin: "https://example.com:8443", want: false},
+		{name: "exact with port", allowed: []string{"https://example.com:8443"}, origin: "https://example.com:8443", want: true},
+		{name: "subdomain", allowed: []string{"https://*.example.com"}, origin: "https://a.example.com", want: true},
+		{name: "nested subdomain", allowed: []string{"*.example.com"}, origin: "http://a.b.example.com", want: true},
+		{name: "subdomain with port", allowed: []string{"*.example.com"}, origin: "https://a.example.com:8443", want: true},
+		{name: "subdomain with the port of the pattern", allowed: []string{"*.example.com:8443"}, origin: "https://a.example.com:8443", want: true},
+		{name: "subdomain with another port", allowed: []string{"*.example.com:8443"}, origin: "https://a.example.com:9443", want: false},
+		{name: "wildcard excludes the domain", allowed: []string{"*.example.com"}, origin: "https://example.com", want: false},
+		{name: "empty label", allowed: []string{"*.example.com"}, origin: "https://.example.com", want: false},
+		{name: "suffix without a dot", allowed: []string{"*.example.com"}, origin: "https://evilexample.com", want: false},
+		{name: "suffix in the path", allowed: []string{"*.example.com"}, origin: "https://evil.com/.example.com", want: false},
+		{name: "suffix in the userinfo", allowed: []string{"*.example.com"}, origin: "https://a.example.com@evil.com", want: false},
+		{name: "case", allowed: []string{"https://*.Example.com"}, origin: "HTTPS://A.EXAMPLE.COM", want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := &Server{AllowedOrigins: test.allowed}
+			ws := &websocket.Ws{Headers: map[string]string{"Host": "example.com"}}
+			if got := srv.allowedOrigin(ws, test.origin); got != test.want {
+				t.Errorf("allowedOrigin(%q) = %v, want %v", test.origin, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package wsserver
+
+// Token bucket rate limits for handshakes, connections and messages.
+
+import (
+	"math"
+	"mithril/util"
+	"mithril/websocket"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What happens to a message over the rate limit.
+type LimitAction byte
+
+const (
+	// Waits until the message fits the limit, reading from the client stops meanwhile
+	DelayMessage LimitAction = iota
+	// Drops the message
+	DropMessage
+	// Closes the connection with 1008
+	CloseConnection
+)
+
+// Rate limits of a server, see Server.RateLimits. Zero rates and counts disable a limit.
+//
+// Bursts of 0 are the same as the rate. ByteBurst should be at least the largest
+// message, larger ones are only let through by DelayMessage.
+type RateLimits struct {
+	// Handshakes per second per remote IP, the rest get 429
+	HandshakeRate  float64
+	HandshakeBurst int
+	// Open connections per remote IP, the rest get 429
+	MaxConnectionsPerIP int
+	// Received messages and bytes per second per connection
+	MessageRate  float64
+	MessageBurst int
+	ByteRate     float64
+	ByteBurst    int
+	// What happens to messages over the limit
+	MessageAction LimitAction
+
+	// Guards the fields below
+	mu          sync.Mutex
+	handshakes  map[string]*tokenBucket
+	connections map[string]int
+	// Remote IP of every counted connection
+	counted   map[*websocket.Ws]string
+	lastSweep time.Time
+
+	handshakesRejected  atomic.Uint64
+	connectionsRejected atomic.Uint64
+	messagesDelayed     atomic.Uint64
+	messagesDropped     atomic.Uint64
+	connectionsClosed   atomic.Uint64
+}
+
+// Amount of times each limit was hit.
+type LimitHits struct {
+	HandshakesRejected  uint64
+	ConnectionsRejected uint64
+	MessagesDelayed     uint64
+	MessagesDropped     uint64
+	ConnectionsClosed   uint64
+}
+
+// Returns how often the limits were hit so far.
+func (limits *RateLimits) Hits() LimitHits {
+	return LimitHits{
+		HandshakesRejected:  limits.handshakesRejected.Load(),
+		ConnectionsRejected: limits.connectionsRejected.Load(),
+		MessagesDelayed:     limits.messagesDelayed.Load(),
+		MessagesDropped:     limits.messagesDropped.Load(),
+		ConnectionsClosed:   limits.connectionsClosed.Load(),
+	}
+}
+
+// Token bucket, not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Creates a full bucket, a burst of 0 is the same as the rate.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	size := float64(burst)
+	if burst <= 0 {
+		size = math.Max(rate, 1)
+	}
+	return &tokenBucket{rate: rate, burst: size, tokens: size, last: time.Now()}
+}
+
+// Adds the tokens earned since the last call.
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+}
+
+// Returns the time until n tokens are available, 0 if they are.
+func (bucket *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	bucket.refill(now)
+	if bucket.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+// Takes n tokens, going into debt if there aren't enough.
+func (bucket *tokenBucket) take(n float64) {
+	bucket.tokens -= n
+}
+
+// Returns the IP address of a client.
+func remoteIP(ws *websocket.Ws) string {
+	host, _, err := net.SplitHostPort(ws.RemoteAddr().String())
+	if err != nil {
+		return ws.RemoteAddr().String()
+	}
+	return host
+}
+
+// Applies the handshake and connection limits to a new client.
+//
+// Returns false if the client was rejected with 429, its connection is closed then.
+func (limits *RateLimits) admit(ws *websocket.Ws) bool {
+	ip := remoteIP(ws)
+	now := time.Now()
+
+	limits.mu.Lock()
+	if limits.handshakes == nil {
+		limits.handshakes = make(map[string]*tokenBucket)
+		limits.connections = make(map[string]int)
+		limits.counted = make(map[*websocket.Ws]string)
+	}
+	limits.sweep(now)
+
+	var retryAfter time.Duration
+	if limits.HandshakeRate > 0 {
+		bucket, ok := limits.handshakes[ip]
+		if !ok {
+			bucket = newTokenBucket(limits.HandshakeRate, limits.HandshakeBurst)
+			limits.handshakes[ip] = bucket
+		}
+		retryAfter = bucket.wait(1, now)
+		if retryAfter == 0 {
+			bucket.take(1)
+		} else {
+			limits.handshakesRejected.Add(1)
+		}
+	}
+	full := limits.MaxConnectionsPerIP > 0 && limits.connections[ip] >= limits.MaxConnectionsPerIP
+	if full {
+		limits.connectionsRejected.Add(1)
+	}
+	if retryAfter == 0 && !full {
+		limits.connections[ip]++
+		limits.counted[ws] = ip
+	}
+	limits.mu.Unlock()
+
+	if retryAfter == 0 && !full {
+		return true
+	}
+	headers := http.Header{}
+	if retryAfter > 0 {
+		headers.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	ws.SendHTTPResponse("429", headers, "Too many connections from "+ip+".")
+	ws.Logger.Info("rate limited", "handshake", retryAfter > 0, "connections", full)
+	ws.Conn.Close()
+	return false
+}
+
+// Forgets handshake buckets that are full again, the caller must hold mu.
+func (limits *RateLimits) sweep(now time.Time) {
+	if now.Sub(limits.lastSweep) < time.Minute {
+		return
+	}
+	limits.lastSweep = now
+	for ip, bucket := range limits.handshakes {
+		if bucket.wait(bucket.burst, now) == 0 {
+			delete(limits.handshakes, ip)
+		}
+	}
+}
+
+// Stops counting a connection, calling it again does nothing.
+func (limits *RateLimits) release(ws *websocket.Ws) {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	ip, ok := limits.counted[ws]
+	if !ok {
+		return
+	}
+	delete(limits.counted, ws)
+	limits.connections[ip]--
+	if limits.connections[ip] == 0 {
+		delete(limits.connections, ip)
+	}
+}
+
+// Returns the message limiter for a new connection (nil without message limits).
+func (limits *RateLimits) limiter() websocket.MessageLimiter {
+	if limits.MessageRate <= 0 && limits.ByteRate <= 0 {
+		return nil
+	}
+	limiter := &connectionLimiter{limits: limits}
+	if limits.MessageRate > 0 {
+		limiter.messages = newTokenBucket(limits.MessageRate, limits.MessageBurst)
+	}
+	if limits.ByteRate > 0 {
+		limiter.bytes = newTokenBucket(limits.ByteRate, limits.ByteBurst)
+	}
+	return limiter
+}
+
+// Message and byte limits of one connection, only used by its reader.
+type connectionLimiter struct {
+	limits   *RateLimits
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+// Applies the message action, see websocket.MessageLimiter.
+func (limiter *connectionLimiter) Allow(ws *websocket.Ws, size int) error {
+	now := time.Now()
+	var wait time.Duration
+	if limiter.messages != nil {
+		wait = limiter.messages.wait(1, now)
+	}
+	if limiter.bytes != nil {
+		wait = max(wait, limiter.bytes.wait(math.Min(float64(size), limiter.bytes.burst), now))
+	}
+
+	if wait > 0 {
+		switch limiter.limits.MessageAction {
+		case DropMessage:
+			limiter.limits.messagesDropped.Add(1)
+			return websocket.ErrDropMessage
+		case CloseConnection:
+			limiter.limits.connectionsClosed.Add(1)
+			return &util.ProtocolError{Code: 1008, Reason: "rate limit exceeded"}
+		}
+
+		limiter.limits.messagesDelayed.Add(1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ws.Context().Done():
+			timer.Stop()
+		}
+	}
+
+	if limiter.messages != nil {
+		limiter.messages.take(1)
+	}
+	if limiter.bytes != nil {
+		limiter.bytes.take(float64(size))
+	}
+	return nil
+}
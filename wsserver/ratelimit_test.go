@@ -0,0 +1,226 @@
+package wsserver
+
+import (
+	"errors"
+	"mithril/websocket"
+	"mithril/wsclient"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Metrics counting dropped messages by reason, the other events are ignored.
+type droppedMetrics struct {
+	mu      sync.Mutex
+	dropped map[string]int
+}
+
+func (metrics *droppedMetrics) MessageDropped(reason string) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.dropped == nil {
+		metrics.dropped = make(map[string]int)
+	}
+	metrics.dropped[reason]++
+}
+
+// Returns how many messages were dropped for reason.
+func (metrics *droppedMetrics) count(reason string) int {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	return metrics.dropped[reason]
+}
+
+func (*droppedMetrics) MessageReceived(websocket.MessageType, int) {}
+func (*droppedMetrics) MessageSent(websocket.MessageType, int)     {}
+func (*droppedMetrics) PingRTT(time.Duration)                      {}
+func (*droppedMetrics) CloseSent(uint16)                           {}
+func (*droppedMetrics) WriteQueued(int)                            {}
+func (*droppedMetrics) HandshakeAccepted()                         {}
+func (*droppedMetrics) HandshakeRejected(string)                   {}
+func (*droppedMetrics) ConnectionClosed()                          {}
+
+// Encodes masked text frames with a zero key, one per text.
+func textFrames(texts ...string) []byte {
+	var frames []byte
+	for _, text := range texts {
+		frames = append(frames, 0x81, 0x80|byte(len(text)), 0, 0, 0, 0)
+		frames = append(frames, text...)
+	}
+	return frames
+}
+
+// Starts a server with limits that passes every received message to the returned channel.
+//
+// Returns its address and the channel
+func limitedServer(t *testing.T, srv *Server, limits *RateLimits) (string, <-chan string) {
+	t.Helper()
+	messages := make(chan string, 10)
+	srv.RateLimits = limits
+	handler := srv.Handle(&Handlers{OnMessage: func(ws *websocket.Ws, messageType websocket.MessageType, data []byte) {
+		messages <- string(data)
+	}})
+	return startServer(t, func(srv *Server) { srv.ListenAndServe(handler, "/ws") }, srv), messages
+}
+
+// Fails the test if a message arrives within a short time.
+func expectNoMessage(t *testing.T, messages <-chan string) {
+	t.Helper()
+	select {
+	case message := <-messages:
+		t.Fatalf("received %q", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHandshakeRate(t *testing.T) {
+	limits := &RateLimits{HandshakeRate: 0.5, HandshakeBurst: 2}
+	address, _ := limitedServer(t, NewServer("", ""), limits)
+
+	dialRaw(t, address)
+	dialRaw(t, address)
+	_, _, response := handshakeRaw(t, address, "/ws", "")
+	if response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got %s, want 429", response.Status)
+	}
+	// One token takes two seconds
+	if got := response.Header.Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After %q, want 2", got)
+	}
+	err := wsclient.ConnectURL("ws://"+address+"/ws", func(ws *wsclient.ClientWs) {}, nil)
+	var handshakeError *wsclient.HandshakeError
+	if !errors.As(err, &handshakeError) || handshakeError.StatusCode != 429 || handshakeError.Headers["Retry-After"] == "" {
+		t.Errorf("client got %v, want a 429 handshake error with Retry-After", err)
+	}
+	if hits := limits.Hits(); hits != (LimitHits{HandshakesRejected: 2}) {
+		t.Errorf("hits %+v", hits)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	srv := NewServer("", "")
+	limits := &RateLimits{MaxConnectionsPerIP: 1}
+	address, _ := limitedServer(t, srv, limits)
+
+	first, _ := dialRaw(t, address)
+	_, _, response := handshakeRaw(t, address, "/ws", "")
+	if response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got %s, want 429", response.Status)
+	}
+	// Waiting doesn't help, only a client leaving does
+	if got := response.Header.Get("Retry-After"); got != "" {
+		t.Errorf("Retry-After %q", got)
+	}
+	if hits := limits.Hits(); hits != (LimitHits{ConnectionsRejected: 1}) {
+		t.Errorf("hits %+v", hits)
+	}
+
+	first.Close()
+	waitClients(t, srv, 0)
+	dialRaw(t, address)
+}
+
+func TestMaxConnectionsPerIPReleasesShedClients(t *testing.T) {
+	srv := NewServer("", "")
+	srv.MaxConnections = 1
+	srv.ShedIdleAfter = 20 * time.Millisecond
+	limits := &RateLimits{MaxConnectionsPerIP: 2}
+	address, _ := limitedServer(t, srv, limits)
+
+	// Each client sheds the one before, still counting it would reach the limit of 2
+	for i := 0; i < 3; i++ {
+		dialRaw(t, address)
+		waitClients(t, srv, 1)
+		time.Sleep(40 * time.Millisecond)
+	}
+	if hits := limits.Hits(); hits != (LimitHits{}) {
+		t.Errorf("hits %+v", hits)
+	}
+}
+
+func TestMessageLimits(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		srv := NewServer("", "")
+		metrics := &droppedMetrics{}
+		srv.Metrics = metrics
+		limits := &RateLimits{MessageRate: 20, MessageBurst: 2, MessageAction: DropMessage}
+		address, messages := limitedServer(t, srv, limits)
+		conn, _ := dialRaw(t, address)
+
+		conn.Write(textFrames("a", "b", "c", "d"))
+		for _, want := range []string{"a", "b"} {
+			if got := receive(t, messages); got != want {
+				t.Fatalf("received %q, want %q", got, want)
+			}
+		}
+		expectNoMessage(t, messages)
+		// Refilled, the next message is the first one after the dropped ones
+		time.Sleep(100 * time.Millisecond)
+		conn.Write(textFrames("e"))
+		if got := receive(t, messages); got != "e" {
+			t.Fatalf("received %q, want e", got)
+		}
+		if hits := limits.Hits(); hits != (LimitHits{MessagesDropped: 2}) {
+			t.Errorf("hits %+v", hits)
+		}
+		if got := metrics.count("rate_limit"); got != 2 {
+			t.Errorf("%d drops counted, want 2", got)
+		}
+	})
+
+	t.Run("drop bytes", func(t *testing.T) {
+		limits := &RateLimits{ByteRate: 1, ByteBurst: 10, MessageAction: DropMessage}
+		address, messages := limitedServer(t, NewServer("", ""), limits)
+		conn, _ := dialRaw(t, address)
+
+		conn.Write(textFrames("12345678", "12345678", "12"))
+		for _, want := range []string{"12345678", "12"} {
+			if got := receive(t, messages); got != want {
+				t.Fatalf("received %q, want %q", got, want)
+			}
+		}
+		if hits := limits.Hits(); hits != (LimitHits{MessagesDropped: 1}) {
+			t.Errorf("hits %+v", hits)
+		}
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		limits := &RateLimits{MessageRate: 10, MessageBurst: 1, MessageAction: DelayMessage}
+		address, messages := limitedServer(t, NewServer("", ""), limits)
+		conn, _ := dialRaw(t, address)
+
+		start := time.Now()
+		conn.Write(textFrames("a", "b", "c"))
+		for _, want := range []string{"a", "b", "c"} {
+			if got := receive(t, messages); got != want {
+				t.Fatalf("received %q, want %q", got, want)
+			}
+		}
+		// Two messages waited for a token, 100 ms each
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Errorf("three messages took %v at 10 per second", elapsed)
+		}
+		if hits := limits.Hits(); hits != (LimitHits{MessagesDelayed: 2}) {
+			t.Errorf("hits %+v", hits)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		limits := &RateLimits{MessageRate: 10, MessageBurst: 1, MessageAction: CloseConnection}
+		address, messages := limitedServer(t, NewServer("", ""), limits)
+		conn, reader := dialRaw(t, address)
+
+		conn.Write(textFrames("a", "b"))
+		if got := receive(t, messages); got != "a" {
+			t.Fatalf("received %q, want a", got)
+		}
+		if code := readCloseCode(t, reader); code != 1008 {
+			t.Fatalf("closed with %d, want 1008", code)
+		}
+		expectNoMessage(t, messages)
+		if hits := limits.Hits(); hits != (LimitHits{ConnectionsClosed: 1}) {
+			t.Errorf("hits %+v", hits)
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package wsserver
+
+// Routing of incoming TLS connections by their ClientHello.
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	mtls "mithril/tls"
+	"mithril/util"
+	"mithril/websocket"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What happens to a connection whose ClientHello matched.
+type Route struct {
+	// Terminates TLS with this config and serves WebSockets.
+	TLSConfig *tls.Config
+	// Forwards the raw TCP stream, TLS included, to this address instead.
+	Backend string
+}
+
+// Picks a Route for each connection based on SNI, ALPN and supported versions.
+type Router struct {
+	// Routes by server name, a leading "*." matches any single subdomain.
+	ServerNames map[string]*Route
+	// Routes by ALPN protocol, checked when no server name matched.
+	Protocols map[string]*Route
+	// Used when nothing else matched (can be nil, the connection is then dropped).
+	Default *Route
+	// Overrides the maps above when set, returning nil drops the connection.
+	Select func(info *mtls.ClientHelloInfo) *Route
+	// Time allowed for the client to send its ClientHello (defaults to 10 seconds).
+	HelloTimeout time.Duration
+	// Logger for routing failures (nil logs nothing, servers set their own).
+	Logger *slog.Logger
+}
+
+// Returns the route for a ClientHello (can be nil).
+func (router *Router) route(info *mtls.ClientHelloInfo) *Route {
+	if router.Select != nil {
+		return router.Select(info)
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(info.ServerName, "."))
+	if route, ok := router.ServerNames[name]; ok {
+		return route
+	}
+	if index := strings.IndexByte(name, '.'); index != -1 {
+		if route, ok := router.ServerNames["*"+name[index:]]; ok {
+			return route
+		}
+	}
+	for _, protocol := range info.ALPNProtocols {
+		if route, ok := router.Protocols[protocol]; ok {
+			return route
+		}
+	}
+	return router.Default
+}
+
+// Wraps a listener so that Accept only returns connections routed to this server.
+//
+// Connections routed to a backend are proxied in the background.
+func (router *Router) Listener(inner net.Listener) net.Listener {
+	listener := &routingListener{
+		Listener: inner,
+		router:   router,
+		accepted: make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	go listener.acceptLoop()
+	return listener
+}
+
+type routingListener struct {
+	net.Listener
+	router    *Router
+	accepted  chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func (listener *routingListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.accepted:
+		return conn, nil
+	case <-listener.closed:
+		if listener.err != nil {
+			return nil, listener.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *routingListener) Close() error {
+	listener.closeOnce.Do(func() { close(listener.closed) })
+	return listener.Listener.Close()
+}
+
+// Accepts raw connections and inspects each one in its own goroutine.
+func (listener *routingListener) acceptLoop() {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			listener.err = err
+			listener.closeOnce.Do(func() { close(listener.closed) })
+			return
+		}
+		go listener.inspect(conn)
+	}
+}
+
+// Peeks the ClientHello of conn and routes it.
+func (listener *routingListener) inspect(conn net.Conn) {
+	timeout := listener.router.HelloTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	peeked, err := mtls.PeekClientHello(conn)
+	if err != nil {
+		listener.logger().Info("failed to read ClientHello", "remote", conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	route := listener.router.route(peeked.Info)
+	switch {
+	case route == nil:
+		listener.logger().Info("no route for server name", "remote", conn.RemoteAddr().String(), "server_name", peeked.Info.ServerName)
+		conn.Close()
+	case route.Backend != "":
+		go listener.proxy(peeked, route.Backend)
+	case route.TLSConfig != nil:
+		select {
+		case listener.accepted <- tls.Server(peeked, route.TLSConfig):
+		case <-listener.closed:
+			conn.Close()
+		}
+	default:
+		listener.logger().Error("route has neither a TLS config nor a backend", "server_name", peeked.Info.ServerName)
+		conn.Close()
+	}
+}
+
+// Returns the logger of the router.
+func (listener *routingListener) logger() *slog.Logger {
+	return util.LoggerOrDiscard(listener.router.Logger)
+}
+
+// Copies bytes between a client and a backend until either side closes.
+func (listener *routingListener) proxy(client net.Conn, backendAddress string) {
+	defer client.Close()
+	backend, err := net.Dial("tcp", backendAddress)
+	if err != nil {
+		listener.logger().Error("failed to reach backend", "backend", backendAddress, "error", err)
+		return
+	}
+	defer backend.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(backend, client)
+		closeWrite(backend)
+		close(done)
+	}()
+	io.Copy(client, backend)
+	closeWrite(client)
+	<-done
+}
+
+// Half-closes a TCP connection so the peer sees EOF.
+func closeWrite(conn net.Conn) {
+	if peeked, ok := conn.(*mtls.PeekedConn); ok {
+		conn = peeked.Conn
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+}
+
+// Creates a WebSocket server on a port shared with other services.
+//
+// Each connection is routed by its ClientHello, see Router.
+func CreateWebSocketRouted(addr string, port string, handler func(websocket *websocket.Ws, server *Server) (uint16, error), routeString string, router *Router) {
+	NewServer(addr, port).ListenAndServeRouted(handler, routeString, router)
+}
@@ -0,0 +1,245 @@
+package wsserver
+
+import (
+	"bytes"
+	"io"
+	mtls "mithril/tls"
+	"mithril/wsclient"
+	"net"
+	"testing"
+	"time"
+)
+
+// Encodes a ClientHello for serverName (none if empty) offering protocols, as records.
+func helloRecords(serverName string, protocols ...string) []byte {
+	hello := &mtls.ClientHelloMessage{
+		Version:            mtls.VersionTLS12,
+		CipherSuites:       []uint16{mtls.TLS_AES_128_GCM_SHA256},
+		CompressionMethods: []byte{0},
+		Extensions:         []mtls.Extension{mtls.SupportedVersionsExtension(mtls.VersionTLS13)},
+	}
+	if serverName != "" {
+		hello.Extensions = append(hello.Extensions, mtls.ServerNameExtension(serverName))
+	}
+	if len(protocols) > 0 {
+		hello.Extensions = append(hello.Extensions, mtls.ALPNExtension(protocols...))
+	}
+	var stream []byte
+	for _, record := range mtls.Fragment(mtls.RecordHandshake, mtls.VersionTLS10, hello.Marshal()) {
+		stream = append(stream, record.Bytes()...)
+	}
+	return stream
+}
+
+// Splits the handshake records of stream into records carrying size bytes.
+func splitRecords(stream []byte, size int) []byte {
+	var split []byte
+	for len(stream) > 0 {
+		record, used, err := mtls.ParseRecord(stream)
+		if err != nil {
+			panic(err)
+		}
+		for fragment := record.Fragment; len(fragment) > 0; {
+			n := min(len(fragment), size)
+			split = append(split, (&mtls.TLSRecord{ContentType: record.ContentType, Version: record.Version, Length: uint16(n), Fragment: fragment[:n]}).Bytes()...)
+			fragment = fragment[n:]
+		}
+		stream = stream[used:]
+	}
+	return split
+}
+
+// Starts a TCP backend that reads each connection to its end, passes what it read to the
+// returned channel and answers with its name.
+//
+// Returns its address and the channel
+func captureBackend(t *testing.T, name string) (string, <-chan []byte) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				received <- data
+				conn.Write([]byte(name))
+			}()
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+// Sends stream to address, half-closes and reads until the server closes.
+//
+// Returns what the server sent
+func sendThrough(t *testing.T, address string, stream []byte) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(stream)
+	conn.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(reply)
+}
+
+func TestRouterRoute(t *testing.T) {
+	exact, wildcard, alpn, fallback, selected := &Route{}, &Route{}, &Route{}, &Route{}, &Route{}
+	router := &Router{
+		ServerNames: map[string]*Route{"example.com": exact, "*.example.com": wildcard},
+		Protocols:   map[string]*Route{"h2": alpn},
+		Default:     fallback,
+	}
+	tests := []struct {
+		name       string
+		serverName string
+		protocols  []string
+		want       *Route
+	}{
+		{"exact", "example.com", nil, exact},
+		{"exact before ALPN", "example.com", []string{"h2"}, exact},
+		{"case and trailing dot", "Example.COM.", nil, exact},
+		{"wildcard", "api.example.com", nil, wildcard},
+		{"wildcard before ALPN", "api.example.com", []string{"h2"}, wildcard},
+		// A wildcard covers a single label
+		{"two labels below the wildcard", "a.b.example.com", nil, fallback},
+		{"suffix without a dot", "badexample.com", nil, fallback},
+		{"ALPN", "other.test", []string{"h2"}, alpn},
+		{"ALPN in any position", "", []string{"http/1.1", "h2"}, alpn},
+		{"unknown ALPN", "", []string{"http/1.1"}, fallback},
+		{"nothing", "", nil, fallback},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := router.route(&mtls.ClientHelloInfo{ServerName: test.serverName, ALPNProtocols: test.protocols}); got != test.want {
+				t.Errorf("got %p, want %p", got, test.want)
+			}
+		})
+	}
+
+	router.Default = nil
+	if got := router.route(&mtls.ClientHelloInfo{ServerName: "other.test"}); got != nil {
+		t.Errorf("got %p without a default", got)
+	}
+	router.Select = func(info *mtls.ClientHelloInfo) *Route { return selected }
+	if got := router.route(&mtls.ClientHelloInfo{ServerName: "example.com"}); got != selected {
+		t.Errorf("Select did not override the maps")
+	}
+}
+
+func TestRouterListener(t *testing.T) {
+	config, pool := testTLSConfig(t)
+	exact, exactReceived := captureBackend(t, "exact")
+	wildcard, wildcardReceived := captureBackend(t, "wildcard")
+	alpn, alpnReceived := captureBackend(t, "alpn")
+	fallback, fallbackReceived := captureBackend(t, "default")
+	router := &Router{
+		ServerNames: map[string]*Route{
+			"localhost":     {TLSConfig: config},
+			"example.com":   {Backend: exact},
+			"*.example.com": {Backend: wildcard},
+		},
+		Protocols: map[string]*Route{"h2": {Backend: alpn}},
+		Default:   &Route{Backend: fallback},
+	}
+	address := startServer(t, func(srv *Server) { srv.ListenAndServeRouted(echoHandler, "/ws", router) }, NewServer("", ""))
+	_, port, _ := net.SplitHostPort(address)
+
+	t.Run("websocket", func(t *testing.T) {
+		echoed := make(chan string, 1)
+		err := wsclient.ConnectURL("wss://localhost:"+port+"/ws", func(ws *wsclient.ClientWs) {
+			ws.WriteText("hello")
+			_, data, _ := ws.ReadMessage()
+			echoed <- string(data)
+		}, &wsclient.TLSOptions{RootCAs: pool})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := receive(t, echoed); got != "hello" {
+			t.Fatalf("echoed %q", got)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		stream   []byte
+		backend  string
+		received <-chan []byte
+	}{
+		{"exact", helloRecords("example.com"), "exact", exactReceived},
+		{"wildcard", helloRecords("api.example.com", "h2"), "wildcard", wildcardReceived},
+		{"ALPN", helloRecords("other.test", "http/1.1", "h2"), "alpn", alpnReceived},
+		{"default", helloRecords(""), "default", fallbackReceived},
+		// The peeked records are replayed whatever their size
+		{"split hello", splitRecords(helloRecords("example.com"), 5), "exact", exactReceived},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Bytes after the ClientHello are passed through too
+			stream := append(test.stream, []byte("\x17\x03\x03\x00\x05after")...)
+			if reply := sendThrough(t, address, stream); reply != test.backend {
+				t.Errorf("reply %q, want %q", reply, test.backend)
+			}
+			if got := receive(t, test.received); !bytes.Equal(got, stream) {
+				t.Errorf("backend received %d bytes, sent %d", len(got), len(stream))
+			}
+		})
+	}
+}
+
+func TestRouterDropsConnections(t *testing.T) {
+	router := &Router{
+		ServerNames: map[string]*Route{"example.com": {}},
+		// Shorter than the 10 second default so the silent client is dropped quickly
+		HelloTimeout: 100 * time.Millisecond,
+	}
+	address := startServer(t, func(srv *Server) { srv.ListenAndServeRouted(echoHandler, "/ws", router) }, NewServer("", ""))
+
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"no route", helloRecords("other.test")},
+		{"route without TLS config or backend", helloRecords("example.com")},
+		{"plain HTTP", []byte("GET /ws HTTP/1.1\r\nHost: localhost\r\n\r\n")},
+		{"not a handshake", []byte("\x17\x03\x03\x00\x01x")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if reply := sendThrough(t, address, test.stream); reply != "" {
+				t.Errorf("received %q", reply)
+			}
+		})
+	}
+
+	t.Run("silent client", func(t *testing.T) {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		start := time.Now()
+		if received, err := io.ReadAll(conn); err != nil || len(received) != 0 {
+			t.Fatalf("received %q, %v", received, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("dropped after %v", elapsed)
+		}
+	})
+}
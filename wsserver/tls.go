@@ -0,0 +1,139 @@
+package wsserver
+
+// Helpers for serving WebSockets over TLS.
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"mithril/util"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNilTLSConfig = errors.New("nil TLS config")
+
+// Certificate/key pair that is reloaded from disk whenever one of the files changes.
+type CertificateReloader struct {
+	CertFile string
+	KeyFile  string
+
+	// Logs reloads (nil logs nothing)
+	Logger *slog.Logger
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+// Loads a certificate/key pair and watches it for changes.
+//
+// Returns a error (can be nil)
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{CertFile: certFile, KeyFile: keyFile}
+	return reloader, reloader.Reload()
+}
+
+// Returns the newest modification time of the certificate and key files.
+func (r *CertificateReloader) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(r.CertFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.KeyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// Reads the certificate/key pair from disk.
+//
+// Returns a error (can be nil), the previous certificate is kept on failure.
+func (r *CertificateReloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.certificate = &certificate
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// Returns the current certificate, reloading it first if the files changed.
+//
+// Meant to be used as tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	certificate, loadedAt := r.certificate, r.modTime
+	r.mu.RUnlock()
+
+	modTime, err := r.latestModTime()
+	if err == nil && modTime.After(loadedAt) {
+		if err := r.Reload(); err != nil {
+			util.LoggerOrDiscard(r.Logger).Error("failed to reload certificate", "file", r.CertFile, "error", err)
+		} else {
+			util.LoggerOrDiscard(r.Logger).Info("reloaded certificate", "file", r.CertFile)
+			r.mu.RLock()
+			certificate = r.certificate
+			r.mu.RUnlock()
+		}
+	}
+
+	if certificate == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+	return certificate, nil
+}
+
+// Creates a TLS config serving a single certificate/key pair that is hot reloaded.
+//
+// Returns a error (can be nil)
+func LoadTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+// Creates a TLS config that selects the certificate by the SNI server name.
+//
+// Keys are host names, a leading "*." matches any single subdomain.
+// The fallback is used for unknown or missing server names (can be nil).
+func SNIConfig(certificates map[string]*CertificateReloader, fallback *CertificateReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+			if reloader, ok := certificates[name]; ok {
+				return reloader.GetCertificate(hello)
+			}
+			if index := strings.IndexByte(name, '.'); index != -1 {
+				if reloader, ok := certificates["*"+name[index:]]; ok {
+					return reloader.GetCertificate(hello)
+				}
+			}
+			if fallback != nil {
+				return fallback.GetCertificate(hello)
+			}
+			return nil, errors.New("no certificate for server name " + hello.ServerName)
+		},
+	}
+}
@@ -0,0 +1,26 @@
+package wsserver
+
+// Trace context of handshake requests.
+
+import (
+	"bytes"
+	"context"
+	"mithril/trace"
+)
+
+// Returns a context carrying the traceparent header of request, if it has a valid one.
+func requestContext(request []byte) context.Context {
+	ctx := context.Background()
+	for _, line := range bytes.Split(request, []byte("\r\n"))[1:] {
+		name, value, found := bytes.Cut(line, []byte(":"))
+		if !found || !bytes.EqualFold(bytes.TrimSpace(name), []byte("traceparent")) {
+			continue
+		}
+		sc, err := trace.ParseTraceparent(string(bytes.TrimSpace(value)))
+		if err == nil {
+			ctx = trace.ContextWithSpanContext(ctx, sc)
+		}
+		break
+	}
+	return ctx
+}
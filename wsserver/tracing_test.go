@@ -0,0 +1,105 @@
+package wsserver
+
+import (
+	"mithril/trace"
+	"mithril/websocket"
+	"mithril/wsclient"
+	"testing"
+	"time"
+)
+
+func TestRequestContext(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name  string
+		lines string
+		valid bool
+	}{
+		{"header", "Traceparent: " + traceparent, true},
+		{"lowercase", "traceparent:" + traceparent, true},
+		{"malformed", "traceparent: 00-zz", false},
+		{"missing", "Host: localhost", false},
+		{"first one counts", "traceparent: 00-zz\r\ntraceparent: " + traceparent, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := []byte("GET /ws HTTP/1.1\r\n" + test.lines + "\r\n\r\n")
+			sc := trace.SpanContextFromContext(requestContext(request))
+			if sc.IsValid() != test.valid {
+				t.Fatalf("got %+v, want valid %v", sc, test.valid)
+			}
+			if test.valid && sc.Traceparent() != traceparent {
+				t.Errorf("got %s, want %s", sc.Traceparent(), traceparent)
+			}
+		})
+	}
+}
+
+// Waits until exporter has n spans named name or fails the test after a few seconds.
+//
+// Returns the spans
+func waitSpans(t *testing.T, exporter *trace.MemoryExporter, name string, n int) []*trace.Span {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(time.Millisecond) {
+		if spans := exporter.SpansNamed(name); len(spans) == n {
+			return spans
+		} else if time.Now().After(deadline) {
+			t.Fatalf("%d %s spans, want %d", len(spans), name, n)
+		}
+	}
+}
+
+// A message and its reply form one trace across client and server.
+func TestTracePropagation(t *testing.T) {
+	serverSpans, clientSpans := &trace.MemoryExporter{}, &trace.MemoryExporter{}
+	srv := NewServer("", "")
+	srv.Tracer = &trace.Tracer{Exporter: serverSpans}
+	srv.TraceEnvelope = true
+	handler := srv.Handle(&Handlers{
+		OnMessage: func(ws *websocket.Ws, messageType websocket.MessageType, data []byte) {
+			ws.WriteMessageContext(ws.MessageContext(), messageType, data)
+		},
+	})
+	address := startServer(t, func(srv *Server) { srv.ListenAndServe(handler, "/ws") }, srv)
+
+	client := &wsclient.Client{Tracer: &trace.Tracer{Exporter: clientSpans}, TraceEnvelope: true}
+	err := client.ConnectURL("ws://"+address+"/ws", func(ws *wsclient.ClientWs) {
+		ws.WriteText("hello")
+		// The envelope is removed before the message is returned
+		if _, data, err := ws.ReadMessage(); err != nil || string(data) != "hello" {
+			t.Errorf("echo %q, %v", data, err)
+		}
+		ws.FinishMessage(nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect := waitSpans(t, clientSpans, "websocket.connect", 1)[0]
+	handshake := waitSpans(t, serverSpans, "websocket.handshake", 1)[0]
+	clientWrite := waitSpans(t, clientSpans, "websocket.write", 1)[0]
+	serverMessage := waitSpans(t, serverSpans, "websocket.message", 1)[0]
+	serverWrite := waitSpans(t, serverSpans, "websocket.write", 1)[0]
+	clientMessage := waitSpans(t, clientSpans, "websocket.message", 1)[0]
+
+	// Each span is the child of the one before it
+	chain := []*trace.Span{connect, handshake, clientWrite, serverMessage, serverWrite, clientMessage}
+	parents := []*trace.Span{nil, connect, connect, clientWrite, serverMessage, serverWrite}
+	for i, span := range chain {
+		if span.SpanContext.TraceID != connect.SpanContext.TraceID {
+			t.Errorf("%s span is in trace %x, want %x", span.Name, span.SpanContext.TraceID, connect.SpanContext.TraceID)
+		}
+		if parents[i] == nil {
+			if span.Parent.IsValid() {
+				t.Errorf("%s span has parent %+v", span.Name, span.Parent)
+			}
+			continue
+		}
+		if span.Parent.TraceID != parents[i].SpanContext.TraceID || span.Parent.SpanID != parents[i].SpanContext.SpanID {
+			t.Errorf("%s span has parent %x, want the %s span %x", span.Name, span.Parent.SpanID, parents[i].Name, parents[i].SpanContext.SpanID)
+		}
+		if span.Err != nil {
+			t.Errorf("%s span failed: %v", span.Name, span.Err)
+		}
+	}
+}
@@ -4,36 +4,156 @@ package wsserver
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
+	mtls "mithril/tls"
+	"mithril/trace"
 	"mithril/util"
 	"mithril/websocket"
 	"net"
+	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 type Server struct {
 	Listener net.Listener
-	Clients  []*websocket.Ws
-	Address  string
-	Port     string
+	// Clients that completed the handshake, guarded by ClientsMu
+	Clients   []*websocket.Ws
+	ClientsMu sync.Mutex
+	Address   string
+	Port      string
+	TLSConfig *tls.Config
+	// Rejects TLS clients whose JA3 string, JA3 hash or JA4 fingerprint is listed
+	FingerprintBlocklist map[string]bool
+	// Custom fingerprint policy, returning false rejects the client (can be nil)
+	CheckFingerprint func(fingerprint *mtls.Fingerprint) bool
+	// Largest frame a client may send, 0 means no limit
+	MaxFrameSize int64
+	// Largest reassembled message a client may send, 0 means no limit
+	MaxMessageSize int64
+	// Memory shared by all clients for received data (can be nil)
+	MemoryBudget *websocket.MemoryBudget
+	// Buffers shared by all clients (nil uses the package default)
+	BufferPool websocket.BufferPool
+	// Origins browsers may connect from, "*" allows any and "https://*.example.com" subdomains.
+	// Empty allows only the origin matching the Host header. Clients without Origin are allowed.
+	AllowedOrigins []string
+	// Custom origin policy replacing AllowedOrigins, returning false rejects the client with 403 (can be nil)
+	CheckOrigin func(ws *websocket.Ws, origin string) bool
+	// Most clients connected at once, the rest get 503 (0 means no limit).
+	// Clients count once their handshake request arrived.
+	MaxConnections int
+	// Sent as Retry-After when the server is full (0 sends 5 seconds)
+	RetryAfter time.Duration
+	// When full, the client idle the longest is closed with 1013 for a new one,
+	// if it has been idle for at least this long (0 never closes clients)
+	ShedIdleAfter time.Duration
+	// Time a client has to complete the TLS handshake and send its request (0 waits 10 seconds)
+	HandshakeTimeout time.Duration
+	// Rate limits for handshakes, connections and messages (can be nil)
+	RateLimits *RateLimits
+	// Inspects the handshake request (ws.Headers, ws.Path, ws.Query) before accepting it (can be nil).
+	// Values set on ws stay for the connection, the returned headers are added to the 101 response.
+	// A *HandshakeError rejects the client with its status, any other error with 403 and its message.
+	CheckHandshake func(ws *websocket.Ws) (http.Header, error)
+
+	// Logger of the server, clients log through it with their ID and address (nil logs nothing)
+	Logger *slog.Logger
+	// Counters of handshakes, connections and the traffic of every client (can be nil).
+	// metrics.NewRegistry serves them in the Prometheus text format.
+	Metrics Metrics
+	// Traces handshakes, received messages and writes (nil traces nothing).
+	// A traceparent header of the handshake request becomes the parent of the connection.
+	Tracer *trace.Tracer
+	// Carries the trace context inside text and binary messages, see websocket.Conn.TraceEnvelope
+	TraceEnvelope bool
+
+	// OnOpen of the Handlers given to Handle
+	onOpen func(ws *websocket.Ws)
+	// Admitted clients still in the handshake, guarded by ClientsMu
+	handshaking int
+	// ID of the next client, for logs
+	nextID atomic.Uint64
 }
 
-// Returns a Server struct.
-func initServer(address string, port string) *Server {
-	listener, err := net.Listen("tcp", address+":"+port)
-	util.OnError(err)
+// Largest HTTP request accepted for the handshake (8 KiB)
+const maxRequestSize = 8 << 10
 
-	log.Println("Server listening on address: " + address + " and port: " + port)
+// Time to complete the handshake when HandshakeTimeout is 0
+const defaultHandshakeTimeout = 10 * time.Second
 
+// Returns a Server struct that is not listening yet.
+//
+// Set its fields, then call one of the ListenAndServe methods.
+func NewServer(address string, port string) *Server {
 	var clientSlice []*websocket.Ws
 
 	return &Server{
-		Listener: listener,
-		Clients:  clientSlice,
-		Address:  address,
-		Port:     port,
+		Clients:        clientSlice,
+		Address:        address,
+		Port:           port,
+		MaxMessageSize: websocket.DefaultReadLimit,
+	}
+}
+
+// Opens the TCP listener.
+func (srv *Server) listen() {
+	listener, err := net.Listen("tcp", srv.Address+":"+srv.Port)
+	util.OnError(err)
+	srv.Listener = listener
+
+	srv.logger().Info("server listening", "address", srv.Address, "port", srv.Port)
+}
+
+// Returns the logger of the server.
+func (srv *Server) logger() *slog.Logger {
+	return util.LoggerOrDiscard(srv.Logger)
+}
+
+// Serves WebSockets over plain TCP (ws://).
+func (srv *Server) ListenAndServe(handler func(websocket *websocket.Ws, server *Server) (uint16, error), routeString string) {
+	srv.listen()
+	srv.serve(handler, routeString)
+}
+
+// Serves WebSockets over TLS (wss://).
+//
+// See LoadTLSConfig and SNIConfig for building the config. Clients are only
+// fingerprinted when FingerprintBlocklist or CheckFingerprint is set.
+func (srv *Server) ListenAndServeTLS(handler func(websocket *websocket.Ws, server *Server) (uint16, error), routeString string, config *tls.Config) {
+	if config == nil {
+		util.OnError(errNilTLSConfig)
+	}
+	srv.TLSConfig = config
+	// Only a fingerprint policy needs the ClientHello parsed before crypto/tls sees it
+	if len(srv.FingerprintBlocklist) > 0 || srv.CheckFingerprint != nil {
+		srv.ListenAndServeRouted(handler, routeString, &Router{Default: &Route{TLSConfig: config}})
+		return
+	}
+	srv.listen()
+	srv.Listener = tls.NewListener(srv.Listener, config)
+	srv.serve(handler, routeString)
+}
+
+// Serves WebSockets on a port shared with other services.
+//
+// Each connection is routed by its ClientHello, see Router.
+func (srv *Server) ListenAndServeRouted(handler func(websocket *websocket.Ws, server *Server) (uint16, error), routeString string, router *Router) {
+	srv.listen()
+	if router.Logger == nil {
+		router.Logger = srv.Logger
 	}
+	srv.Listener = router.Listener(srv.Listener)
+	srv.serve(handler, routeString)
 }
 
 // Accepts a TCP connection.
@@ -46,76 +166,321 @@ func (srv *Server) acceptConnection() *websocket.Ws {
 
 	// Buffer
 	buffer := bufio.NewReadWriter(bufio.NewReader(connection), bufio.NewWriter(connection))
-	// WebSocket instance
-	ws := &websocket.Ws{Conn: connection, Buffer: buffer}
+	return srv.newClient(connection, buffer)
+}
 
-	srv.Clients = append(srv.Clients, ws)
-	log.Println("Host " + connection.LocalAddr().String() + " connected.")
+// Wraps a connection, it joins Clients once its handshake completes.
+//
+// Returns a *websocket.Ws.
+func (srv *Server) newClient(connection net.Conn, buffer *bufio.ReadWriter) *websocket.Ws {
+	// WebSocket instance
+	ws := websocket.NewConn(connection, buffer, websocket.ServerRole)
+	ws.SetFrameLimit(srv.MaxFrameSize)
+	ws.SetReadLimit(srv.MaxMessageSize)
+	ws.Budget = srv.MemoryBudget
+	ws.Pool = srv.BufferPool
+	ws.Metrics = srv.Metrics
+	ws.Tracer = srv.Tracer
+	ws.TraceEnvelope = srv.TraceEnvelope
+	ws.Logger = srv.logger().With("conn", srv.nextID.Add(1), "remote", connection.RemoteAddr().String())
+	ws.Logger.Debug("client connected")
 
 	return ws
 }
 
-// Broadcasts data to all clients.
-func (srv *Server) BroadcastToAll(data []byte) {
+// Records the TLS fingerprint of a client and applies the fingerprint policy.
+//
+// Returns false if the client must be rejected.
+func (srv *Server) fingerprint(ws *websocket.Ws) bool {
+	tlsConn, ok := ws.Conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	peeked, ok := tlsConn.NetConn().(*mtls.PeekedConn)
+	if !ok {
+		return true
+	}
+
+	fingerprint, err := mtls.NewFingerprint(peeked.Info.Raw)
+	if err != nil {
+		ws.Logger.Info("failed to fingerprint client", "error", err)
+		return false
+	}
+	ws.Fingerprint = fingerprint
+
+	blocked := srv.FingerprintBlocklist[fingerprint.JA3] || srv.FingerprintBlocklist[fingerprint.JA3Hash] || srv.FingerprintBlocklist[fingerprint.JA4]
+	if !blocked && srv.CheckFingerprint != nil {
+		blocked = !srv.CheckFingerprint(fingerprint)
+	}
+	if blocked {
+		ws.Logger.Info("rejected blocked TLS fingerprint", "ja4", fingerprint.JA4)
+	}
+	return !blocked
+}
+
+// Removes a client from the client list.
+func (srv *Server) removeClient(ws *websocket.Ws) {
+	if srv.RateLimits != nil {
+		srv.RateLimits.release(ws)
+	}
+	srv.ClientsMu.Lock()
+	defer srv.ClientsMu.Unlock()
 	for i := 0; i <= len(srv.Clients)-1; i++ {
-		_, err := srv.Clients[i].Write(data)
-		if err != nil {
+		if srv.Clients[i] == ws {
 			srv.Clients[i] = srv.Clients[len(srv.Clients)-1]
 			srv.Clients = srv.Clients[:len(srv.Clients)-1]
-			log.Println(err)
+			return
 		}
 	}
-	log.Println("Broadcasted " + strconv.Itoa(len(data)) + " bytes of data to all clients.")
+}
+
+// Broadcasts data to all clients.
+//
+// Safe to call from handlers, clients that fail to receive it are removed.
+func (srv *Server) BroadcastToAll(data []byte) {
+	// Write outside of the lock so a slow client doesn't block new connections
+	srv.ClientsMu.Lock()
+	clients := append([]*websocket.Ws(nil), srv.Clients...)
+	srv.ClientsMu.Unlock()
 
+	for i := 0; i <= len(clients)-1; i++ {
+		_, err := clients[i].Write(data)
+		if err != nil {
+			srv.removeClient(clients[i])
+			clients[i].Logger.Warn("broadcast failed", "error", err)
+		}
+	}
+	srv.logger().Debug("broadcast", "bytes", len(data), "clients", len(clients))
 }
 
-// Creates a WebSocket server
-func CreateWebSocket(addr string, port string, handler func(websocket *websocket.Ws, server *Server) (uint16, error), routeString string) {
-	server := initServer(addr, port)
-	defer server.Listener.Close()
+// Accepts connections and hands them over to the handler.
+func (srv *Server) serve(handler func(websocket *websocket.Ws, server *Server) (uint16, error), routeString string) {
+	defer srv.Listener.Close()
 	for {
 		// create listener
-		websocketInstance := server.acceptConnection()
+		websocketInstance := srv.acceptConnection()
 
 		// goroutine
 		go func(ws *websocket.Ws) {
-			bytes := make([]byte, 256)
-			length, err := ws.Conn.Read(bytes)
-
-			if err == io.EOF {
-				util.OnError(err)
+			defer srv.removeClient(ws)
+			if !srv.upgrade(ws, routeString) {
+				return
 			}
+			defer srv.closed()
 
-			method, route, err := ws.DetermineRequest(bytes[:length])
-			util.OnError(err)
-
-			if route == routeString {
-				if method != "GET" {
-					ws.SendHTTPError("400", "Invalid request method! Was:"+method+" Should be GET.")
-					log.Println("Client attempted to connect with an incorrect method. (" + method + ")")
-					ws.Conn.Close()
-					return
-				} else {
-					headers := ws.GetHTTPHeaders(bytes[:length])
-					log.Println("Obtained headers from HTTP request.")
-
-					ws.ServerHandshake(headers["Sec-WebSocket-Key"])
-					log.Println("Sent handshake to client.")
-
-					for {
-						status, err := handler(ws, server)
-						if err != nil {
-							log.Println("exception: ", err, " Closing connection.")
-							ws.Close(status, err.Error())
-							break
-						}
-					}
+			for {
+				status, err := handler(ws, srv)
+				ws.FinishMessage(err)
+				if err != nil {
+					srv.closeWithError(ws, status, err)
+					break
+				}
+				// Closed by the handler or the client
+				if ws.IsClosed() {
+					break
 				}
-			} else {
-				// Send error and disconnect
-				ws.SendHTTPError("400", "Invalid route! ("+route+")")
-				ws.Conn.Close()
 			}
 		}(websocketInstance)
 	}
 }
+
+// Reads the HTTP request and answers it with the WebSocket handshake.
+//
+// Returns false if the client was rejected, its connection is closed then.
+func (srv *Server) upgrade(ws *websocket.Ws, routeString string) bool {
+	// Checked before the TLS handshake, which only runs on the first read
+	if !srv.fingerprint(ws) {
+		srv.rejected("fingerprint")
+		ws.Conn.Close()
+		return false
+	}
+
+	request, ok := srv.readRequest(ws)
+	if !ok {
+		return false
+	}
+
+	// The connection continues the trace of the request, if it has one
+	ctx, span := srv.Tracer.Start(requestContext(request), "websocket.handshake", slog.String("remote", ws.RemoteAddr().String()))
+	ws.SetContext(ctx)
+	reason := srv.handshake(ws, request, routeString)
+	span.SetAttributes(slog.String("path", ws.Path))
+	if reason != "" {
+		span.SetError(errors.New("handshake rejected: " + reason))
+		span.Finish()
+		srv.rejected(reason)
+		return false
+	}
+	span.Finish()
+	srv.accepted()
+
+	if srv.RateLimits != nil {
+		ws.Limiter = srv.RateLimits.limiter()
+	}
+	if srv.onOpen != nil {
+		srv.onOpen(ws)
+	}
+	return true
+}
+
+// Checks the request and sends the 101 response, accepted clients join Clients.
+//
+// Returns the reason the client was rejected, empty if it was accepted
+func (srv *Server) handshake(ws *websocket.Ws, request []byte, routeString string) (reason string) {
+	// Checked after reading, closing with unread data could reset the response
+	if srv.RateLimits != nil && !srv.RateLimits.admit(ws) {
+		return "rate_limit"
+	}
+	if !srv.admitConnection(ws) {
+		return "capacity"
+	}
+	defer func() { srv.finishHandshake(ws, reason == "") }()
+
+	method, route, err := ws.DetermineRequest(request)
+	util.OnError(err)
+
+	if route != routeString {
+		// Send error and disconnect
+		ws.SendHTTPError("400", "Invalid route! ("+route+")")
+		ws.Logger.Info("rejected unknown route", "route", route)
+		ws.Conn.Close()
+		return "route"
+	}
+	if method != "GET" {
+		ws.SendHTTPError("400", "Invalid request method! Was:"+method+" Should be GET.")
+		ws.Logger.Info("rejected request method", "method", method)
+		ws.Conn.Close()
+		return "method"
+	}
+
+	headers, err := ws.GetHTTPHeaders(request)
+	if err != nil {
+		ws.SendHTTPError("400", "Malformed request headers.")
+		ws.Logger.Info("rejected malformed headers", "error", err)
+		ws.Conn.Close()
+		return "headers"
+	}
+	ws.Headers = headers
+	// Request line: method, target and version
+	if fields := strings.Fields(strings.SplitN(string(request), "\r\n", 2)[0]); len(fields) == 3 {
+		ws.SetRequestURI(fields[1])
+	}
+	ws.Logger = ws.Logger.With("path", ws.Path)
+
+	if !srv.checkOrigin(ws) {
+		return "origin"
+	}
+	responseHeaders, ok := srv.checkHandshake(ws)
+	if !ok {
+		return "check_handshake"
+	}
+	ws.AcceptHandshake(headers["Sec-WebSocket-Key"], responseHeaders)
+	ws.Logger.Debug("handshake complete")
+	return ""
+}
+
+// Reads the HTTP request up to the empty line ending its headers.
+//
+// Returns the request and false if the client was dropped, its connection is closed then.
+func (srv *Server) readRequest(ws *websocket.Ws) ([]byte, bool) {
+	timeout := srv.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	ws.Conn.SetReadDeadline(time.Now().Add(timeout))
+	request := make([]byte, maxRequestSize)
+	length := 0
+	for !bytes.Contains(request[:length], []byte("\r\n\r\n")) {
+		if length == len(request) {
+			ws.SendHTTPError("431", "Request headers larger than "+strconv.Itoa(maxRequestSize)+" bytes.")
+			ws.Logger.Info("rejected oversized request")
+			srv.rejected("request_too_large")
+			ws.Conn.Close()
+			return nil, false
+		}
+
+		n, err := ws.Conn.Read(request[length:])
+		length += n
+		if err != nil {
+			// A failed TLS handshake surfaces as a read error too
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				ws.Logger.Info("handshake timed out", "received", length)
+				srv.rejected("timeout")
+			} else if _, isTLS := ws.Conn.(*tls.Conn); isTLS && length == 0 {
+				ws.Logger.Info("TLS handshake failed", "error", err)
+				srv.rejected("tls")
+			} else {
+				ws.Logger.Debug("client left during the handshake", "error", err)
+				srv.rejected("aborted")
+			}
+			ws.Conn.Close()
+			return nil, false
+		}
+	}
+	ws.Conn.SetReadDeadline(time.Time{})
+	return request[:length], true
+}
+
+// Closes a client after its handler returned an error.
+//
+// Status codes that can't be sent in a close frame become 1011, except 1006.
+func (srv *Server) closeWithError(ws *websocket.Ws, status uint16, err error) {
+	var protocolError *util.ProtocolError
+	switch {
+	case errors.As(err, &protocolError):
+		// Protocol violations decide the close code themselves
+		status = protocolError.Code
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		// The client is gone, whatever the handler returned
+		status = 1006
+	case status != 1006 && !util.ValidCloseCode(status):
+		status = 1011
+	}
+	if status == 1006 {
+		ws.Logger.Debug("client disconnected", "error", err)
+	} else {
+		ws.Logger.Warn("closing connection after error", "code", status, "error", err)
+	}
+	// 1006 (dropped) closes the socket without sending a close frame
+	ws.Close(status, closeReason(err))
+}
+
+// Largest close reason, the close frame payload also holds the 2 byte code
+const maxCloseReason = 123
+
+// Returns the message of err, cut on a UTF-8 boundary to fit a close frame.
+func closeReason(err error) string {
+	reason := err.Error()
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	for i := maxCloseReason; i > 0; i-- {
+		if utf8.RuneStart(reason[i]) {
+			return reason[:i]
+		}
+	}
+	return ""
+}
+
+// Creates a WebSocket server
+func CreateWebSocket(addr string, port string, handler func(websocket *websocket.Ws, server *Server) (uint16, error), routeString string) {
+	NewServer(addr, port).ListenAndServe(handler, routeString)
+}
+
+// Creates a WebSocket server that reads messages itself and calls handlers, see Handlers.
+func CreateWebSocketHandlers(addr string, port string, handlers *Handlers, routeString string) {
+	srv := NewServer(addr, port)
+	srv.ListenAndServe(srv.Handle(handlers), routeString)
+}
+
+// Creates a WebSocket server driven by an event loop, see Server.ListenAndServeEvents.
+func CreateWebSocketEvents(addr string, port string, handler func(websocket *websocket.Ws, server *Server) (uint16, error), routeString string) {
+	NewServer(addr, port).ListenAndServeEvents(handler, routeString)
+}
+
+// Creates a WebSocket server secured with TLS (wss://).
+//
+// See LoadTLSConfig and SNIConfig for building the config.
+func CreateWebSocketTLS(addr string, port string, handler func(websocket *websocket.Ws, server *Server) (uint16, error), routeString string, config *tls.Config) {
+	NewServer(addr, port).ListenAndServeTLS(handler, routeString, config)
+}
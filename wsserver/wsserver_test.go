@@ -0,0 +1,318 @@
+package wsserver
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mtls "mithril/tls"
+	"mithril/websocket"
+	"mithril/wsclient"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// Returns a port that was free a moment ago.
+func freePort(t testing.TB) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// Runs serve on a free port and waits until it accepts connections.
+//
+// Returns the address of the server
+func startServer(t testing.TB, serve func(srv *Server), srv *Server) string {
+	t.Helper()
+	srv.Address = "127.0.0.1"
+	srv.Port = freePort(t)
+	go serve(srv)
+
+	address := net.JoinHostPort(srv.Address, srv.Port)
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			return address
+		}
+	}
+	t.Fatal("server did not start")
+	return ""
+}
+
+// Handler echoing text and binary messages.
+func echoHandler(ws *websocket.Ws, srv *Server) (uint16, error) {
+	messageType, data, err := ws.ReadMessage()
+	if err != nil {
+		return 1000, err
+	}
+	if !messageType.IsControl() {
+		ws.WriteMessage(messageType, data)
+	}
+	return 1000, nil
+}
+
+// Sends a handshake request for target, headers holds extra "Name: value\r\n" lines.
+//
+// Returns the connection, the reader holding what followed the response and the response
+func handshakeRaw(t testing.TB, address string, target string, headers string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" + headers + "\r\n"))
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("no handshake response: %v", err)
+	}
+	return conn, reader, response
+}
+
+// Opens a WebSocket connection without a client library.
+//
+// Returns the connection and the reader holding what followed the 101 response
+func dialRaw(t testing.TB, address string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, reader, response := handshakeRaw(t, address, "/ws", "")
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %s", response.Status)
+	}
+	return conn, reader
+}
+
+// Reads the close frame the server sent.
+//
+// Returns its status code, 1005 if it has none
+func readCloseCode(t testing.TB, reader *bufio.Reader) uint16 {
+	t.Helper()
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			t.Fatalf("no close frame: %v", err)
+		}
+		// Server frames are unmasked, the tests only expect short ones
+		payload := make([]byte, header[1]&127)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			t.Fatal(err)
+		}
+		if header[0]&15 != 8 {
+			continue
+		}
+		if len(payload) < 2 {
+			return 1005
+		}
+		return uint16(payload[0])<<8 | uint16(payload[1])
+	}
+}
+
+// Waits until the server has n clients or fails the test after a few seconds.
+func waitClients(t testing.TB, srv *Server, n int) {
+	t.Helper()
+	count := func() int {
+		srv.ClientsMu.Lock()
+		defer srv.ClientsMu.Unlock()
+		return len(srv.Clients)
+	}
+	for deadline := time.Now().Add(3 * time.Second); count() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("server has %d clients, want %d", count(), n)
+		}
+	}
+}
+
+// Waits for a value or fails the test after a few seconds.
+func receive[T any](t testing.TB, values <-chan T) T {
+	t.Helper()
+	select {
+	case value := <-values:
+		return value
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out")
+	}
+	var zero T
+	return zero
+}
+
+// Returns a config holding a self-signed certificate for localhost and its pool.
+func testTLSConfig(t testing.TB) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, pool
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	config, pool := testTLSConfig(t)
+
+	tests := []struct {
+		name string
+		// Sets a fingerprint policy
+		policy      bool
+		fingerprint bool
+	}{
+		{name: "crypto/tls only", policy: false, fingerprint: false},
+		{name: "fingerprint policy", policy: true, fingerprint: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fingerprinted := make(chan bool, 1)
+			srv := NewServer("", "")
+			if test.policy {
+				srv.CheckFingerprint = func(fingerprint *mtls.Fingerprint) bool { return true }
+			}
+			handler := func(ws *websocket.Ws, srv *Server) (uint16, error) {
+				select {
+				case fingerprinted <- ws.Fingerprint != nil:
+				default:
+				}
+				return echoHandler(ws, srv)
+			}
+			address := startServer(t, func(srv *Server) { srv.ListenAndServeTLS(handler, "/ws", config) }, srv)
+			_, port, _ := net.SplitHostPort(address)
+
+			echoed := make(chan string, 1)
+			err := wsclient.ConnectURL("wss://localhost:"+port+"/ws", func(ws *wsclient.ClientWs) {
+				ws.WriteText("hello")
+				_, data, _ := ws.ReadMessage()
+				echoed <- string(data)
+			}, &wsclient.TLSOptions{RootCAs: pool})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := receive(t, echoed); got != "hello" {
+				t.Fatalf("echoed %q", got)
+			}
+			if got := receive(t, fingerprinted); got != test.fingerprint {
+				t.Errorf("fingerprinted = %v, want %v", got, test.fingerprint)
+			}
+		})
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	// Handler returning status and err right away
+	failing := func(status uint16, err error) func(ws *websocket.Ws, srv *Server) (uint16, error) {
+		return func(ws *websocket.Ws, srv *Server) (uint16, error) { return status, err }
+	}
+	tests := []struct {
+		name string
+		// Handler of the connection, nil uses Handle
+		handler func(ws *websocket.Ws, srv *Server) (uint16, error)
+		// The client drops the connection
+		drop bool
+		// Close code sent, 1006 means no close frame
+		code uint16
+	}{
+		{name: "dropped", drop: true, code: 1006},
+		{name: "dropped with status 0", drop: true, code: 1006, handler: func(ws *websocket.Ws, srv *Server) (uint16, error) {
+			// The handler of main.go
+			_, _, err := ws.ReadMessage()
+			return 0, err
+		}},
+		{name: "closed connection", handler: failing(1000, fmt.Errorf("write: %w", net.ErrClosed)), code: 1006},
+		{name: "status 0", handler: failing(0, errors.New("failed")), code: 1011},
+		{name: "reserved status", handler: failing(1005, errors.New("failed")), code: 1011},
+		{name: "application status", handler: failing(4001, errors.New("failed")), code: 4001},
+		{name: "long reason", handler: failing(1011, errors.New(strings.Repeat("é", 100))), code: 1011},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := NewServer("", "")
+			closes := make(chan uint16, 1)
+			handler := test.handler
+			if handler == nil {
+				handler = srv.Handle(&Handlers{OnClose: func(ws *websocket.Ws, code uint16, reason string) { closes <- code }})
+			}
+			address := startServer(t, func(srv *Server) { srv.ListenAndServe(handler, "/ws") }, srv)
+			conn, reader := dialRaw(t, address)
+			defer conn.Close()
+			if test.drop {
+				// The server reads EOF while it could still write
+				conn.(*net.TCPConn).CloseWrite()
+				if test.handler == nil {
+					if code := receive(t, closes); code != 1006 {
+						t.Errorf("OnClose got %d, want 1006", code)
+					}
+				}
+			}
+
+			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			received, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.code == 1006 {
+				if len(received) != 0 {
+					t.Fatalf("server sent %x, want no close frame", received)
+				}
+				return
+			}
+			// Unmasked close frame: header, code, reason
+			if len(received) < 4 || received[0] != 0x88 || int(received[1]) != len(received)-2 {
+				t.Fatalf("not one close frame: %x", received)
+			}
+			if code := uint16(received[2])<<8 | uint16(received[3]); code != test.code {
+				t.Errorf("close code %d, want %d", code, test.code)
+			}
+			if reason := received[4:]; len(reason) > 123 || !utf8.Valid(reason) {
+				t.Errorf("reason of %d bytes, valid UTF-8: %v", len(reason), utf8.Valid(reason))
+			}
+		})
+	}
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	srv := NewServer("", "")
+	address := startServer(t, func(srv *Server) { srv.ListenAndServe(echoHandler, "/ws") }, srv)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nBogus\r\nHost: x\r\n\r\n"))
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", response.StatusCode)
+	}
+
+	// The server is still up
+	conn, _ = dialRaw(t, address)
+	conn.Close()
+}